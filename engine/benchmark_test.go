@@ -75,6 +75,33 @@ func BenchmarkSinglepassStringFuncGoWASM(b *testing.B) {
 	}
 }
 
+func BenchmarkSinglepassBoundStringFuncGoWASM(b *testing.B) {
+	e := setupEngine("../_test_fixtures/go/no_imports/module.wasm", CompilerSinglepass, b)
+
+	inst, err := e.GetInstance("test", "")
+	if err != nil {
+		b.Error(err)
+		b.FailNow()
+	}
+
+	var stringFunc func(string) (string, error)
+	err = inst.Bind("string_func", &stringFunc)
+	if err != nil {
+		b.Error(err)
+		b.FailNow()
+	}
+
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		_, err := stringFunc("Nic")
+		if err != nil {
+			b.Error(err)
+			b.FailNow()
+		}
+	}
+}
+
 func BenchmarkCraneliftIntFuncGoWASM(b *testing.B) {
 	e := setupEngine("../_test_fixtures/go/no_imports/module.wasm", CompilerCranelift, b)
 
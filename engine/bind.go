@@ -0,0 +1,132 @@
+package engine
+
+import (
+	"context"
+	"reflect"
+
+	"golang.org/x/xerrors"
+)
+
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+// Bind sets the Go func variable pointed to by fnPtr to a function that calls the
+// function name exported by the module, i.e.
+//
+//	var hello func(string) (string, error)
+//	err := i.Bind("hello", &hello)
+//
+//	out, err := hello("Nic")
+//
+// The func must return an error as its last result, the other results are set from
+// the values returned by the function. The first parameter can be a context.Context
+// which is used in the same way as CallFunctionContext. The parameters and results are
+// converted in the same way as CallFunction, the signature is checked against the
+// exported function when Bind is called and the export is only looked up once.
+func (i *wasmerInstance) Bind(name string, fnPtr interface{}) error {
+	pv := reflect.ValueOf(fnPtr)
+	if pv.Kind() != reflect.Ptr || pv.IsNil() || pv.Elem().Kind() != reflect.Func {
+		return xerrors.Errorf("fnPtr must be a pointer to a func, got %T", fnPtr)
+	}
+
+	ft := pv.Elem().Type()
+
+	// the export is looked up holding the call slot so that the instance can not be
+	// removed at the same time
+	i.calls <- struct{}{}
+	fn, err := i.lookupFunction(name)
+	<-i.calls
+
+	if err != nil {
+		return err
+	}
+
+	err = i.validateBinding(name, ft, fn)
+	if err != nil {
+		return xerrors.Errorf("unable to bind function %s: %w", name, err)
+	}
+
+	hasContext := ft.NumIn() > 0 && ft.In(0) == contextType
+	numResults := ft.NumOut() - 1
+
+	wrapper := reflect.MakeFunc(ft, func(args []reflect.Value) []reflect.Value {
+		ctx := context.Background()
+		if hasContext {
+			if c, ok := args[0].Interface().(context.Context); ok && c != nil {
+				ctx = c
+			}
+
+			args = args[1:]
+		}
+
+		params := make([]interface{}, len(args))
+		for n, a := range args {
+			params[n] = a.Interface()
+		}
+
+		outs := make([]reflect.Value, numResults)
+		results := make(Results, numResults)
+		for n := range outs {
+			outs[n] = reflect.New(ft.Out(n))
+			results[n] = outs[n].Interface()
+		}
+
+		var outputParam interface{}
+		switch numResults {
+		case 0:
+		case 1:
+			outputParam = results[0]
+		default:
+			outputParam = results
+		}
+
+		errValue := reflect.Zero(errorType)
+
+		err := i.call(ctx, name, fn, outputParam, params)
+		if err != nil {
+			errValue = reflect.ValueOf(err)
+		}
+
+		ret := make([]reflect.Value, 0, ft.NumOut())
+		for n, o := range outs {
+			if err != nil {
+				ret = append(ret, reflect.Zero(ft.Out(n)))
+				continue
+			}
+
+			ret = append(ret, o.Elem())
+		}
+
+		return append(ret, errValue)
+	})
+
+	pv.Elem().Set(wrapper)
+
+	return nil
+}
+
+// validateBinding checks that the func type ft can be used to call the exported function fn
+func (i *wasmerInstance) validateBinding(name string, ft reflect.Type, fn *exportedFunction) error {
+	if ft.IsVariadic() {
+		return xerrors.Errorf("variadic functions can not be bound")
+	}
+
+	if ft.NumOut() == 0 || ft.Out(ft.NumOut()-1) != errorType {
+		return xerrors.Errorf("func must return an error as its last result")
+	}
+
+	params := []reflect.Type{}
+	for n := 0; n < ft.NumIn(); n++ {
+		if n == 0 && ft.In(n) == contextType {
+			continue
+		}
+
+		params = append(params, ft.In(n))
+	}
+
+	results := []reflect.Type{}
+	for n := 0; n < ft.NumOut()-1; n++ {
+		results = append(results, ft.Out(n))
+	}
+
+	return i.checkSignature(name, fn, params, results)
+}
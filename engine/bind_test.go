@@ -0,0 +1,137 @@
+package engine
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBindCallsFunction(t *testing.T) {
+	i, _ := testSetupEngine(t, goModule, nil)
+
+	var stringFunc func(string) (string, error)
+	err := i.Bind("string_func", &stringFunc)
+	require.NoError(t, err)
+
+	out, err := stringFunc("Nic")
+	require.NoError(t, err)
+	require.Equal(t, "Hello Nic", out)
+
+	var intFunc func(context.Context, int32, int32) (int32, error)
+	err = i.Bind("int_func", &intFunc)
+	require.NoError(t, err)
+
+	sum, err := intFunc(context.Background(), 3, 2)
+	require.NoError(t, err)
+	require.Equal(t, int32(5), sum)
+}
+
+func TestBindCallsFunctionWithNumericTypes(t *testing.T) {
+	i := setupNumericInstance(t)
+
+	var add func(int64, int64) (int64, error)
+	err := i.Bind("add_i64", &add)
+	require.NoError(t, err)
+
+	out, err := add(1, 2)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), out)
+
+	var scale func(float64) (float64, error)
+	err = i.Bind("scale_f64", &scale)
+	require.NoError(t, err)
+
+	f, err := scale(1.5)
+	require.NoError(t, err)
+	require.Equal(t, 3.0, f)
+}
+
+func TestBindCallsFunctionWithStructuredArguments(t *testing.T) {
+	i := setupWatInstance(t, watEchoBytes, &PluginConfig{EncodeArguments: true})
+
+	var echo func(testPerson) (*testPerson, error)
+	err := i.Bind("echo", &echo)
+	require.NoError(t, err)
+
+	out, err := echo(testPerson{Name: "Nic", Age: 21})
+	require.NoError(t, err)
+	require.Equal(t, &testPerson{Name: "Nic", Age: 21}, out)
+}
+
+func TestBindReturnsErrorFromFunction(t *testing.T) {
+	i := setupNumericInstance(t)
+
+	var negate func(int32) (int32, error)
+	err := i.Bind("negate", &negate)
+	require.NoError(t, err)
+
+	var add func(int32, int64) (int32, error)
+	err = i.Bind("negate", &add)
+	require.Error(t, err)
+
+	var overflow func(int) (int32, error)
+	err = i.Bind("negate", &overflow)
+	require.NoError(t, err)
+
+	out, err := overflow(1 << 40)
+	require.Error(t, err)
+	require.Equal(t, int32(0), out)
+}
+
+func TestBindReturnsErrorWhenFunctionNotFound(t *testing.T) {
+	i := setupNumericInstance(t)
+
+	var fn func() error
+	err := i.Bind("not_exist", &fn)
+	require.IsType(t, FunctionNotFoundError{}, err)
+	require.Nil(t, fn)
+}
+
+func TestBindValidatesSignature(t *testing.T) {
+	i := setupNumericInstance(t)
+
+	tests := map[string]interface{}{
+		"not a pointer":      func(int32) (int32, error) { return 0, nil },
+		"not a func":         new(int32),
+		"no error result":    new(func(int32) int32),
+		"too many results":   new(func(int32) (int32, int32, error)),
+		"variadic":           new(func(...int32) (int32, error)),
+		"too many params":    new(func(int32, int32) (int32, error)),
+		"too few params":     new(func() (int32, error)),
+		"wrong param kind":   new(func(float32) (int32, error)),
+		"wrong result kind":  new(func(int32) (float64, error)),
+		"unsupported param":  new(func(testPerson) (int32, error)),
+		"unsupported result": new(func(int32) (map[string]int, error)),
+	}
+
+	for name, fn := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := i.Bind("negate", fn)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestBindReturnsErrorWhenInstanceIsRemoved(t *testing.T) {
+	i := setupNumericInstance(t)
+
+	// Bind and Remove run at the same time so that the race detector can check them
+	done := make(chan error)
+	go func() {
+		var negate func(int32) (int32, error)
+		done <- i.Bind("negate", &negate)
+	}()
+
+	err := i.Remove()
+	require.NoError(t, err)
+
+	err = <-done
+	if err != nil {
+		require.ErrorIs(t, err, ErrInstanceRemoved)
+	}
+
+	var negate func(int32) (int32, error)
+	err = i.Bind("negate", &negate)
+	require.ErrorIs(t, err, ErrInstanceRemoved)
+}
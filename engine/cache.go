@@ -0,0 +1,232 @@
+package engine
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime/debug"
+	"unsafe"
+
+	"github.com/nicholasjackson/wasp/engine/logger"
+	"github.com/wasmerio/wasmer-go/wasmer"
+	"golang.org/x/xerrors"
+)
+
+// wasmerModule is the Go module path for the Wasmer runtime, the version of
+// this module is used to invalidate cached modules when the runtime changes
+const wasmerModule = "github.com/wasmerio/wasmer-go"
+
+// defaultWasmerVersion is used when the version of the Wasmer runtime can not
+// be determined from the build information
+const defaultWasmerVersion = "v1.0.3"
+
+// cacheFormat is written at the start of every cache file, it must be changed
+// when the format of the cache file changes. Changes to the instrumentation do not
+// need a new format as the key is the hash of the instrumented module.
+var cacheFormat = []byte("wasp-module-cache-v1\n")
+
+// moduleLayoutSupported is true when wasmer.Module has the layout of wasmer-go v1.0.3,
+// the store for a deserialized module can only be set when the layout is known, see
+// setModuleStore. When the layout is not known modules are compiled without the cache.
+var moduleLayoutSupported = checkModuleLayout()
+
+// checkModuleLayout returns true when the fields of wasmer.Module are the pointer to the
+// Wasmer module followed by the store
+func checkModuleLayout() bool {
+	t := reflect.TypeOf(wasmer.Module{})
+	if t.NumField() != 2 {
+		return false
+	}
+
+	inner, store := t.Field(0), t.Field(1)
+
+	return inner.Name == "_inner" && inner.Type.Kind() == reflect.Ptr &&
+		store.Name == "store" && store.Type == reflect.TypeOf(&wasmer.Store{})
+}
+
+// moduleCache stores compiled modules on disk so that they do not need
+// to be compiled every time the engine is started.
+//
+// Modules are keyed by the SHA-256 of the Wasm binary, the compiler and the version
+// of the Wasmer runtime. Each cache file contains the key and a checksum of the serialized
+// module, files that do not match are removed and the module is recompiled.
+type moduleCache struct {
+	dir      string
+	compiler Compiler
+	version  string
+	log      *logger.Wrapper
+}
+
+// newModuleCache creates a cache that stores compiled modules in dir,
+// the directory is created if it does not exist
+func newModuleCache(dir string, compiler Compiler, log *logger.Wrapper) (*moduleCache, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, xerrors.Errorf("unable to create cache directory %s: %w", dir, err)
+	}
+
+	if !moduleLayoutSupported {
+		log.Error("Compiled modules will not be cached, the version of Wasmer is not supported", "version", wasmerVersion())
+	}
+
+	return &moduleCache{
+		dir:      dir,
+		compiler: compiler,
+		version:  wasmerVersion(),
+		log:      log,
+	}, nil
+}
+
+// wasmerVersion returns the version of the Wasmer runtime the engine was built with
+func wasmerVersion() string {
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, d := range bi.Deps {
+			if d.Path != wasmerModule {
+				continue
+			}
+
+			if d.Replace != nil {
+				return d.Replace.Path + "@" + d.Replace.Version
+			}
+
+			return d.Version
+		}
+	}
+
+	return defaultWasmerVersion
+}
+
+// key returns the cache key for the Wasm binary
+func (c *moduleCache) key(wasm []byte) []byte {
+	h := sha256.New()
+	h.Write(wasm)
+	h.Write([]byte{0})
+	h.Write([]byte(c.compiler))
+	h.Write([]byte{0})
+	h.Write([]byte(c.version))
+
+	return h.Sum(nil)
+}
+
+func (c *moduleCache) path(key []byte) string {
+	return filepath.Join(c.dir, hex.EncodeToString(key)+".module")
+}
+
+// compile returns the compiled module for the Wasm binary, when the module
+// is not in the cache it is compiled and added to the cache
+func (c *moduleCache) compile(store *wasmer.Store, wasm []byte) (*wasmer.Module, error) {
+	if !moduleLayoutSupported {
+		return wasmer.NewModule(store, wasm)
+	}
+
+	key := c.key(wasm)
+
+	m, err := c.load(store, key)
+	if err == nil {
+		c.log.Debug("Loaded module from cache", "path", c.path(key))
+		return m, nil
+	}
+
+	if !os.IsNotExist(err) {
+		// the cache file is invalid, remove it so that it can be replaced
+		c.log.Debug("Invalidating cached module", "path", c.path(key), "error", err)
+		os.Remove(c.path(key))
+	}
+
+	m, err = wasmer.NewModule(store, wasm)
+	if err != nil {
+		return nil, err
+	}
+
+	// failing to write the cache should not stop the module from being used
+	err = c.save(key, m)
+	if err != nil {
+		c.log.Error("Unable to write module to cache", "path", c.path(key), "error", err)
+	}
+
+	return m, nil
+}
+
+// load reads the module with the given key from the cache
+func (c *moduleCache) load(store *wasmer.Store, key []byte) (*wasmer.Module, error) {
+	data, err := ioutil.ReadFile(c.path(key))
+	if err != nil {
+		return nil, err
+	}
+
+	headerLen := len(cacheFormat) + len(key) + sha256.Size
+	if len(data) < headerLen || !bytes.HasPrefix(data, cacheFormat) {
+		return nil, xerrors.Errorf("cache file has an invalid header")
+	}
+
+	header := data[len(cacheFormat):headerLen]
+	serialized := data[headerLen:]
+
+	if !bytes.Equal(header[:len(key)], key) {
+		return nil, xerrors.Errorf("cache file key does not match")
+	}
+
+	sum := sha256.Sum256(serialized)
+	if !bytes.Equal(header[len(key):], sum[:]) {
+		return nil, xerrors.Errorf("cache file checksum does not match")
+	}
+
+	m, err := wasmer.DeserializeModule(store, serialized)
+	if err != nil {
+		return nil, xerrors.Errorf("unable to deserialize module: %w", err)
+	}
+
+	setModuleStore(m, store)
+
+	return m, nil
+}
+
+// setModuleStore sets the store for a deserialized module, wasmer-go v1.0.3
+// does not set the store in DeserializeModule which causes NewInstance to
+// panic and wasmer-go does not have another way to deserialize a module.
+// The field is only written when moduleLayoutSupported is true, and when the
+// store is empty so that a version of wasmer-go that fixes the issue is not
+// affected.
+func setModuleStore(m *wasmer.Module, store *wasmer.Store) {
+	f := reflect.ValueOf(m).Elem().Field(1)
+	if !f.IsNil() {
+		return
+	}
+
+	reflect.NewAt(f.Type(), unsafe.Pointer(f.UnsafeAddr())).Elem().Set(reflect.ValueOf(store))
+}
+
+// save writes the compiled module to the cache, the file is written to a
+// temporary location and renamed so that partial files are never read
+func (c *moduleCache) save(key []byte, m *wasmer.Module) error {
+	serialized, err := m.Serialize()
+	if err != nil {
+		return xerrors.Errorf("unable to serialize module: %w", err)
+	}
+
+	f, err := ioutil.TempFile(c.dir, "module-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	sum := sha256.Sum256(serialized)
+
+	for _, d := range [][]byte{cacheFormat, key, sum[:], serialized} {
+		if _, err := f.Write(d); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), c.path(key))
+}
@@ -0,0 +1,124 @@
+package engine
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func setupCacheTests(t *testing.T, dir string, c Compiler) *Wasm {
+	e, err := NewWithOptions(nil, Options{Compiler: c, CacheDir: dir})
+	require.NoError(t, err)
+
+	err = e.RegisterPlugin("test", goModule, nil)
+	require.NoError(t, err)
+
+	return e
+}
+
+func cacheFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*.module"))
+	require.NoError(t, err)
+
+	return files
+}
+
+func TestCacheWritesCompiledModule(t *testing.T) {
+	dir := t.TempDir()
+	setupCacheTests(t, dir, CompilerSinglepass)
+
+	require.Len(t, cacheFiles(t, dir), 1)
+}
+
+func TestCacheLoadsCompiledModule(t *testing.T) {
+	dir := t.TempDir()
+	setupCacheTests(t, dir, CompilerSinglepass)
+
+	files := cacheFiles(t, dir)
+	require.Len(t, files, 1)
+
+	e := setupCacheTests(t, dir, CompilerSinglepass)
+	callIntFunc(t, e)
+
+	require.Equal(t, files, cacheFiles(t, dir))
+}
+
+func TestCacheKeyIncludesCompiler(t *testing.T) {
+	dir := t.TempDir()
+	setupCacheTests(t, dir, CompilerSinglepass)
+	setupCacheTests(t, dir, CompilerCranelift)
+
+	require.Len(t, cacheFiles(t, dir), 2)
+}
+
+func TestCacheKeyIncludesPluginConfig(t *testing.T) {
+	dir := t.TempDir()
+	setupCacheTests(t, dir, CompilerSinglepass)
+
+	e, err := NewWithOptions(nil, Options{CacheDir: dir})
+	require.NoError(t, err)
+
+	// metering changes the instrumented module so it must be cached separately
+	err = e.RegisterPlugin("test", goModule, &PluginConfig{Callbacks: &Callbacks{}, Fuel: 1000})
+	require.NoError(t, err)
+
+	require.Len(t, cacheFiles(t, dir), 2)
+}
+
+func TestCacheReplacesInvalidModule(t *testing.T) {
+	dir := t.TempDir()
+	setupCacheTests(t, dir, CompilerSinglepass)
+
+	files := cacheFiles(t, dir)
+	require.Len(t, files, 1)
+
+	// corrupt the cached module
+	data, err := ioutil.ReadFile(files[0])
+	require.NoError(t, err)
+
+	data[len(data)-1] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(files[0], data, 0600))
+
+	e := setupCacheTests(t, dir, CompilerSinglepass)
+	callIntFunc(t, e)
+
+	// the cache file should have been rewritten
+	c, err := newModuleCache(dir, CompilerSinglepass, e.log)
+	require.NoError(t, err)
+
+	wasm, err := ioutil.ReadFile(goModule)
+	require.NoError(t, err)
+
+	iw, _, err := instrumentModule(wasm, instrumentOptions{})
+	require.NoError(t, err)
+
+	_, err = c.load(e.store, c.key(iw))
+	require.NoError(t, err)
+}
+
+func TestNewWithOptionsReturnsErrorWhenCacheDirInvalid(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, ioutil.WriteFile(f, []byte("not a dir"), 0600))
+
+	_, err := NewWithOptions(nil, Options{CacheDir: f})
+	require.Error(t, err)
+}
+
+func TestCacheChecksWasmerModuleLayout(t *testing.T) {
+	// the layout is pinned to the version of wasmer-go in go.mod, the test fails when
+	// wasmer-go is updated so that setModuleStore can be checked
+	require.True(t, checkModuleLayout())
+}
+
+func TestCacheCompilesModulesWhenLayoutIsNotSupported(t *testing.T) {
+	moduleLayoutSupported = false
+	defer func() { moduleLayoutSupported = checkModuleLayout() }()
+
+	dir := t.TempDir()
+	e := setupCacheTests(t, dir, CompilerSinglepass)
+	require.Empty(t, cacheFiles(t, dir))
+
+	callIntFunc(t, e)
+}
@@ -1,6 +1,7 @@
 package engine
 
 import (
+	"fmt"
 	"reflect"
 
 	"github.com/nicholasjackson/wasp/engine/logger"
@@ -51,42 +52,103 @@ func (c *Callbacks) addCallbacks(i Instance, store *wasmer.Store, log *logger.Wr
 func createCallback(i Instance, log *logger.Wrapper, ns, name string, callFunc interface{}) (*wasmer.FunctionType, func([]wasmer.Value) ([]wasmer.Value, error)) {
 	callback := reflect.TypeOf(callFunc)
 
+	// unsupported types are reported when the callback is called
 	inParams := []wasmer.ValueKind{}
-	for i := 0; i < callback.NumIn(); i++ {
-		inParams = append(inParams, wasmer.I32)
+	for n := 0; n < callback.NumIn(); n++ {
+		k, _ := wasmKind(callback.In(n))
+		inParams = append(inParams, k)
+	}
+
+	// a trailing error is not returned to the module, the error can be read by the
+	// module using the default import last_host_error
+	numOut := callback.NumOut()
+	returnsError := numOut > 0 && callback.Out(numOut-1) == errorType
+	if returnsError {
+		numOut--
 	}
 
 	outParams := []wasmer.ValueKind{}
-	for i := 0; i < callback.NumOut(); i++ {
-		outParams = append(outParams, wasmer.I32)
+	resultGlobals := false
+	for n := 0; n < numOut; n++ {
+		k, _ := wasmKind(callback.Out(n))
+		outParams = append(outParams, k)
+
+		resultGlobals = resultGlobals || k != wasmer.I32
+	}
+
+	// Wasmer can only return i32 values from host functions, callbacks that return other
+	// types set the result globals added to the module by instrumentModule and the function
+	// type has no results
+	resultKinds := outParams
+	if resultGlobals {
+		outParams = []wasmer.ValueKind{}
 	}
 
 	ft := wasmer.NewFunctionType(
 		wasmer.NewValueTypes(inParams...),
 		wasmer.NewValueTypes(outParams...))
 
-	ff := func(args []wasmer.Value) ([]wasmer.Value, error) {
+	// fail stops the module when the callback can not be completed, returning an error
+	// from the host function crashes the Wasmer runtime so the error is set on the
+	// instance and the module is interrupted, the module traps when the callback returns.
+	// The interrupt is cleared before the memory allocated for the call is freed.
+	fail := func(err error) ([]wasmer.Value, error) {
+		err = xerrors.Errorf("callback function %s.%s failed: %w", ns, name, err)
+		log.Error("Callback failed", "namespace", ns, "name", name, "error", err)
+
+		i.setError(err)
+		i.interrupt()
+
+		return zeroValues(ft.Results()), nil
+	}
+
+	ff := func(args []wasmer.Value) (results []wasmer.Value, err error) {
+		// a panic can not be allowed to unwind through the Wasmer runtime, the
+		// panic is returned from the function call as a TrapError and like fail
+		// the interrupt is cleared before the memory for the call is freed
+		defer func() {
+			if r := recover(); r != nil {
+				log.Error("Callback panicked", "namespace", ns, "name", name, "panic", r)
+
+				i.setError(TrapError{Kind: TrapHostPanic, Message: fmt.Sprintf("callback function %s.%s panicked: %v", ns, name, r)})
+				i.interrupt()
+
+				results, err = zeroValues(ft.Results()), nil
+			}
+		}()
 
 		log.Debug("Callback called", "namespace", ns, "name", name, "args", args)
 
+		// stop the module if the function call has been cancelled, the module
+		// traps as soon as the callback returns
+		if i.callContext().Err() != nil {
+			i.interrupt()
+			return zeroValues(ft.Results()), nil
+		}
+
 		// build the parameter list
 		inParams := []reflect.Value{}
 		for n := 0; n < callback.NumIn(); n++ {
-			switch callback.In(n).Kind() {
-			case reflect.String:
-				in, err := i.getStringFromMemory(args[n].I32())
+			if _, err := wasmKind(callback.In(n)); err != nil {
+				return fail(err)
+			}
+
+			switch {
+			case passedByPointer(callback.In(n)):
+				ps, err := readParameter(i, args[n].I32(), callback.In(n))
 				if err != nil {
-					panic(err)
+					return fail(xerrors.Errorf("unable to read parameter %d: %w", n, err))
 				}
 
-				ps := reflect.ValueOf(in)
-				inParams = append(inParams, ps)
-			case reflect.Int32:
-				ps := reflect.ValueOf(args[n].I32())
 				inParams = append(inParams, ps)
 
 			default:
-				return nil, xerrors.Errorf("only String and Int32 parameters can currently be used for callback functions")
+				ps, err := fromWasmValue(args[n].Unwrap(), callback.In(n))
+				if err != nil {
+					return fail(xerrors.Errorf("unable to convert parameter %d: %w", n, err))
+				}
+
+				inParams = append(inParams, ps)
 			}
 		}
 
@@ -98,37 +160,157 @@ func createCallback(i Instance, log *logger.Wrapper, ns, name string, callFunc i
 
 		// check returned parameters = expected
 		if len(out) != callback.NumOut() {
-			return nil, xerrors.Errorf(
-				"callback function %s.%s received with incorrect number of return parameters, expected: %d, received: %d, signature: %s",
-				ns,
-				name,
+			return fail(xerrors.Errorf(
+				"received incorrect number of return parameters, expected: %d, received: %d, signature: %s",
 				callback.NumOut(),
 				len(out),
 				callback.String(),
-			)
+			))
+		}
+
+		// when the callback returns an error the module receives zero values, and the
+		// error is available from last_host_error
+		if returnsError {
+			var err error
+			if e := out[numOut]; !e.IsNil() {
+				err = e.Interface().(error)
+			}
+
+			i.setHostError(err)
+
+			if err != nil {
+				log.Debug("Callback returned an error", "namespace", ns, "name", name, "error", err)
+
+				if resultGlobals {
+					zero := zeroValues(wasmer.NewValueTypes(resultKinds...))
+					if err := i.setResultGlobals(zero); err != nil {
+						return fail(err)
+					}
+				}
+
+				return zeroValues(ft.Results()), nil
+			}
 		}
 
 		// process the response parameters
 		outParams := []wasmer.Value{}
-		for n := 0; n < callback.NumOut(); n++ {
-			switch callback.Out(n).Kind() {
-			case reflect.String:
-				s, err := i.setStringInMemory(out[n].String())
+		for n := 0; n < numOut; n++ {
+			k, err := wasmKind(callback.Out(n))
+			if err != nil {
+				return fail(err)
+			}
+
+			switch {
+			case passedByPointer(callback.Out(n)):
+				addr, err := writeResult(i, out[n])
 				if err != nil {
-					panic(err)
+					return fail(xerrors.Errorf("unable to write return parameter %d: %w", n, err))
 				}
 
-				outParams = append(outParams, wasmer.NewI32(s))
-			case reflect.Int32:
-				outParams = append(outParams, wasmer.NewI32(int32(out[n].Int())))
+				outParams = append(outParams, wasmer.NewI32(addr))
 
 			default:
-				return nil, xerrors.Errorf("only String and Int32 parameters can be used for callback functions")
+				v, err := toWasmValue(out[n], k)
+				if err != nil {
+					return fail(xerrors.Errorf("unable to convert return parameter %d: %w", n, err))
+				}
+
+				outParams = append(outParams, wasmer.NewValue(v, k))
 			}
 		}
 
+		if resultGlobals {
+			err := i.setResultGlobals(outParams)
+			if err != nil {
+				return fail(err)
+			}
+
+			return []wasmer.Value{}, nil
+		}
+
 		return outParams, nil
 	}
 
 	return ft, ff
 }
+
+// errorType is the type of the error interface
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// readParameter reads a callback parameter that is passed as a pointer to data in the modules
+// memory, like strings the memory is freed when the function call that called the callback completes
+func readParameter(i Instance, addr int32, t reflect.Type) (reflect.Value, error) {
+	if t.Kind() == reflect.String {
+		s, err := i.getStringFromMemory(addr)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+
+		return reflect.ValueOf(s).Convert(t), nil
+	}
+
+	data, err := i.getBytesFromMemory(addr)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+
+	switch t.Kind() {
+	case reflect.Slice:
+		return reflect.ValueOf(data).Convert(t), nil
+
+	case reflect.Ptr:
+		v := reflect.New(t.Elem())
+		err := i.getCodec().Unmarshal(data, v.Interface())
+		if err != nil {
+			return reflect.Value{}, xerrors.Errorf("unable to unmarshal %s: %w", t, err)
+		}
+
+		return v, nil
+
+	default:
+		v := reflect.New(t)
+		err := i.getCodec().Unmarshal(data, v.Interface())
+		if err != nil {
+			return reflect.Value{}, xerrors.Errorf("unable to unmarshal %s: %w", t, err)
+		}
+
+		return v.Elem(), nil
+	}
+}
+
+// writeResult copies a callback result that is passed as a pointer to the modules memory,
+// the memory is freed when the function call that called the callback completes
+func writeResult(i Instance, v reflect.Value) (int32, error) {
+	switch v.Kind() {
+	case reflect.String:
+		return i.setStringInMemory(v.String())
+
+	case reflect.Slice:
+		return i.setBytesInMemory(v.Bytes())
+
+	default:
+		data, err := i.getCodec().Marshal(v.Interface())
+		if err != nil {
+			return 0, xerrors.Errorf("unable to marshal %s: %w", v.Type(), err)
+		}
+
+		return i.setBytesInMemory(data)
+	}
+}
+
+// zeroValues returns a zero value for each of the given types
+func zeroValues(types []*wasmer.ValueType) []wasmer.Value {
+	values := []wasmer.Value{}
+	for _, t := range types {
+		switch t.Kind() {
+		case wasmer.F32:
+			values = append(values, wasmer.NewF32(float32(0)))
+		case wasmer.F64:
+			values = append(values, wasmer.NewF64(float64(0)))
+		default:
+			values = append(values, wasmer.NewValue(0, t.Kind()))
+		}
+	}
+
+	return values
+}
@@ -1,10 +1,14 @@
 package engine
 
 import (
+	"context"
+	"fmt"
+	"math"
 	"testing"
 
 	"github.com/hashicorp/go-hclog"
 	"github.com/nicholasjackson/wasp/engine/logger"
+	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 	"github.com/wasmerio/wasmer-go/wasmer"
 )
@@ -14,6 +18,7 @@ func setupCallbackTests(t *testing.T) (*mockInstance, *logger.Wrapper) {
 	wl := logger.New(l.Info, l.Debug, l.Error, l.Trace)
 
 	mi := &mockInstance{}
+	mi.On("callContext").Return(context.Background())
 
 	return mi, wl
 }
@@ -69,6 +74,25 @@ func TestCallbackFunctionPassesPtrAsString(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestCallbackFunctionInterruptsInstanceWhenContextCancelled(t *testing.T) {
+	_, l := setupCallbackTests(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	i := &mockInstance{}
+	i.On("callContext").Return(ctx)
+	i.On("interrupt")
+
+	_, ff := createCallback(i, l, "testns", "testfunc", testCallbackFuncInt)
+
+	out, err := ff([]wasmer.Value{wasmer.NewI32(1)})
+	require.NoError(t, err)
+	require.Equal(t, int32(0), out[0].I32())
+
+	i.AssertCalled(t, "interrupt")
+}
+
 func testCallbackFuncString(in string) string {
 	return in
 }
@@ -79,3 +103,336 @@ func testCallbackFuncInt(in int) int {
 
 func testCallbackFuncEmpty() {
 }
+
+func TestCreateCallbackCreatesFunctionWithCorrectSignatureNumeric(t *testing.T) {
+	i, l := setupCallbackTests(t)
+
+	ft, _ := createCallback(i, l, "testns", "testfunc", testCallbackFuncNumeric)
+
+	kinds := []wasmer.ValueKind{}
+	for _, p := range ft.Params() {
+		kinds = append(kinds, p.Kind())
+	}
+
+	require.Equal(t, []wasmer.ValueKind{wasmer.I64, wasmer.I64, wasmer.F32, wasmer.F64, wasmer.I32, wasmer.I32}, kinds)
+
+	// f64 results are returned using the result globals
+	require.Len(t, ft.Results(), 0)
+}
+
+func TestCallbackFunctionConvertsNumericParameters(t *testing.T) {
+	i, l := setupCallbackTests(t)
+
+	var results []wasmer.Value
+	i.On("setResultGlobals", mock.Anything).Run(func(args mock.Arguments) {
+		results = args.Get(0).([]wasmer.Value)
+	}).Return(nil)
+
+	_, ff := createCallback(i, l, "testns", "testfunc", testCallbackFuncNumeric)
+
+	out, err := ff([]wasmer.Value{
+		wasmer.NewI64(int64(1)),
+		wasmer.NewI64(int64(-1)),
+		wasmer.NewF32(float32(1.5)),
+		wasmer.NewF64(float64(2.5)),
+		wasmer.NewI32(int32(-1)),
+		wasmer.NewI32(int32(1)),
+	})
+	require.NoError(t, err)
+	require.Len(t, out, 0)
+
+	// 1 + 18446744073709551615 + 1.5 + 2.5 + 4294967295 + 1
+	require.Len(t, results, 1)
+	require.Equal(t, float64(1)+float64(math.MaxUint64)+1.5+2.5+float64(math.MaxUint32)+1, results[0].F64())
+}
+
+func TestCallbackFunctionInterruptsInstanceWhenResultOutOfRange(t *testing.T) {
+	i, l := setupCallbackTests(t)
+	i.On("setError", mock.Anything)
+	i.On("interrupt")
+
+	// int is passed as an i32, returning a value larger than an i32 fails
+	_, ff := createCallback(i, l, "testns", "testfunc", func() int { return math.MaxInt32 + 1 })
+
+	out, err := ff([]wasmer.Value{})
+	require.NoError(t, err)
+	require.Equal(t, int32(0), out[0].I32())
+
+	i.AssertCalled(t, "setError", mock.Anything)
+	i.AssertCalled(t, "interrupt")
+}
+
+func testCallbackFuncNumeric(a int64, b uint64, c float32, d float64, e uint32, f bool) float64 {
+	r := float64(a) + float64(b) + float64(c) + d + float64(e)
+	if f {
+		r++
+	}
+
+	return r
+}
+
+type testPerson struct {
+	Name string `json:"name" msgpack:"name"`
+	Age  int32  `json:"age" msgpack:"age"`
+}
+
+func TestCreateCallbackCreatesFunctionWithCorrectSignatureBytesAndStructs(t *testing.T) {
+	i, l := setupCallbackTests(t)
+
+	ft, _ := createCallback(i, l, "testns", "testfunc", func(a []byte, b testPerson, c *testPerson) *testPerson { return nil })
+
+	require.Len(t, ft.Params(), 3)
+	for _, p := range ft.Params() {
+		require.Equal(t, wasmer.I32, p.Kind())
+	}
+
+	require.Len(t, ft.Results(), 1)
+	require.Equal(t, wasmer.I32, ft.Results()[0].Kind())
+}
+
+func TestCallbackFunctionPassesBytes(t *testing.T) {
+	i, l := setupCallbackTests(t)
+	i.On("getBytesFromMemory", int32(10)).Return([]byte{1, 2, 3}, nil)
+	i.On("setBytesInMemory", []byte{3, 2, 1}).Return(int32(20), nil)
+
+	_, ff := createCallback(i, l, "testns", "testfunc", func(in []byte) []byte {
+		return []byte{in[2], in[1], in[0]}
+	})
+
+	out, err := ff([]wasmer.Value{wasmer.NewI32(10)})
+	require.NoError(t, err)
+	require.Equal(t, int32(20), out[0].I32())
+}
+
+func TestCallbackFunctionMarshalsStructs(t *testing.T) {
+	i, l := setupCallbackTests(t)
+	i.On("getCodec").Return(JSONCodec{})
+	i.On("getBytesFromMemory", int32(10)).Return([]byte(`{"name":"Nic","age":21}`), nil)
+	i.On("setBytesInMemory", []byte(`{"name":"Hello Nic","age":22}`)).Return(int32(20), nil)
+
+	_, ff := createCallback(i, l, "testns", "testfunc", func(in testPerson) *testPerson {
+		return &testPerson{Name: "Hello " + in.Name, Age: in.Age + 1}
+	})
+
+	out, err := ff([]wasmer.Value{wasmer.NewI32(10)})
+	require.NoError(t, err)
+	require.Equal(t, int32(20), out[0].I32())
+}
+
+func TestCallbackFunctionMarshalsStructsWithMsgpack(t *testing.T) {
+	in, err := MsgpackCodec{}.Marshal(testPerson{Name: "Nic", Age: 21})
+	require.NoError(t, err)
+
+	var got testPerson
+
+	i, l := setupCallbackTests(t)
+	i.On("getCodec").Return(MsgpackCodec{})
+	i.On("getBytesFromMemory", int32(10)).Return(in, nil)
+	i.On("setBytesInMemory", mock.Anything).Run(func(args mock.Arguments) {
+		err := MsgpackCodec{}.Unmarshal(args.Get(0).([]byte), &got)
+		require.NoError(t, err)
+	}).Return(int32(20), nil)
+
+	_, ff := createCallback(i, l, "testns", "testfunc", func(in *testPerson) testPerson {
+		return testPerson{Name: "Hello " + in.Name, Age: in.Age + 1}
+	})
+
+	_, err = ff([]wasmer.Value{wasmer.NewI32(10)})
+	require.NoError(t, err)
+	require.Equal(t, testPerson{Name: "Hello Nic", Age: 22}, got)
+}
+
+func TestCallbackFunctionInterruptsInstanceWhenStructCanNotBeUnmarshalled(t *testing.T) {
+	i, l := setupCallbackTests(t)
+	i.On("getCodec").Return(JSONCodec{})
+	i.On("getBytesFromMemory", int32(10)).Return([]byte(`not json`), nil)
+	i.On("setError", mock.Anything)
+	i.On("interrupt")
+
+	_, ff := createCallback(i, l, "testns", "testfunc", func(in testPerson) {})
+
+	_, err := ff([]wasmer.Value{wasmer.NewI32(10)})
+	require.NoError(t, err)
+
+	i.AssertCalled(t, "interrupt")
+}
+
+// watEcho is a module that passes length prefixed JSON to the echo callback and
+// returns the result, the module has a simple allocator that never frees memory
+var watEcho = `
+(module
+	(import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+	(import "env" "echo" (func $echo (param i32) (result i32)))
+	(memory (export "memory") 1)
+	(global $next (mut i32) (i32.const 1024))
+	(data (i32.const 16) "\17\00\00\00{\"name\":\"Nic\",\"age\":21}")
+	(func (export "allocate") (param $size i32) (result i32)
+		(local $addr i32)
+		(local.set $addr (global.get $next))
+		(global.set $next (i32.add (global.get $next) (local.get $size)))
+		(local.get $addr))
+	(func (export "deallocate") (param i32 i32))
+	(func (export "call_echo") (result i32)
+		(call $echo (i32.const 16))))
+`
+
+func TestCallbackReceivesAndReturnsStructsFromModule(t *testing.T) {
+	cb := &Callbacks{}
+	cb.AddCallback("env", "echo", func(in testPerson) testPerson {
+		return testPerson{Name: "Hello " + in.Name, Age: in.Age + 1}
+	})
+
+	i := setupWatInstance(t, watEcho, &PluginConfig{Callbacks: cb})
+
+	var out []byte
+	err := i.CallFunction("call_echo", &out)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"name":"Hello Nic","age":22}`, string(out))
+}
+
+func TestCreateCallbackCreatesFunctionWithoutTrailingError(t *testing.T) {
+	i, l := setupCallbackTests(t)
+
+	ft, _ := createCallback(i, l, "testns", "testfunc", func(in string) (string, error) { return in, nil })
+
+	require.Len(t, ft.Params(), 1)
+	require.Len(t, ft.Results(), 1)
+	require.Equal(t, wasmer.I32, ft.Results()[0].Kind())
+}
+
+func TestCallbackFunctionSetsHostErrorWhenCallbackReturnsError(t *testing.T) {
+	i, l := setupCallbackTests(t)
+	i.On("setHostError", mock.Anything)
+
+	_, ff := createCallback(i, l, "testns", "testfunc", func(in int32) (int32, error) {
+		return 12, fmt.Errorf("boom")
+	})
+
+	out, err := ff([]wasmer.Value{wasmer.NewI32(1)})
+	require.NoError(t, err)
+	require.Equal(t, int32(0), out[0].I32())
+
+	i.AssertCalled(t, "setHostError", fmt.Errorf("boom"))
+	i.AssertNotCalled(t, "interrupt")
+}
+
+func TestCallbackFunctionClearsHostErrorWhenCallbackSucceeds(t *testing.T) {
+	i, l := setupCallbackTests(t)
+	i.On("setHostError", nil)
+
+	_, ff := createCallback(i, l, "testns", "testfunc", func(in int32) (int32, error) {
+		return in + 1, nil
+	})
+
+	out, err := ff([]wasmer.Value{wasmer.NewI32(1)})
+	require.NoError(t, err)
+	require.Equal(t, int32(2), out[0].I32())
+
+	i.AssertCalled(t, "setHostError", nil)
+}
+
+func TestCallbackFunctionSetsZeroResultGlobalsWhenCallbackReturnsError(t *testing.T) {
+	i, l := setupCallbackTests(t)
+	i.On("setHostError", mock.Anything)
+
+	var results []wasmer.Value
+	i.On("setResultGlobals", mock.Anything).Run(func(args mock.Arguments) {
+		results = args.Get(0).([]wasmer.Value)
+	}).Return(nil)
+
+	_, ff := createCallback(i, l, "testns", "testfunc", func() (float64, error) {
+		return 1.5, fmt.Errorf("boom")
+	})
+
+	out, err := ff([]wasmer.Value{})
+	require.NoError(t, err)
+	require.Len(t, out, 0)
+
+	require.Len(t, results, 1)
+	require.Equal(t, float64(0), results[0].F64())
+}
+
+// watHostError is a module that calls a callback that can fail and returns the
+// result of last_host_error
+var watHostError = `
+(module
+	(import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+	(import "env" "fail" (func $fail (param i32) (result i32)))
+	(import "env" "last_host_error" (func $last_host_error (result i32)))
+	(memory (export "memory") 1)
+	(global $next (mut i32) (i32.const 1024))
+	(func (export "allocate") (param $size i32) (result i32)
+		(local $addr i32)
+		(local.set $addr (global.get $next))
+		(global.set $next (i32.add (global.get $next) (local.get $size)))
+		(local.get $addr))
+	(func (export "deallocate") (param i32 i32))
+	(func (export "get_string_size") (param $p i32) (result i32)
+		(local $n i32)
+		(block $done
+			(loop $l
+				(br_if $done (i32.eqz (i32.load8_u (i32.add (local.get $p) (local.get $n)))))
+				(local.set $n (i32.add (local.get $n) (i32.const 1)))
+				(br $l)))
+		(local.get $n))
+	(func (export "call_fail") (param i32) (result i32)
+		(drop (call $fail (local.get 0)))
+		(call $last_host_error)))
+`
+
+func TestCallbackErrorIsAvailableToModule(t *testing.T) {
+	cb := &Callbacks{}
+	cb.AddCallback("env", "fail", func(n int32) (int32, error) {
+		if n == 1 {
+			return 0, fmt.Errorf("boom")
+		}
+
+		return n, nil
+	})
+
+	i := setupWatInstance(t, watHostError, &PluginConfig{Callbacks: cb})
+
+	var out int32
+	err := i.CallFunction("call_fail", &out, 0)
+	require.NoError(t, err)
+	require.Equal(t, int32(0), out)
+
+	var msg string
+	err = i.CallFunction("call_fail", &msg, 1)
+	require.NoError(t, err)
+	require.Equal(t, "boom", msg)
+}
+
+// watCallbackAllocations is a module that passes its parameter to a callback and
+// counts the allocations that have not been freed
+var watCallbackAllocations = `
+(module
+	(import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+	(import "env" "callback" (func $callback (param i32)))
+	(memory (export "memory") 1)
+	(global $next (mut i32) (i32.const 1024))
+	(global $allocated (export "allocated") (mut i32) (i32.const 0))
+	(func (export "allocate") (param $size i32) (result i32)
+		(local $addr i32)
+		(global.set $allocated (i32.add (global.get $allocated) (i32.const 1)))
+		(local.set $addr (global.get $next))
+		(global.set $next (i32.add (global.get $next) (local.get $size)))
+		(local.get $addr))
+	(func (export "deallocate") (param i32 i32)
+		(global.set $allocated (i32.sub (global.get $allocated) (i32.const 1))))
+	(func (export "call") (param i32)
+		(call $callback (local.get 0))))
+`
+
+func TestCallbackFailureFreesMemory(t *testing.T) {
+	cb := &Callbacks{}
+	cb.AddCallback("env", "callback", func(m map[string]string) {})
+
+	i := setupWatInstance(t, watCallbackAllocations, &PluginConfig{Callbacks: cb})
+
+	for n := 0; n < 3; n++ {
+		err := i.CallFunction("call", nil, "hello")
+		require.Error(t, err)
+		require.Equal(t, int32(0), allocated(t, i))
+	}
+}
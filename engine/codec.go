@@ -0,0 +1,148 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"golang.org/x/xerrors"
+	"google.golang.org/protobuf/proto"
+)
+
+// codecNameFunction is the optional function exported by a plugin that returns
+// the name of the codec the plugin uses, when the function exists the name must
+// match the name of the Codec in the PluginConfig
+const codecNameFunction = "codec_name"
+
+// codecNameTimeout is the maximum time a plugin can take to return the name of its codec,
+// the instance is not metered while the codec is negotiated
+const codecNameTimeout = time.Second
+
+// Codec marshals the structs and structured arguments that are passed between
+// the host and the plugin, the marshalled data is passed to the plugin as bytes.
+type Codec interface {
+	// Name returns the name of the encoding, i.e. json
+	Name() string
+	// Marshal returns the encoding of v
+	Marshal(v interface{}) ([]byte, error)
+	// Unmarshal decodes data into the value pointed to by v
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// CodecMismatchError is returned by GetInstance when the codec reported by
+// the plugin is not the codec configured for the plugin
+type CodecMismatchError struct {
+	// Plugin is the name of the codec reported by the plugin
+	Plugin string
+	// Host is the name of the codec in the PluginConfig
+	Host string
+}
+
+// Error implements the error interface
+func (c CodecMismatchError) Error() string {
+	return fmt.Sprintf("plugin uses the codec %s, the host is configured to use %s", c.Plugin, c.Host)
+}
+
+// JSONCodec marshals values as JSON using encoding/json, it is the default codec
+type JSONCodec struct{}
+
+// Name returns the name of the codec
+func (JSONCodec) Name() string {
+	return "json"
+}
+
+// Marshal returns the JSON encoding of v
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal decodes the JSON data into v
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// MsgpackCodec marshals values as MessagePack
+type MsgpackCodec struct{}
+
+// Name returns the name of the codec
+func (MsgpackCodec) Name() string {
+	return "msgpack"
+}
+
+// Marshal returns the MessagePack encoding of v
+func (MsgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+// Unmarshal decodes the MessagePack data into v
+func (MsgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+// ProtobufCodec marshals values as Protocol Buffers, values must be
+// generated message types that implement proto.Message
+type ProtobufCodec struct{}
+
+// Name returns the name of the codec
+func (ProtobufCodec) Name() string {
+	return "protobuf"
+}
+
+// Marshal returns the Protocol Buffers encoding of v
+func (ProtobufCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, xerrors.Errorf("type %T does not implement proto.Message", v)
+	}
+
+	return proto.Marshal(m)
+}
+
+// Unmarshal decodes the Protocol Buffers data into v
+func (ProtobufCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return xerrors.Errorf("type %T does not implement proto.Message", v)
+	}
+
+	return proto.Unmarshal(data, m)
+}
+
+// negotiateCodec checks that the codec used by the plugin matches the codec in
+// the PluginConfig, plugins that do not export codec_name are not checked
+func negotiateCodec(i *wasmerInstance) error {
+	if _, err := i.instance.Exports.GetRawFunction(codecNameFunction); err != nil {
+		return nil
+	}
+
+	// the codec is negotiated with metering suspended so that the call does not use the
+	// fuel for the instance, the call is not recorded as the last call to the instance
+	m := i.meter
+	err := m.suspend()
+	if err != nil {
+		return err
+	}
+
+	i.meter = nil
+
+	ctx, cancel := context.WithTimeout(context.Background(), codecNameTimeout)
+	defer cancel()
+
+	var name string
+	err = i.CallFunctionContext(ctx, codecNameFunction, &name)
+
+	i.meter = m
+	i.lastCallFailed = false
+
+	if err != nil {
+		return xerrors.Errorf("unable to get the codec for the plugin: %w", err)
+	}
+
+	if name != i.codec.Name() {
+		return CodecMismatchError{Plugin: name, Host: i.codec.Name()}
+	}
+
+	return nil
+}
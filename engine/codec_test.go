@@ -0,0 +1,115 @@
+package engine
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// watCodecName is a module that reports the msgpack codec using the codec_name export
+var watCodecName = `
+(module
+	(import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+	(memory (export "memory") 1)
+	(data (i32.const 16) "msgpack\00")
+	(func (export "deallocate") (param i32 i32))
+	(func (export "get_string_size") (param i32) (result i32)
+		(i32.const 7))
+	(func (export "codec_name") (result i32)
+		(i32.const 16)))
+`
+
+func TestCodecsRoundTripValues(t *testing.T) {
+	for _, c := range []Codec{JSONCodec{}, MsgpackCodec{}} {
+		data, err := c.Marshal(testPerson{Name: "Nic", Age: 21})
+		require.NoError(t, err, c.Name())
+
+		out := testPerson{}
+		err = c.Unmarshal(data, &out)
+		require.NoError(t, err, c.Name())
+		require.Equal(t, testPerson{Name: "Nic", Age: 21}, out, c.Name())
+	}
+}
+
+func TestProtobufCodecRoundTripsMessages(t *testing.T) {
+	c := ProtobufCodec{}
+
+	data, err := c.Marshal(wrapperspb.String("Nic"))
+	require.NoError(t, err)
+
+	out := &wrapperspb.StringValue{}
+	err = c.Unmarshal(data, out)
+	require.NoError(t, err)
+	require.Equal(t, "Nic", out.GetValue())
+}
+
+func TestProtobufCodecReturnsErrorForNonMessages(t *testing.T) {
+	c := ProtobufCodec{}
+
+	_, err := c.Marshal(testPerson{})
+	require.Error(t, err)
+
+	err = c.Unmarshal([]byte{}, &testPerson{})
+	require.Error(t, err)
+}
+
+func TestCallFunctionMarshalsStructuredArgumentsWithProtobuf(t *testing.T) {
+	i := setupWatInstance(t, watEchoBytes, &PluginConfig{EncodeArguments: true, Codec: ProtobufCodec{}})
+
+	out := &wrapperspb.StringValue{}
+	err := i.CallFunction("echo", out, wrapperspb.String("Nic"))
+	require.NoError(t, err)
+	require.True(t, proto.Equal(wrapperspb.String("Nic"), out))
+}
+
+func TestGetInstanceReturnsErrorWhenCodecDoesNotMatch(t *testing.T) {
+	e := New(nil)
+	err := e.RegisterPluginBytes("test", watToWasm(t, watCodecName), nil)
+	require.NoError(t, err)
+
+	_, err = e.GetInstance("test", "")
+
+	cme := CodecMismatchError{}
+	require.True(t, xerrors.As(err, &cme))
+	require.Equal(t, "msgpack", cme.Plugin)
+	require.Equal(t, "json", cme.Host)
+}
+
+func TestGetInstanceNegotiatesCodec(t *testing.T) {
+	e := New(nil)
+	err := e.RegisterPluginBytes("test", watToWasm(t, watCodecName), &PluginConfig{Codec: MsgpackCodec{}})
+	require.NoError(t, err)
+
+	i, err := e.GetInstance("test", "")
+	require.NoError(t, err)
+	require.Equal(t, "msgpack", i.getCodec().Name())
+}
+
+func TestGetInstanceNegotiatesCodecWithoutUsingFuel(t *testing.T) {
+	e := New(nil)
+	err := e.RegisterPluginBytes("test", watToWasm(t, watCodecName), &PluginConfig{Codec: MsgpackCodec{}, InstanceFuel: 1})
+	require.NoError(t, err)
+
+	i, err := e.GetInstance("test", "")
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), i.FuelConsumed())
+	require.False(t, i.failed())
+}
+
+func TestGetInstanceStopsCodecNegotiationAfterTimeout(t *testing.T) {
+	wat := strings.Replace(watCodecName, `(i32.const 16)))`, `(loop $l (br $l)) (i32.const 16)))`, 1)
+
+	e := New(nil)
+	err := e.RegisterPluginBytes("test", watToWasm(t, wat), &PluginConfig{Codec: MsgpackCodec{}})
+	require.NoError(t, err)
+
+	start := time.Now()
+	_, err = e.GetInstance("test", "")
+	require.ErrorIs(t, err, ErrCallTimeout)
+	require.Less(t, time.Since(start), codecNameTimeout+time.Second)
+}
@@ -0,0 +1,145 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// the tests in this file are intended to be run with the race detector enabled
+// go test -race ./...
+
+func TestEngineRegistersAndCreatesInstancesConcurrently(t *testing.T) {
+	wasm := watToWasm(t, watVersion(1))
+	e := New(nil)
+
+	err := e.RegisterPluginBytes("test", wasm, nil)
+	require.NoError(t, err)
+
+	wg := sync.WaitGroup{}
+	errs := make(chan error, 40)
+
+	for n := 0; n < 10; n++ {
+		wg.Add(4)
+
+		go func(n int) {
+			defer wg.Done()
+			errs <- e.RegisterPluginBytes(fmt.Sprintf("plugin_%d", n), wasm, nil)
+		}(n)
+
+		go func() {
+			defer wg.Done()
+			errs <- e.RegisterPluginBytes("test", wasm, nil)
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			i, err := e.GetInstance("test", "")
+			if err == nil {
+				err = i.CallFunction("version", nil)
+			}
+
+			errs <- err
+		}()
+
+		go func() {
+			defer wg.Done()
+			e.Plugins()
+			errs <- nil
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	require.Len(t, e.Plugins(), 11)
+}
+
+func TestInstanceSerialisesConcurrentCalls(t *testing.T) {
+	i, _ := testSetupEngine(t, goModule, nil)
+
+	wg := sync.WaitGroup{}
+	results := make(chan string, 20)
+
+	for n := 0; n < 20; n++ {
+		wg.Add(1)
+
+		go func(n int) {
+			defer wg.Done()
+
+			var out string
+			err := i.CallFunction("string_func", &out, fmt.Sprintf("%d", n))
+			if err != nil {
+				out = err.Error()
+			}
+
+			results <- out
+		}(n)
+	}
+
+	wg.Wait()
+	close(results)
+
+	got := []string{}
+	for r := range results {
+		got = append(got, r)
+	}
+
+	expected := []string{}
+	for n := 0; n < 20; n++ {
+		expected = append(expected, fmt.Sprintf("Hello %d", n))
+	}
+
+	require.ElementsMatch(t, expected, got)
+}
+
+func TestInstanceReturnsErrorWhenContextDoneWaitingForCall(t *testing.T) {
+	conf := &PluginConfig{Callbacks: &Callbacks{}}
+	conf.Callbacks.AddCallback("env", "tick", func() {})
+
+	i := setupWatInstance(t, watLoop, conf)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error)
+	go func() {
+		done <- i.CallFunctionContext(ctx, "loop", nil)
+	}()
+
+	// wait for the first call to start before making the second call
+	time.Sleep(20 * time.Millisecond)
+
+	wctx, wcancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer wcancel()
+
+	err := i.CallFunctionContext(wctx, "loop", nil)
+	require.Equal(t, ErrCallTimeout, err)
+
+	require.Equal(t, ErrCallTimeout, <-done)
+}
+
+func TestMeteredInstanceReturnsFuelConsumedDuringCall(t *testing.T) {
+	i := setupWatInstance(t, watCount, &PluginConfig{Fuel: 100000000})
+
+	done := make(chan error)
+	go func() {
+		done <- i.CallFunction("count", nil, 1000000)
+	}()
+
+	for n := 0; n < 10; n++ {
+		i.FuelConsumed()
+	}
+
+	require.NoError(t, <-done)
+	require.Greater(t, i.FuelConsumed(), uint64(0))
+}
@@ -1,6 +1,26 @@
 package engine
 
-import "github.com/nicholasjackson/wasp/engine/logger"
+import (
+	"encoding/json"
+
+	"github.com/nicholasjackson/wasp/engine/logger"
+	"golang.org/x/xerrors"
+)
+
+// isDefaultImport returns true when the import is provided by the engine
+func isDefaultImport(module, name string) bool {
+	if module != "env" {
+		return false
+	}
+
+	switch name {
+	case "raise_error", "raise_error_v2", "abort", "last_host_error",
+		"workspace_lock", "workspace_try_lock", "workspace_unlock":
+		return true
+	}
+
+	return false
+}
 
 func (w *Wasm) getDefaultCallbacks(i Instance, l *logger.Wrapper) *Callbacks {
 	cb := &Callbacks{}
@@ -10,7 +30,47 @@ func (w *Wasm) getDefaultCallbacks(i Instance, l *logger.Wrapper) *Callbacks {
 		"raise_error",
 		func(err string) {
 			l.Debug("Error raised by plugin", "error", err)
-			i.setError(err)
+			i.setError(xerrors.New(err))
+		},
+	)
+
+	// raise_error_v2 takes a JSON encoded PluginError, the error is returned
+	// from the function call
+	cb.AddCallback(
+		"env",
+		"raise_error_v2",
+		func(payload []byte) {
+			pe := PluginError{}
+			err := json.Unmarshal(payload, &pe)
+			if err != nil {
+				l.Error("Unable to decode error raised by plugin", "error", err)
+				i.setError(xerrors.Errorf("unable to decode error raised by plugin: %w", err))
+				return
+			}
+
+			l.Debug("Error raised by plugin", "code", pe.Code, "error", pe.Message)
+			i.setError(pe)
+		},
+	)
+
+	// last_host_error returns a pointer to the message for the error returned by the last
+	// callback that returns an error, 0 is returned when the callback succeeded
+	cb.AddCallback(
+		"env",
+		"last_host_error",
+		func() int32 {
+			err := i.getHostError()
+			if err == nil {
+				return 0
+			}
+
+			addr, err := i.setStringInMemory(err.Error())
+			if err != nil {
+				l.Error("Unable to write host error to module memory", "error", err)
+				return 0
+			}
+
+			return addr
 		},
 	)
 
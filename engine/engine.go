@@ -2,8 +2,14 @@ package engine
 
 import (
 	"fmt"
+	"io"
+	"io/fs"
 	"io/ioutil"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/nicholasjackson/wasp/engine/logger"
 	"github.com/wasmerio/wasmer-go/wasmer"
@@ -11,9 +17,26 @@ import (
 )
 
 type Wasm struct {
-	log     *logger.Wrapper
-	store   *wasmer.Store
+	log      *logger.Wrapper
+	store    *wasmer.Store
+	cache    *moduleCache
+	compiler Compiler
+
+	// mutex protects plugins, plugins can be replaced at any time by ReloadPlugin
+	mutex   sync.RWMutex
 	plugins map[string]*plugin
+
+	// lastInstanceID is the ID of the last instance created by GetInstance
+	lastInstanceID uint64
+
+	// helpers are the helper modules used by the WASI guard for each version of WASI,
+	// see wasiGuardHelper
+	helperMutex sync.Mutex
+	helpers     map[string]*wasmer.Module
+
+	// workspaceMutex protects workspaces, the workspaces that have not been closed
+	workspaceMutex sync.Mutex
+	workspaces     map[*Workspace]bool
 }
 
 type Compiler string
@@ -38,17 +61,41 @@ func New(log *logger.Wrapper) *Wasm {
 //	Singlepass: Super fast compilation times, slow execution times. Not prone to JIT-bombs
 //	Cranelift: Fast compilation times, fast execution times
 func NewWithCompiler(log *logger.Wrapper, c Compiler) *Wasm {
+	// without a cache directory NewWithOptions can not fail
+	w, _ := NewWithOptions(log, Options{Compiler: c})
+	return w
+}
+
+// Options defines the configuration for the engine
+type Options struct {
+	// Compiler used to compile Wasm modules, defaults to CompilerSinglepass
+	Compiler Compiler
+
+	// CacheDir is the directory used to cache compiled modules, when set
+	// modules are only compiled the first time they are registered, subsequent
+	// registrations of the same module load the compiled module from the cache.
+	// When empty compiled modules are not cached.
+	CacheDir string
+}
+
+// NewWithOptions creates a new plugin engine with the given options, an error
+// is returned if the cache directory can not be created
+func NewWithOptions(log *logger.Wrapper, o Options) (*Wasm, error) {
 	if log == nil {
 		// create a nil logger
 		log = logger.New(nil, nil, nil, nil)
 	}
 
-	w := &Wasm{log: log}
+	if o.Compiler == "" {
+		o.Compiler = CompilerSinglepass
+	}
+
+	w := &Wasm{log: log, compiler: o.Compiler}
 
 	// Singlepass compiler is
 	config := wasmer.NewConfig()
 
-	switch c {
+	switch o.Compiler {
 	case CompilerCranelift:
 		config.UseCraneliftCompiler()
 	case CompilerSinglepass:
@@ -59,7 +106,26 @@ func NewWithCompiler(log *logger.Wrapper, c Compiler) *Wasm {
 	w.store = wasmer.NewStore(engine)
 	w.plugins = map[string]*plugin{}
 
-	return w
+	if o.CacheDir != "" {
+		c, err := newModuleCache(o.CacheDir, o.Compiler, log)
+		if err != nil {
+			return nil, err
+		}
+
+		w.cache = c
+	}
+
+	return w, nil
+}
+
+// PluginNotFoundError is returned when a plugin with the given name
+// has not been registered with the engine
+type PluginNotFoundError struct {
+	Name string
+}
+
+func (p PluginNotFoundError) Error() string {
+	return fmt.Sprintf("plugin %s, not found, ensure all plugins are registered before use", p.Name)
 }
 
 type ImportNotFoundError struct {
@@ -85,11 +151,90 @@ func (i ImportNotFoundError) Error() string {
 		pluginConfig: Additional configuration for the engine such as environment variables and volumes
 */
 func (w *Wasm) RegisterPlugin(name, pluginPath string, pluginConfig *PluginConfig) error {
-	wasmBytes, err := ioutil.ReadFile(pluginPath)
+	p, err := w.newPluginFromFile(pluginPath, pluginConfig)
+	if err != nil {
+		return err
+	}
+
+	w.setPlugin(name, p)
+
+	return nil
+}
+
+/*
+	RegisterPluginReader registers a plugin where the Wasm module is read from the given reader
+
+	Parameters:
+		name: The name of the plugin as it will be registered with the engine
+		r: The reader containing the Wasm module, the reader is read until EOF
+		pluginConfig: Additional configuration for the engine such as environment variables and volumes
+*/
+func (w *Wasm) RegisterPluginReader(name string, r io.Reader, pluginConfig *PluginConfig) error {
+	wasmBytes, err := ioutil.ReadAll(r)
+	if err != nil {
+		return xerrors.Errorf("unable to read WASM module: %w", err)
+	}
+
+	return w.RegisterPluginBytes(name, wasmBytes, pluginConfig)
+}
+
+/*
+	RegisterPluginFS registers a plugin where the Wasm module is loaded from the given filesystem,
+	this allows plugins to be embedded in the application using go:embed
+
+	Parameters:
+		name: The name of the plugin as it will be registered with the engine
+		fsys: The filesystem containing the Wasm module
+		pluginPath: The path to the Wasm module in fsys
+		pluginConfig: Additional configuration for the engine such as environment variables and volumes
+*/
+func (w *Wasm) RegisterPluginFS(name string, fsys fs.FS, pluginPath string, pluginConfig *PluginConfig) error {
+	wasmBytes, err := fs.ReadFile(fsys, pluginPath)
 	if err != nil {
 		return xerrors.Errorf("unable to load WASM module: %w", err)
 	}
 
+	return w.RegisterPluginBytes(name, wasmBytes, pluginConfig)
+}
+
+/*
+	RegisterPluginBytes registers a plugin from the Wasm module in wasmBytes
+
+	Parameters:
+		name: The name of the plugin as it will be registered with the engine
+		wasmBytes: The Wasm module in the binary format
+		pluginConfig: Additional configuration for the engine such as environment variables and volumes
+*/
+func (w *Wasm) RegisterPluginBytes(name string, wasmBytes []byte, pluginConfig *PluginConfig) error {
+	p, err := w.newPlugin(wasmBytes, pluginConfig)
+	if err != nil {
+		return err
+	}
+
+	w.setPlugin(name, p)
+
+	return nil
+}
+
+// UnregisterPlugin removes the plugin with the given name from the engine, existing
+// instances of the plugin can continue to be used until they are removed. A
+// PluginNotFoundError is returned when the plugin is not registered.
+func (w *Wasm) UnregisterPlugin(name string) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if _, ok := w.plugins[name]; !ok {
+		return PluginNotFoundError{name}
+	}
+
+	delete(w.plugins, name)
+
+	return nil
+}
+
+// newPlugin compiles the Wasm module and validates that all the imports for the module
+// are satisfied by either the default imports or the callbacks in pluginConfig
+func (w *Wasm) newPlugin(wasmBytes []byte, pluginConfig *PluginConfig) (*plugin, error) {
 	// always create a config if one does not exist
 	if pluginConfig == nil {
 		pluginConfig = &PluginConfig{
@@ -97,46 +242,109 @@ func (w *Wasm) RegisterPlugin(name, pluginPath string, pluginConfig *PluginConfi
 		}
 	}
 
+	if pluginConfig.Callbacks == nil {
+		pluginConfig.Callbacks = &Callbacks{}
+	}
+
+	size := len(wasmBytes)
+
+	err := validateVolumes(pluginConfig)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid volumes: %w", err)
+	}
+
+	imports, err := importInfo(wasmBytes)
+	if err != nil {
+		return nil, xerrors.Errorf("unable to read WASM module imports: %w", err)
+	}
+
+	// volumes, stdin and captured output are handled by the WASI guard
+	if len(pluginConfig.volumes()) > 0 || pluginConfig.capturesOutput() || pluginConfig.Stdin != nil {
+		namespaces := []string{}
+		for _, i := range imports {
+			namespaces = append(namespaces, i.Module)
+		}
+
+		_, err := wasiGuardNamespace(namespaces)
+		if err != nil {
+			return nil, xerrors.Errorf("volumes, stdin and captured output are not supported for the module: %w", err)
+		}
+	}
+
+	names := functionNames(wasmBytes)
+
+	// instrument the module so that the engine can interrupt, meter and limit execution
+	wasmBytes, offsets, err := instrumentModule(
+		wasmBytes,
+		instrumentOptions{
+			metering:       pluginConfig.metered(),
+			maxMemoryPages: pluginConfig.memoryLimit(),
+		},
+	)
+	if err != nil {
+		return nil, xerrors.Errorf("unable to instrument WASM module: %w", err)
+	}
+
 	// Compile the module
-	module, err := wasmer.NewModule(w.store, wasmBytes)
+	module, err := w.compile(wasmBytes)
 	if err != nil {
-		return xerrors.Errorf("unable to instantiate WASM module: %w", err)
+		return nil, xerrors.Errorf("unable to instantiate WASM module: %w", err)
 	}
 
 	// validate that there are callbacks for all the imported functions
 	for _, i := range module.Imports() {
 		// wasi functions that are provided by the system are loaded in the wasi_... namespaces
-		if strings.HasPrefix(i.Module(), "wasi_") ||
-			(i.Module() == "env" && i.Name() == "raise_error") ||
-			(i.Module() == "env" && i.Name() == "abort") {
+		if strings.HasPrefix(i.Module(), "wasi_") || isDefaultImport(i.Module(), i.Name()) {
 			// default import
 		} else {
-			if pluginConfig == nil {
-				return ImportNotFoundError{i.Name(), i.Module()}
-			}
-
-			if pluginConfig.Callbacks == nil {
-				return ImportNotFoundError{i.Name(), i.Module()}
-			}
-
 			if m, ok := pluginConfig.Callbacks.callbackFunctions[i.Module()]; ok {
 				if _, ok := m[i.Name()]; !ok {
-					return ImportNotFoundError{i.Name(), i.Module()}
+					return nil, ImportNotFoundError{i.Name(), i.Module()}
 				}
 			} else {
-				return ImportNotFoundError{i.Name(), i.Module()}
+				return nil, ImportNotFoundError{i.Name(), i.Module()}
 			}
 		}
 	}
 
 	p := &plugin{
-		module: module,
-		config: pluginConfig,
+		module:     module,
+		config:     pluginConfig,
+		size:       size,
+		registered: time.Now(),
+		imports:    imports,
+
+		functionNames: names,
+		offsets:       offsets,
 	}
 
+	return p, nil
+}
+
+// setPlugin adds the plugin to the engine replacing any existing plugin with the same name
+func (w *Wasm) setPlugin(name string, p *plugin) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
 	w.plugins[name] = p
+}
 
-	return nil
+// getPlugin returns the plugin with the given name
+func (w *Wasm) getPlugin(name string) (*plugin, bool) {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+
+	p, ok := w.plugins[name]
+	return p, ok
+}
+
+// compile the Wasm module, using the cache when configured
+func (w *Wasm) compile(wasmBytes []byte) (*wasmer.Module, error) {
+	if w.cache != nil {
+		return w.cache.compile(w.store, wasmBytes)
+	}
+
+	return wasmer.NewModule(w.store, wasmBytes)
 }
 
 /*
@@ -150,56 +358,172 @@ func (w *Wasm) RegisterPlugin(name, pluginPath string, pluginConfig *PluginConfi
 									this directory is mounted to /workspace inside the Wasm module.
 */
 func (w *Wasm) GetInstance(name, workspaceDir string) (Instance, error) {
+	return w.GetInstanceWithOptions(name, InstanceOptions{WorkspaceDir: workspaceDir})
+}
+
+// GetInstanceWithOptions retrieves an instance of a plugin in the same way as GetInstance,
+// opts allows the WASI environment, arguments and stdin to be configured for the instance.
+func (w *Wasm) GetInstanceWithOptions(name string, opts InstanceOptions) (_ Instance, err error) {
 	// find the plugin
-	p, ok := w.plugins[name]
+	p, ok := w.getPlugin(name)
 	if !ok {
-		return nil, xerrors.Errorf("plugin %s, not found, ensure all plugins are registered before use", name)
+		return nil, PluginNotFoundError{name}
 	}
 
-	// Create the Wasi environment
-	// we can specify directories,etc for each instance
-	wasi := wasmer.NewWasiStateBuilder("wasi-plugins")
+	workspaceDir := opts.WorkspaceDir
+	if opts.Workspace != nil {
+		if workspaceDir != "" {
+			return nil, xerrors.New("only one of Workspace and WorkspaceDir can be set")
+		}
 
-	// add the environment variables
-	if p.config != nil && p.config.Environment != nil {
-		for k, v := range p.config.Environment {
-			wasi.Environment(k, v)
+		if opts.Workspace.isClosed() {
+			return nil, ErrWorkspaceClosed
 		}
+
+		workspaceDir = opts.Workspace.Dir()
 	}
 
-	if workspaceDir != "" {
-		wasi.MapDirectory("workspace", workspaceDir)
+	// Create the Wasi environment for the instance
+	wasi := newWasiState(name, p.config, opts)
+
+	// mount the volumes and the workspace, the mounts are checked by the WASI guard
+	volumes := p.config.volumes()
+	mounts, err := mapVolumes(wasi, volumes, workspaceDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// the virtual filesystems are backed by an empty scratch directory for the instance
+	virtual, scratch, err := mapFilesystems(wasi, volumes, opts.Filesystems)
+	if err != nil {
+		return nil, err
 	}
-	//.Environment("TESTER", "NIC").MapDirectory("host", "./").Finalize()
+
+	// when the instance can not be created it is removed in the same way as Remove,
+	// before the instance exists only the scratch directory needs to be removed
+	var inst *wasmerInstance
+	defer func() {
+		switch {
+		case err == nil:
+		case inst != nil:
+			inst.Remove()
+		case scratch != "":
+			os.RemoveAll(scratch)
+		}
+	}()
+
+	if scratch != "" {
+		if !importsNamespace(p.module, wasiNamespace) {
+			return nil, xerrors.Errorf("filesystems are only supported for modules importing %s", wasiNamespace)
+		}
+	}
+
+	wasi.InheritStdout().InheritStderr()
+
 	sb, err := wasi.Finalize()
 	if err != nil {
 		return nil, xerrors.Errorf("unable to create Wasi state: %w", err)
 	}
 
-	io, err := sb.GenerateImportObject(w.store, p.module)
+	importObject, err := sb.GenerateImportObject(w.store, p.module)
 	if err != nil {
 		return nil, err
 	}
 
-	inst := newInstance(io)
+	inst = newInstance(importObject)
+	inst.log = w.log
+	inst.id = atomic.AddUint64(&w.lastInstanceID, 1)
+	inst.volume = scratch
+	inst.workspace = opts.Workspace
+	inst.plugin = p
+	inst.codec = p.config.codec()
+
+	// captured output is written by the WASI guard
+	stdio := map[int32]io.Writer{}
+	if p.config.Stdout.captured() {
+		inst.stdout = p.config.Stdout.newWriter(w.log, name, inst.id, "stdout")
+		stdio[1] = inst.stdout
+	}
 
-	// Add the default imports
-	defaultCallbacks := w.getDefaultCallbacks(inst, w.log)
+	if p.config.Stderr.captured() {
+		inst.stderr = p.config.Stderr.newWriter(w.log, name, inst.id, "stderr")
+		stdio[2] = inst.stderr
+	}
+
+	// stdin is read by the WASI guard, Wasmer always inherits the stdin of the host
+	// process so the guard reads from an empty reader when stdin is not set
+	stdin := map[int32]io.Reader{0: strings.NewReader("")}
+	if opts.Stdin != nil {
+		stdin[0] = opts.Stdin
+	} else if p.config.Stdin != nil {
+		stdin[0] = p.config.Stdin
+	}
+
+	// the guard is not needed when the module does not import WASI, the module can
+	// not access the mounts or stdio
+	var helper *wasmer.Module
+	if len(mounts) > 0 || len(virtual) > 0 || len(stdio) > 0 || len(stdin) > 0 {
+		namespace, err := wasiGuardNamespace(moduleNamespaces(p.module))
+		if err != nil {
+			return nil, xerrors.Errorf("workspaces, volumes and stdin are not supported for the module: %w", err)
+		}
+
+		if namespace != "" {
+			helper, err = w.wasiGuardHelper(namespace)
+			if err != nil {
+				return nil, err
+			}
+
+			inst.guard = newWasiGuard(w.store, helper, p.module, namespace, importObject, inst, mounts, stdio, stdin, virtual)
+		}
+	}
 
-	// add the default callbacks to our user defined list
-	p.config.Callbacks.merge(defaultCallbacks)
+	// combine the user defined callbacks with the default imports for this instance,
+	// the plugin config is shared by all instances and must not be modified
+	callbacks := &Callbacks{}
+	callbacks.merge(p.config.Callbacks)
+	callbacks.merge(w.getDefaultCallbacks(inst, w.log))
+	callbacks.merge(workspaceCallbacks(inst, opts.Workspace, inst.id, w.log))
 
 	// Add the callbacks to the instance
-	p.config.Callbacks.addCallbacks(inst, w.store, w.log)
+	callbacks.addCallbacks(inst, w.store, w.log)
 
 	// Create a new instance of the module
-	instance, err := wasmer.NewInstance(p.module, io)
+	instance, err := wasmer.NewInstance(p.module, importObject)
 	if err != nil {
 		return nil, xerrors.Errorf("unable to create a new instance of the plugin: %w", err)
 	}
 
 	inst.instance = instance
-	inst.log = w.log
+
+	if inst.guard != nil {
+		err = inst.guard.attach(w.store, helper, sb, instance)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	inst.interruptGlobal, err = instance.Exports.GetGlobal(globalInterrupt)
+	if err != nil {
+		return nil, xerrors.Errorf("unable to find the interrupt global for the plugin: %w", err)
+	}
+
+	inst.meter, err = newMeter(instance, p.config)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.config.memoryLimit() > 0 {
+		inst.memoryExceededGlobal, err = instance.Exports.GetGlobal(globalMemoryExceeded)
+		if err != nil {
+			return nil, xerrors.Errorf("unable to find the memory exceeded global for the plugin: %w", err)
+		}
+	}
+
+	err = negotiateCodec(inst)
+	if err != nil {
+		return nil, err
+	}
 
 	return inst, nil
 }
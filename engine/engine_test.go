@@ -0,0 +1,91 @@
+package engine
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+var goModule = "../_test_fixtures/go/no_imports/module.wasm"
+
+func callIntFunc(t *testing.T, e *Wasm) {
+	i, err := e.GetInstance("test", "")
+	require.NoError(t, err)
+
+	var out int32
+	err = i.CallFunction("int_func", &out, 3, 2)
+	require.NoError(t, err)
+	require.Equal(t, int32(5), out)
+}
+
+func TestRegisterPluginBytesRegistersPlugin(t *testing.T) {
+	wasm, err := ioutil.ReadFile(goModule)
+	require.NoError(t, err)
+
+	e := New(nil)
+	err = e.RegisterPluginBytes("test", wasm, nil)
+	require.NoError(t, err)
+
+	callIntFunc(t, e)
+}
+
+func TestRegisterPluginBytesReturnsErrorForInvalidModule(t *testing.T) {
+	e := New(nil)
+	err := e.RegisterPluginBytes("test", []byte("not a module"), nil)
+	require.Error(t, err)
+}
+
+func TestRegisterPluginBytesValidatesImports(t *testing.T) {
+	i := `
+(module
+	(import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+	(import "env" "missing" (func))
+	(memory (export "memory") 1))
+`
+	wasm := watToWasm(t, i)
+
+	e := New(nil)
+	err := e.RegisterPluginBytes("test", wasm, nil)
+
+	inf := ImportNotFoundError{}
+	require.True(t, xerrors.As(err, &inf))
+	require.Equal(t, "missing", inf.Name)
+	require.Equal(t, "env", inf.Module)
+}
+
+func TestRegisterPluginReaderRegistersPlugin(t *testing.T) {
+	wasm, err := ioutil.ReadFile(goModule)
+	require.NoError(t, err)
+
+	e := New(nil)
+	err = e.RegisterPluginReader("test", bytes.NewReader(wasm), nil)
+	require.NoError(t, err)
+
+	callIntFunc(t, e)
+}
+
+func TestRegisterPluginFSRegistersPlugin(t *testing.T) {
+	wasm, err := ioutil.ReadFile(goModule)
+	require.NoError(t, err)
+
+	fsys := fstest.MapFS{
+		"plugins/module.wasm": &fstest.MapFile{Data: wasm},
+	}
+
+	e := New(nil)
+	err = e.RegisterPluginFS("test", fsys, "plugins/module.wasm", nil)
+	require.NoError(t, err)
+
+	callIntFunc(t, e)
+}
+
+func TestRegisterPluginFSReturnsErrorWhenFileNotFound(t *testing.T) {
+	e := New(nil)
+	err := e.RegisterPluginFS("test", os.DirFS("../_test_fixtures"), "missing.wasm", nil)
+	require.Error(t, err)
+}
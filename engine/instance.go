@@ -1,8 +1,12 @@
 package engine
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"os"
+	"reflect"
 	"time"
 
 	"github.com/nicholasjackson/wasp/engine/logger"
@@ -10,13 +14,30 @@ import (
 	"golang.org/x/xerrors"
 )
 
+// Instance is an instance of a plugin, instances are safe for concurrent use however
+// function calls are serialised, only one function call is executed at a time and
+// concurrent calls wait for the current call to complete. To call functions in
+// parallel create an Instance for each goroutine or use a Pool.
 type Instance interface {
 	CallFunction(string, interface{}, ...interface{}) error
+	CallFunctionContext(context.Context, string, interface{}, ...interface{}) error
+	Bind(string, interface{}) error
+	FuelConsumed() uint64
+	Stdout() []byte
+	Stderr() []byte
 	Remove() error
 	// private
+	failed() bool
+	getPlugin() *plugin
+	callContext() context.Context
+	interrupt()
+	setResultGlobals([]wasmer.Value) error
+	getCodec() Codec
 	getImportObject() importObject
-	setError(string)
+	setError(error)
 	getError() error
+	setHostError(error)
+	getHostError() error
 	setStringInMemory(string) (int32, error)
 	getStringFromMemory(int32) (string, error)
 	setBytesInMemory([]byte) (int32, error)
@@ -44,8 +65,30 @@ func (f FunctionNotFoundError) Error() string {
 	)
 }
 
+// ErrCallTimeout is returned by CallFunctionContext when the deadline
+// for the context expires before the function call completes
+var ErrCallTimeout = xerrors.New("function call exceeded the context deadline")
+
+// ErrCallCancelled is returned by CallFunctionContext when the context
+// is cancelled before the function call completes
+var ErrCallCancelled = xerrors.New("function call was cancelled")
+
+// ErrInstanceUnusable is returned when calling a function on an instance
+// where a previous call was interrupted, the state of the instance memory
+// can not be guaranteed and a new instance should be created.
+var ErrInstanceUnusable = xerrors.New("instance is unusable, a previous function call was interrupted")
+
+// ErrMemoryLimitExceeded is returned by CallFunction when the module attempts to
+// grow its memory beyond the limit set in the PluginConfig
+var ErrMemoryLimitExceeded = xerrors.New("function call exceeded the memory limit")
+
+// ErrInstanceRemoved is returned when calling a function on an instance that
+// has been removed
+var ErrInstanceRemoved = xerrors.New("instance has been removed")
+
 // WasmerInstance represents a concrete implementation of a plugin instance
 type wasmerInstance struct {
+	plugin       *plugin
 	instance     *wasmer.Instance
 	importObject *wasmer.ImportObject
 	log          *logger.Wrapper
@@ -53,12 +96,67 @@ type wasmerInstance struct {
 	// Volume is the name of the instance specific volume
 	volume string
 
+	// workspace is the shared workspace attached to the instance, locks held
+	// by the instance are released when it is removed
+	workspace *Workspace
+
 	// map of the address and size of any memory
 	// allocated by this instance
 	allocatedMemory map[int32]int32
 
 	// last error is the last error raised by the system
 	lastError error
+
+	// hostError is the error returned by the last callback that returns an error
+	hostError error
+
+	// lastCallFailed is set when the module trapped, was interrupted or a callback
+	// returned an error during the last call to the instance
+	lastCallFailed bool
+
+	// unusable is set when a call was interrupted before it completed
+	unusable bool
+
+	// removed is set when the instance has been removed
+	removed bool
+
+	// abandoned is closed when a call that was interrupted has stopped running in
+	// the module, nil when no call has been abandoned
+	abandoned chan struct{}
+
+	// calls ensures that only one function call is in progress, a call
+	// holds the single slot in the channel until it completes
+	calls chan struct{}
+
+	// ctx is the context for the function call that is currently in progress
+	ctx context.Context
+
+	// codec marshals structs passed to and from callbacks
+	codec Codec
+
+	// guard checks the WASI filesystem calls for the volumes and writes the captured
+	// output, nil when the instance has no mounts or captured output
+	guard *wasiGuard
+
+	// id is the unique ID of the instance in the engine
+	id uint64
+
+	// stdout and stderr are the writers for the captured output, nil when the
+	// output is written to the host process
+	stdout io.Writer
+	stderr io.Writer
+
+	// interruptGlobal is the global exported by the instrumented module that
+	// causes the module to trap when set
+	interruptGlobal *wasmer.Global
+
+	// meter tracks the fuel consumed by the instance, nil when the plugin
+	// is not metered
+	meter *meter
+
+	// memoryExceededGlobal is set by the module when memory.grow exceeds the
+	// memory limit, nil when the plugin memory is not limited
+	memoryExceededGlobal *wasmer.Global
 }
 
 // newInstance creates a new Plugin instance
@@ -70,24 +168,126 @@ func newInstance(io *wasmer.ImportObject) *wasmerInstance {
 	// all the pointers in this collection should be deallocated once the function call has completed to
 	// avoid leaking memory in the instance
 	am := map[int32]int32{}
-	return &wasmerInstance{allocatedMemory: am, importObject: io}
+	return &wasmerInstance{allocatedMemory: am, importObject: io, calls: make(chan struct{}, 1)}
 }
 
+// Results is used as the outputParam for CallFunction to receive the values returned
+// by a function that has multiple results, each element is a pointer that is set from
+// the result at the same position in the same way as a single outputParam. Elements
+// that are nil are ignored.
+//
+//	var s string
+//	var status int32
+//	err := i.CallFunction("multi", engine.Results{&s, &status}, "Nic")
+type Results []interface{}
+
 // CallFunction in the Wasm module with the given parameters
 // The response from the function will automatically be cast into the type specified
 // by outputParam. In the instance that outputParam is a complex type that is returned
 // as a pointer from the WASMFunction CallFunction reads the WasmModule memory and
-// sets outputParam
+// sets outputParam. Functions that return multiple values can be called with an
+// outputParam of type Results.
 func (i *wasmerInstance) CallFunction(name string, outputParam interface{}, inputParams ...interface{}) error {
-	f, err := i.instance.Exports.GetFunction(name)
+	return i.CallFunctionContext(context.Background(), name, outputParam, inputParams...)
+}
+
+// CallFunctionContext calls the function in the Wasm module in the same way as CallFunction.
+// When the context is cancelled or its deadline expires before the call completes
+// CallFunctionContext returns ErrCallCancelled or ErrCallTimeout, and the instance is
+// marked as unusable.
+//
+// The module is interrupted at the next function call, loop iteration or host callback,
+// a module that is blocked inside a host callback is interrupted when the callback returns.
+//
+// When another function call is in progress CallFunctionContext waits until it has completed,
+// if the context is done before the call can start ErrCallCancelled or ErrCallTimeout is
+// returned and the instance remains usable.
+func (i *wasmerInstance) CallFunctionContext(ctx context.Context, name string, outputParam interface{}, inputParams ...interface{}) error {
+	return i.call(ctx, name, nil, outputParam, inputParams)
+}
+
+// call runs the exported function name, fn is the function when it has already
+// been looked up, i.e. by Bind, when nil the function is found from the exports
+func (i *wasmerInstance) call(ctx context.Context, name string, fn *exportedFunction, outputParam interface{}, inputParams []interface{}) error {
+	select {
+	case i.calls <- struct{}{}:
+	case <-ctx.Done():
+		return contextError(ctx.Err())
+	}
+	defer func() { <-i.calls }()
+
+	if i.removed {
+		return ErrInstanceRemoved
+	}
+
+	if i.unusable {
+		return ErrInstanceUnusable
+	}
+
+	i.ctx = ctx
+	i.lastCallFailed = false
+
+	err := i.meter.start()
 	if err != nil {
-		return FunctionNotFoundError{name, err}
+		i.lastCallFailed = true
+		return err
 	}
 
-	i.lastError = nil
+	// a callback that failed or panicked in the previous call interrupts the module
+	if i.interruptGlobal != nil {
+		err = i.interruptGlobal.Set(int32(0), wasmer.I32)
+		if err != nil {
+			return xerrors.Errorf("unable to reset interrupt for the instance: %w", err)
+		}
+	}
+
+	if i.memoryExceededGlobal != nil {
+		err = i.memoryExceededGlobal.Set(int32(0), wasmer.I32)
+		if err != nil {
+			return xerrors.Errorf("unable to reset memory limit for the instance: %w", err)
+		}
+	}
+
+	err = i.callFunction(ctx, name, fn, outputParam, inputParams...)
+	if err != nil && !i.unusable {
+		switch {
+		case i.meter.exhausted():
+			err = ErrOutOfFuel
+		case i.memoryLimitExceeded():
+			err = ErrMemoryLimitExceeded
+		}
+	}
+
+	// when the call has been interrupted the module may still be running and the
+	// memory can not be freed
+	if !i.unusable {
+		i.meter.stop()
+		i.freeMemory()
+	}
+
+	return err
+}
+
+func (i *wasmerInstance) callFunction(ctx context.Context, name string, fn *exportedFunction, outputParam interface{}, inputParams ...interface{}) error {
+	if fn == nil {
+		var err error
+		fn, err = i.lookupFunction(name)
+		if err != nil {
+			return err
+		}
+
+		// functions bound with Bind are checked when they are bound
+		err = i.checkSignature(name, fn, paramTypesOf(inputParams), outputTypesOf(outputParam))
+		if err != nil {
+			return err
+		}
+	}
+
+	f := fn.native
+	paramTypes := fn.params
 
-	// ensure the deallocation of memory is always gets called, pass a reference as the slice is not yet populated
-	defer i.freeAllocatedMemory()
+	i.lastError = nil
+	i.hostError = nil
 
 	// parse the input parameters, if we have a string we need to set that in the Wasm modules
 	// memory and pass a pointer to the function instead
@@ -123,7 +323,33 @@ func (i *wasmerInstance) CallFunction(name string, outputParam interface{}, inpu
 			processedParams[n] = addr
 
 		default:
-			processedParams[n] = p
+			// marshal structured parameters and pass the data in the same way as []byte
+			if i.encodeArguments() && p != nil && isStructured(reflect.TypeOf(p)) {
+				data, err := i.codec.Marshal(p)
+				if err != nil {
+					return xerrors.Errorf("unable to marshal parameter %d: %w", n, err)
+				}
+
+				addr, err := i.setBytesInMemory(data)
+				if err != nil {
+					return err
+				}
+
+				processedParams[n] = addr
+				continue
+			}
+
+			// convert numeric parameters to the type expected by the function
+			v, err := toWasmValue(reflect.ValueOf(p), paramTypes[n].Kind())
+			if xerrors.Is(err, errFloatPrecision) {
+				return signatureMismatch(name, fn, paramTypesOf(inputParams), outputTypesOf(outputParam))
+			}
+
+			if err != nil {
+				return xerrors.Errorf("unable to convert parameter %d: %w", n, err)
+			}
+
+			processedParams[n] = v
 		}
 	}
 
@@ -135,14 +361,67 @@ func (i *wasmerInstance) CallFunction(name string, outputParam interface{}, inpu
 		"outputParam", outputParam,
 		"inputParam", processedParams)
 
-	resp, err := f(processedParams...)
+	resp, err := i.invoke(ctx, f, processedParams)
+
+	// errors from the module leave the memory in an unknown state, errors converting
+	// the parameters or results do not
+	i.lastCallFailed = err != nil
+
+	// proc_exit raises a trap, a command that exits with 0 has completed successfully
+	var exit *wasmer.TrapError
+	if err != nil && !i.unusable && xerrors.As(err, &exit) {
+		if code, ok := exitCode(exit); ok {
+			i.log.Debug("Function exited", "name", name, "code", code)
+
+			if code == 0 {
+				i.lastCallFailed = false
+				return nil
+			}
+
+			return ExitError{Function: name, Code: code}
+		}
+	}
+
 	if err != nil {
 		i.log.Error("Calling function failed", "name", name, "error", err)
+
+		if i.unusable {
+			return err
+		}
+
+		var trap *wasmer.TrapError
+		isTrap := xerrors.As(err, &trap)
+
+		// a callback that can not be completed sets the error and interrupts the module
+		if herr := i.getError(); herr != nil {
+			// a callback that panicked is reported as a trap at the callback
+			if te, ok := herr.(TrapError); ok {
+				te.Function = name
+				if isTrap {
+					te.Frames = trapFrames(trap, i.getPlugin())
+				}
+
+				return te
+			}
+
+			return herr
+		}
+
+		if isTrap {
+			return TrapError{
+				Function: name,
+				Kind:     trapKind(trap.Error()),
+				Message:  trap.Error(),
+				Frames:   trapFrames(trap, i.getPlugin()),
+			}
+		}
+
 		return xerrors.Errorf("unable to call function: %w", err)
 	}
 
 	// check for errors
 	if err := i.getError(); err != nil {
+		i.lastCallFailed = true
 		return err
 	}
 
@@ -154,9 +433,49 @@ func (i *wasmerInstance) CallFunction(name string, outputParam interface{}, inpu
 		"response", resp,
 		"time taken", time.Now().Sub(t))
 
+	// functions with multiple results return a slice of values
+	values, ok := resp.([]interface{})
+	if !ok {
+		values = []interface{}{resp}
+	}
+
+	results, ok := outputParam.(Results)
+	if !ok {
+		results = Results{outputParam}
+	}
+
+	for n, out := range results {
+		if out == nil {
+			continue
+		}
+
+		if n >= len(values) {
+			return xerrors.Errorf("function %s returned %d values, %d output parameters were provided", name, len(values), len(results))
+		}
+
+		err := i.setOutput(out, values[n])
+		if err != nil {
+			if len(results) > 1 {
+				return xerrors.Errorf("unable to set output parameter %d: %w", n, err)
+			}
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setOutput sets the value pointed to by outputParam from the value returned by the function
+func (i *wasmerInstance) setOutput(outputParam interface{}, resp interface{}) error {
 	switch outputParam.(type) {
 	case *string:
-		s, err := i.getStringFromMemory(resp.(int32))
+		addr, ok := resp.(int32)
+		if !ok {
+			return xerrors.Errorf("unable to get string from instance memory, function must return a pointer")
+		}
+
+		s, err := i.getStringFromMemory(addr)
 		if err != nil {
 			return xerrors.Errorf("unable to get string from instance memory: %w", err)
 		}
@@ -164,41 +483,302 @@ func (i *wasmerInstance) CallFunction(name string, outputParam interface{}, inpu
 		*outputParam.(*string) = s
 
 	case *[]byte:
-		data, err := i.getBytesFromMemory(resp.(int32))
+		addr, ok := resp.(int32)
+		if !ok {
+			return xerrors.Errorf("unable to get bytes from instance memory, function must return a pointer")
+		}
+
+		data, err := i.getBytesFromMemory(addr)
 		if err != nil {
 			return err
 		}
 
 		*outputParam.(*[]byte) = data
 
-	case *int32:
-		*outputParam.(*int32) = resp.(int32)
-	case nil:
-
 	default:
-		return xerrors.Errorf("output parameters can only be of type *int32 or *string")
+		// numeric types are converted to the type of the output parameter
+		out := reflect.ValueOf(outputParam)
+		if out.Kind() != reflect.Ptr || out.IsNil() {
+			return xerrors.Errorf("output parameters must be a pointer, got %T", outputParam)
+		}
+
+		// structured types are unmarshalled from the returned bytes
+		if i.encodeArguments() && isStructured(out.Elem().Type()) {
+			addr, ok := resp.(int32)
+			if !ok {
+				return xerrors.Errorf("unable to unmarshal the function result, function must return a pointer")
+			}
+
+			data, err := i.getBytesFromMemory(addr)
+			if err != nil {
+				return err
+			}
+
+			err = i.codec.Unmarshal(data, outputParam)
+			if err != nil {
+				return xerrors.Errorf("unable to unmarshal the function result: %w", err)
+			}
+
+			return nil
+		}
+
+		if _, err := wasmKind(out.Elem().Type()); err != nil || passedByPointer(out.Elem().Type()) {
+			return xerrors.Errorf("output parameters can only be of type *string, *[]byte, *int32, *int64, *float32, *float64, *int, *uint32, *uint64 or *bool")
+		}
+
+		v, err := fromWasmValue(resp, out.Elem().Type())
+		if err != nil {
+			return xerrors.Errorf("unable to convert the function result: %w", err)
+		}
+
+		out.Elem().Set(v)
 	}
 
 	return nil
 }
 
-// Remove the instance and cleanup any volumes
+// exportedFunction is a function exported by the module
+type exportedFunction struct {
+	native  wasmer.NativeFunction
+	params  []*wasmer.ValueType
+	results []*wasmer.ValueType
+}
+
+// lookupFunction finds the exported function name, the call slot must be held
+func (i *wasmerInstance) lookupFunction(name string) (*exportedFunction, error) {
+	if i.removed {
+		return nil, ErrInstanceRemoved
+	}
+
+	rf, err := i.instance.Exports.GetRawFunction(name)
+	if err != nil {
+		return nil, FunctionNotFoundError{name, err}
+	}
+
+	return &exportedFunction{
+		native:  rf.Native(),
+		params:  rf.Type().Params(),
+		results: rf.Type().Results(),
+	}, nil
+}
+
+// invoke calls the Wasm function f, if the context can be cancelled the function
+// is called in a separate goroutine so that the caller can return as soon as the
+// context is done
+func (i *wasmerInstance) invoke(ctx context.Context, f wasmer.NativeFunction, params []interface{}) (interface{}, error) {
+	if ctx.Done() == nil {
+		return f(params...)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, contextError(err)
+	}
+
+	type result struct {
+		resp interface{}
+		err  error
+	}
+
+	// buffer the channel so that the goroutine can exit if the call is abandoned
+	done := make(chan result, 1)
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		resp, err := f(params...)
+		done <- result{resp, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.resp, r.err
+	case <-ctx.Done():
+		i.unusable = true
+		i.abandoned = stopped
+		i.interrupt()
+
+		return nil, contextError(ctx.Err())
+	}
+}
+
+// interrupt causes the module to trap at the next function call, loop iteration
+// or return from a host callback
+func (i *wasmerInstance) interrupt() {
+	err := i.interruptGlobal.Set(int32(1), wasmer.I32)
+	if err != nil {
+		i.log.Error("Unable to interrupt instance", "error", err)
+	}
+}
+
+// memoryLimitExceeded returns true when the last call trapped because the module
+// attempted to grow its memory beyond the limit
+func (i *wasmerInstance) memoryLimitExceeded() bool {
+	if i.memoryExceededGlobal == nil {
+		return false
+	}
+
+	v, err := i.memoryExceededGlobal.Get()
+	if err != nil {
+		return false
+	}
+
+	return v.(int32) != 0
+}
+
+// contextError converts a context error into the errors returned by CallFunctionContext
+func contextError(err error) error {
+	if err == context.DeadlineExceeded {
+		return ErrCallTimeout
+	}
+
+	return ErrCallCancelled
+}
+
+// Remove the instance and cleanup any volumes, Remove waits for a function call that is
+// in progress to complete. Memory allocated in the module is freed, captured output is
+// flushed, locks held in a Workspace are released and the scratch volume for the instance
+// is deleted. Calling a function on an instance that has been removed returns
+// ErrInstanceRemoved.
 func (i *wasmerInstance) Remove() error {
+	i.calls <- struct{}{}
+	defer func() { <-i.calls }()
+
+	if i.removed {
+		return nil
+	}
+
+	i.removed = true
+
+	// the memory of an interrupted module can not be trusted
+	if i.instance != nil && !i.unusable {
+		i.freeMemory()
+	}
+
+	for _, w := range []io.Writer{i.stdout, i.stderr} {
+		if lw, ok := w.(*lineWriter); ok {
+			lw.Flush()
+		}
+	}
+
+	if i.workspace != nil {
+		i.workspace.release(i.id)
+	}
+
+	// a call that was abandoned may still be running in the module until it reaches
+	// the interrupt, the Wasmer instance is released once it has stopped
+	if i.abandoned != nil {
+		go func(stopped chan struct{}) {
+			<-stopped
+			i.release()
+		}(i.abandoned)
+	} else {
+		i.release()
+	}
+
+	if i.volume != "" {
+		err := os.RemoveAll(i.volume)
+		if err != nil {
+			return xerrors.Errorf("unable to remove the volume %s for the instance: %w", i.volume, err)
+		}
+	}
+
+	return nil
+}
+
+// release drops the references to the Wasmer instance and the import object, wasmer-go
+// does not allow them to be closed explicitly and they are freed by their finalizers
+func (i *wasmerInstance) release() {
+	i.instance = nil
+	i.importObject = nil
+	i.guard = nil
+	i.interruptGlobal = nil
+	i.memoryExceededGlobal = nil
+
+	// the fuel consumed by the instance can still be read
+	if i.meter != nil {
+		i.meter.fuelGlobal = nil
+		i.meter.exhaustedGlobal = nil
+	}
+
+	i.allocatedMemory = map[int32]int32{}
+	i.ctx = nil
+}
+
+// failed returns true when the module trapped, was interrupted or a callback returned
+// an error during the last call, the instance memory may be in an inconsistent state.
+// Errors returned before the function is called, such as a SignatureMismatchError,
+// and errors converting the results do not fail the instance.
+func (i *wasmerInstance) failed() bool {
+	return i.lastCallFailed
+}
+
+// setResultGlobals sets the globals used to return the results of a callback
+// that returns i64, f32 or f64 values
+func (i *wasmerInstance) setResultGlobals(values []wasmer.Value) error {
+	for n, v := range values {
+		name := resultGlobal(n, v.Kind().String())
+
+		g, err := i.instance.Exports.GetGlobal(name)
+		if err != nil {
+			return xerrors.Errorf("unable to find the result global %s, ensure the callback signature matches the import: %w", name, err)
+		}
+
+		err = g.Set(v.Unwrap(), v.Kind())
+		if err != nil {
+			return xerrors.Errorf("unable to set the result global %s: %w", name, err)
+		}
+	}
+
 	return nil
 }
 
+// encodeArguments returns true when structured arguments to CallFunction are marshalled
+func (i *wasmerInstance) encodeArguments() bool {
+	return i.plugin != nil && i.plugin.config.EncodeArguments
+}
+
+// getCodec returns the codec used to marshal structs for the instance
+func (i *wasmerInstance) getCodec() Codec {
+	return i.codec
+}
+
+// getPlugin returns the plugin the instance was created from
+func (i *wasmerInstance) getPlugin() *plugin {
+	return i.plugin
+}
+
+// callContext returns the context for the function call that is currently in
+// progress, callbacks use this to stop the module once the context is done
+func (i *wasmerInstance) callContext() context.Context {
+	if i.ctx == nil {
+		return context.Background()
+	}
+
+	return i.ctx
+}
+
 func (i *wasmerInstance) getImportObject() importObject {
 	return i.importObject
 }
 
-func (i *wasmerInstance) setError(err string) {
-	i.lastError = fmt.Errorf(err)
+// setError sets the error returned by the current function call
+func (i *wasmerInstance) setError(err error) {
+	i.lastError = err
 }
 
 func (i *wasmerInstance) getError() error {
 	return i.lastError
 }
 
+func (i *wasmerInstance) setHostError(err error) {
+	i.hostError = err
+}
+
+func (i *wasmerInstance) getHostError() error {
+	return i.hostError
+}
+
 // setStringInMemory copies a Go string to the Wasm modules linear memory
 // it first allocates the memory by calling the modules helper function
 // allocate and then copies the string.
@@ -234,12 +814,11 @@ func (i *wasmerInstance) setStringInMemory(s string) (int32, error) {
 		return 0, xerrors.Errorf("unable to write string to memory, memory is not large enough to contain string")
 	}
 
-	for n, c := range s {
-		m.Data()[int(addr)+n] = byte(c)
-	}
+	data := m.Data()
+	copy(data[addr:], s)
 
 	// add the null terminating character
-	m.Data()[int(addr)+size] = '\x00'
+	data[int(addr)+len(s)] = '\x00'
 
 	return addr, nil
 }
@@ -300,7 +879,12 @@ func (i *wasmerInstance) setBytesInMemory(data []byte) (int32, error) {
 
 	m, err := i.instance.Exports.GetMemory("memory")
 	if err != nil {
-		panic(err)
+		return 0, xerrors.Errorf("unable to read Wasm module memory, ensure the Wasm module exports the memory named 'memory': %w", err)
+	}
+
+	// check the memory is big enough to store the data
+	if m.DataSize() < uint(addr)+uint(size) {
+		return 0, xerrors.Errorf("unable to write bytes to memory, memory is not large enough to contain the data")
 	}
 
 	// add the length as a uint32 to the first 4 bytes
@@ -320,12 +904,22 @@ func (i *wasmerInstance) setBytesInMemory(data []byte) (int32, error) {
 func (i *wasmerInstance) getBytesFromMemory(addr int32) ([]byte, error) {
 	m, err := i.instance.Exports.GetMemory("memory")
 	if err != nil {
-		panic(err)
+		return nil, xerrors.Errorf("unable to read Wasm module memory, ensure the Wasm module exports the memory named 'memory': %w", err)
+	}
+
+	// check the memory is big enough to contain the size
+	if addr < 0 || uint64(len(m.Data())) < uint64(addr)+4 {
+		return nil, xerrors.Errorf("unable to read bytes from memory, address %d is outside the memory", addr)
 	}
 
 	//get the size of the data from the first 4 bytes
 	byteLen := binary.LittleEndian.Uint32(m.Data()[addr:])
 
+	// check the memory is big enough to read the data
+	if uint64(len(m.Data())) < uint64(addr)+4+uint64(byteLen) {
+		return nil, xerrors.Errorf("unable to read bytes from memory, memory is not large enough to contain the data")
+	}
+
 	// add the allocated memory to the collection so that we can deallocate it later
 	i.allocatedMemory[addr] = int32(byteLen + 4)
 
@@ -342,6 +936,42 @@ func (i *wasmerInstance) getBytesFromMemory(addr int32) ([]byte, error) {
 	return data, nil
 }
 
+// freeMemory frees the memory allocated for the last call, the call may have left the
+// module interrupted or out of fuel so the globals are reset before deallocate is called
+func (i *wasmerInstance) freeMemory() {
+	if len(i.allocatedMemory) == 0 {
+		return
+	}
+
+	err := i.resetGlobals()
+	if err != nil {
+		i.log.Error("Unable to reset instance to free memory, potential memory leak", "error", err)
+		return
+	}
+
+	i.freeAllocatedMemory()
+}
+
+// resetGlobals clears the interrupt and memory limit flags set by the last call and
+// suspends metering, the fuel used by the engine to free memory is not recorded
+func (i *wasmerInstance) resetGlobals() error {
+	if i.interruptGlobal != nil {
+		err := i.interruptGlobal.Set(int32(0), wasmer.I32)
+		if err != nil {
+			return xerrors.Errorf("unable to reset interrupt for the instance: %w", err)
+		}
+	}
+
+	if i.memoryExceededGlobal != nil {
+		err := i.memoryExceededGlobal.Set(int32(0), wasmer.I32)
+		if err != nil {
+			return xerrors.Errorf("unable to reset memory limit for the instance: %w", err)
+		}
+	}
+
+	return i.meter.suspend()
+}
+
 // freeAllocatedMemory frees any memory that has been created in the instance
 // for passing complex types between the host and Wasm module
 func (i *wasmerInstance) freeAllocatedMemory() {
@@ -1,6 +1,11 @@
 package engine
 
-import "github.com/stretchr/testify/mock"
+import (
+	"context"
+
+	"github.com/stretchr/testify/mock"
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
 
 type mockInstance struct {
 	mock.Mock
@@ -10,11 +15,55 @@ func (m *mockInstance) CallFunction(name string, outParam interface{}, inParam .
 	return m.Called(name, outParam, inParam).Error(0)
 }
 
+func (m *mockInstance) CallFunctionContext(ctx context.Context, name string, outParam interface{}, inParam ...interface{}) error {
+	return m.Called(ctx, name, outParam, inParam).Error(0)
+}
+
+func (m *mockInstance) Bind(name string, fnPtr interface{}) error {
+	return m.Called(name, fnPtr).Error(0)
+}
+
+func (m *mockInstance) FuelConsumed() uint64 {
+	return m.Called().Get(0).(uint64)
+}
+
+func (m *mockInstance) Stdout() []byte {
+	return m.Called().Get(0).([]byte)
+}
+
+func (m *mockInstance) Stderr() []byte {
+	return m.Called().Get(0).([]byte)
+}
+
 func (m *mockInstance) Remove() error {
 	return m.Called().Error(0)
 }
 
-func (m *mockInstance) setError(err string) {
+func (m *mockInstance) failed() bool {
+	return m.Called().Bool(0)
+}
+
+func (m *mockInstance) getPlugin() *plugin {
+	return m.Called().Get(0).(*plugin)
+}
+
+func (m *mockInstance) callContext() context.Context {
+	return m.Called().Get(0).(context.Context)
+}
+
+func (m *mockInstance) interrupt() {
+	m.Called()
+}
+
+func (m *mockInstance) setResultGlobals(values []wasmer.Value) error {
+	return m.Called(values).Error(0)
+}
+
+func (m *mockInstance) getCodec() Codec {
+	return m.Called().Get(0).(Codec)
+}
+
+func (m *mockInstance) setError(err error) {
 	m.Called(err)
 }
 
@@ -26,6 +75,14 @@ func (m *mockInstance) getError() error {
 	return m.Called().Error(0)
 }
 
+func (m *mockInstance) setHostError(err error) {
+	m.Called(err)
+}
+
+func (m *mockInstance) getHostError() error {
+	return m.Called().Error(0)
+}
+
 func (m *mockInstance) setStringInMemory(str string) (int32, error) {
 	args := m.Called(str)
 
@@ -0,0 +1,343 @@
+package engine
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nicholasjackson/wasp/engine/logger"
+	"github.com/stretchr/testify/require"
+	"github.com/wasmerio/wasmer-go/wasmer"
+	"go.uber.org/goleak"
+)
+
+// watLoop is a module that calls the host function tick in an infinite loop,
+// the engine requires all modules to be WASI modules so all test modules
+// import proc_exit and export memory
+var watLoop = `
+(module
+	(import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+	(import "env" "tick" (func $tick))
+	(memory (export "memory") 1)
+	(func (export "loop")
+		(loop $l
+			call $tick
+			br $l)))
+`
+
+// watToWasm compiles the given WebAssembly text to the binary format
+func watToWasm(t *testing.T, wat string) []byte {
+	wasm, err := wasmer.Wat2Wasm(wat)
+	require.NoError(t, err)
+
+	return wasm
+}
+
+// setupWatInstance compiles the given WebAssembly text, registers it as the
+// plugin test and returns an instance of the plugin
+func setupWatInstance(t *testing.T, wat string, conf *PluginConfig) Instance {
+	e := New(logger.New(nil, nil, nil, nil))
+
+	err := e.RegisterPluginBytes("test", watToWasm(t, wat), conf)
+	require.NoError(t, err)
+
+	i, err := e.GetInstance("test", "")
+	require.NoError(t, err)
+
+	return i
+}
+
+func TestCallFunctionContextReturnsErrorOnTimeout(t *testing.T) {
+	cb := &Callbacks{}
+	cb.AddCallback("env", "tick", func() { time.Sleep(time.Millisecond) })
+
+	i := setupWatInstance(t, watLoop, &PluginConfig{Callbacks: cb})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := i.CallFunctionContext(ctx, "loop", nil)
+	require.Equal(t, ErrCallTimeout, err)
+	require.True(t, i.failed())
+
+	err = i.CallFunction("loop", nil)
+	require.Equal(t, ErrInstanceUnusable, err)
+}
+
+func TestCallFunctionContextReturnsErrorOnCancel(t *testing.T) {
+	cb := &Callbacks{}
+	cb.AddCallback("env", "tick", func() { time.Sleep(time.Millisecond) })
+
+	i := setupWatInstance(t, watLoop, &PluginConfig{Callbacks: cb})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	err := i.CallFunctionContext(ctx, "loop", nil)
+	require.Equal(t, ErrCallCancelled, err)
+}
+
+func TestCallFunctionContextCompletesBeforeDeadline(t *testing.T) {
+	i, _ := testSetupEngine(t, "../_test_fixtures/go/no_imports/module.wasm", nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var out int32
+	err := i.CallFunctionContext(ctx, "int_func", &out, 3, 2)
+	require.NoError(t, err)
+	require.Equal(t, int32(5), out)
+}
+
+func TestCallFunctionContextInterruptsModuleInLoop(t *testing.T) {
+	i := setupWatInstance(t, `
+(module
+	(import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+	(memory (export "memory") 1)
+	(func (export "loop")
+		(loop $l
+			br $l)))
+`, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := i.CallFunctionContext(ctx, "loop", nil)
+	require.Equal(t, ErrCallTimeout, err)
+}
+
+// watNumeric is a module with functions for each of the Wasm numeric types
+var watNumeric = `
+(module
+	(import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+	(import "env" "scale" (func $scale (param f64) (result f64)))
+	(memory (export "memory") 1)
+	(func (export "add_i64") (param i64 i64) (result i64)
+		(i64.add (local.get 0) (local.get 1)))
+	(func (export "add_f32") (param f32 f32) (result f32)
+		(f32.add (local.get 0) (local.get 1)))
+	(func (export "scale_f64") (param f64) (result f64)
+		(call $scale (local.get 0)))
+	(func (export "negate") (param i32) (result i32)
+		(i32.sub (i32.const 0) (local.get 0))))
+`
+
+func setupNumericInstance(t *testing.T) Instance {
+	cb := &Callbacks{}
+	cb.AddCallback("env", "scale", func(in float64) float64 { return in * 2 })
+
+	return setupWatInstance(t, watNumeric, &PluginConfig{Callbacks: cb})
+}
+
+func TestCallFunctionWithNumericTypes(t *testing.T) {
+	i := setupNumericInstance(t)
+
+	var i64 int64
+	err := i.CallFunction("add_i64", &i64, int64(math.MaxInt32), 1)
+	require.NoError(t, err)
+	require.Equal(t, int64(math.MaxInt32+1), i64)
+
+	var u64 uint64
+	err = i.CallFunction("add_i64", &u64, uint64(math.MaxUint64), uint64(0))
+	require.NoError(t, err)
+	require.Equal(t, uint64(math.MaxUint64), u64)
+
+	var f32 float32
+	err = i.CallFunction("add_f32", &f32, float32(1.25), float32(2))
+	require.NoError(t, err)
+	require.Equal(t, float32(3.25), f32)
+
+	var f64 float64
+	err = i.CallFunction("scale_f64", &f64, 1.5)
+	require.NoError(t, err)
+	require.Equal(t, float64(3), f64)
+
+	var n int
+	err = i.CallFunction("negate", &n, 3)
+	require.NoError(t, err)
+	require.Equal(t, -3, n)
+
+	var b bool
+	err = i.CallFunction("negate", &b, true)
+	require.NoError(t, err)
+	require.True(t, b)
+}
+
+func TestCallFunctionReturnsErrorWhenParameterOutOfRange(t *testing.T) {
+	i := setupNumericInstance(t)
+
+	err := i.CallFunction("negate", nil, int64(math.MaxInt32+1))
+	require.Error(t, err)
+}
+
+func TestCallFunctionReturnsErrorWhenResultOutOfRange(t *testing.T) {
+	i := setupNumericInstance(t)
+
+	var u32 uint32
+	err := i.CallFunction("add_i64", &u32, int64(math.MaxUint32), int64(1))
+	require.Error(t, err)
+}
+
+func TestCallFunctionReturnsErrorForUnsupportedOutputType(t *testing.T) {
+	i := setupNumericInstance(t)
+
+	var out map[string]string
+	err := i.CallFunction("negate", &out, 1)
+	require.Error(t, err)
+}
+
+// watEchoBytes is a module with a function that returns the pointer it is passed
+var watEchoBytes = `
+(module
+	(import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+	(memory (export "memory") 1)
+	(global $next (mut i32) (i32.const 1024))
+	(func (export "allocate") (param $size i32) (result i32)
+		(local $addr i32)
+		(local.set $addr (global.get $next))
+		(global.set $next (i32.add (global.get $next) (local.get $size)))
+		(local.get $addr))
+	(func (export "deallocate") (param i32 i32))
+	(func (export "echo") (param i32) (result i32)
+		(local.get 0)))
+`
+
+func TestCallFunctionMarshalsStructuredArguments(t *testing.T) {
+	i := setupWatInstance(t, watEchoBytes, &PluginConfig{EncodeArguments: true})
+
+	var out testPerson
+	err := i.CallFunction("echo", &out, testPerson{Name: "Nic", Age: 21})
+	require.NoError(t, err)
+	require.Equal(t, testPerson{Name: "Nic", Age: 21}, out)
+
+	var m map[string]int
+	err = i.CallFunction("echo", &m, map[string]int{"a": 1})
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{"a": 1}, m)
+
+	var s []string
+	err = i.CallFunction("echo", &s, &[]string{"a", "b"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b"}, s)
+
+	// the raw bytes are the JSON encoded struct
+	var b []byte
+	err = i.CallFunction("echo", &b, testPerson{Name: "Nic", Age: 21})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"name":"Nic","age":21}`, string(b))
+}
+
+func TestCallFunctionMarshalsStructuredArgumentsWithCodec(t *testing.T) {
+	i := setupWatInstance(t, watEchoBytes, &PluginConfig{EncodeArguments: true, Codec: MsgpackCodec{}})
+
+	var out testPerson
+	err := i.CallFunction("echo", &out, &testPerson{Name: "Nic", Age: 21})
+	require.NoError(t, err)
+	require.Equal(t, testPerson{Name: "Nic", Age: 21}, out)
+}
+
+func TestCallFunctionReturnsErrorForStructuredArgumentsWhenNotEnabled(t *testing.T) {
+	i := setupWatInstance(t, watEchoBytes, nil)
+
+	err := i.CallFunction("echo", nil, testPerson{Name: "Nic"})
+	require.Error(t, err)
+
+	var out testPerson
+	err = i.CallFunction("echo", &out, 1)
+	require.Error(t, err)
+}
+
+func TestRemoveStopsFurtherCalls(t *testing.T) {
+	i := setupNumericInstance(t)
+
+	var out int32
+	err := i.CallFunction("negate", &out, 1)
+	require.NoError(t, err)
+
+	err = i.Remove()
+	require.NoError(t, err)
+
+	err = i.CallFunction("negate", &out, 1)
+	require.ErrorIs(t, err, ErrInstanceRemoved)
+
+	var negate func(int32) (int32, error)
+	err = i.Bind("negate", &negate)
+	require.ErrorIs(t, err, ErrInstanceRemoved)
+
+	// removing an instance more than once is not an error
+	err = i.Remove()
+	require.NoError(t, err)
+}
+
+func TestRemoveDeletesScratchVolume(t *testing.T) {
+	i, _, _ := setupMemFSInstance(t)
+
+	volume := i.(*wasmerInstance).volume
+	require.DirExists(t, volume)
+
+	err := i.Remove()
+	require.NoError(t, err)
+	require.NoDirExists(t, volume)
+}
+
+func TestRemoveAfterAbandonedCall(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	cb := &Callbacks{}
+	cb.AddCallback("env", "tick", func() { time.Sleep(time.Millisecond) })
+
+	i := setupWatInstance(t, watLoop, &PluginConfig{Callbacks: cb})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := i.CallFunctionContext(ctx, "loop", nil)
+	require.ErrorIs(t, err, ErrCallTimeout)
+
+	err = i.Remove()
+	require.NoError(t, err)
+
+	err = i.CallFunction("loop", nil)
+	require.ErrorIs(t, err, ErrInstanceRemoved)
+}
+
+func TestRemoveDoesNotLeakResources(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	scratch := func() []string {
+		dirs, err := filepath.Glob(filepath.Join(os.TempDir(), "wasp-instance-*"))
+		require.NoError(t, err)
+
+		return dirs
+	}
+
+	before := scratch()
+
+	e := New(logger.New(nil, nil, nil, nil))
+
+	err := e.RegisterPluginBytes("test", watToWasm(t, watMemFS), nil)
+	require.NoError(t, err)
+
+	for n := 0; n < 10; n++ {
+		i, err := e.GetInstanceWithOptions("test", InstanceOptions{Filesystems: map[string]*MemFS{"/files": NewMemFS(nil)}})
+		require.NoError(t, err)
+
+		// a call with a deadline runs the module in a separate goroutine
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+
+		var errno int32
+		err = i.CallFunctionContext(ctx, "mkdir", &errno, fdFiles, pathSub, 3)
+		require.NoError(t, err)
+		require.Equal(t, wasiErrnoSuccess, errno)
+
+		cancel()
+
+		err = i.Remove()
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, before, scratch())
+}
@@ -0,0 +1,583 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// instrumentationPrefix is the prefix for the names of all
+// the exports added to instrumented modules
+const instrumentationPrefix = "__wasp_"
+
+// globalInterrupt is the name of the global exported by instrumented modules
+// that is used to interrupt execution, setting the global to a non zero value
+// causes the module to trap at the next check
+const globalInterrupt = "__wasp_interrupt"
+
+// globalFuel is the name of the global exported by metered modules that contains
+// the remaining fuel for the current call
+const globalFuel = "__wasp_fuel"
+
+// globalFuelExhausted is the name of the global exported by metered modules that
+// is set when the module traps because it has run out of fuel
+const globalFuelExhausted = "__wasp_fuel_exhausted"
+
+// globalMemoryExceeded is the name of the global exported by memory limited modules
+// that is set when the module traps because memory.grow exceeded the limit
+const globalMemoryExceeded = "__wasp_memory_exceeded"
+
+// globalResultPrefix is the prefix for the globals used to return the results
+// from host functions that return i64, f32 or f64 values
+const globalResultPrefix = "__wasp_result_"
+
+// resultGlobal returns the name of the global used to return the result at position
+// n with the given type, i.e. __wasp_result_0_f64
+func resultGlobal(n int, valueType string) string {
+	return fmt.Sprintf("%s%d_%s", globalResultPrefix, n, valueType)
+}
+
+// isInstrumentation returns true when the export was added to the module by instrumentModule
+func isInstrumentation(name string) bool {
+	return strings.HasPrefix(name, instrumentationPrefix)
+}
+
+// MemoryLimitError is returned by RegisterPlugin when a module declares
+// memory that exceeds the limit in the PluginConfig
+type MemoryLimitError struct {
+	// Pages is the number of pages declared by the module
+	Pages uint32
+	// Limit is the maximum number of pages allowed by the PluginConfig
+	Limit uint32
+}
+
+func (m MemoryLimitError) Error() string {
+	return fmt.Sprintf(
+		"plugin declares memory of %d pages which exceeds the limit of %d pages",
+		m.Pages,
+		m.Limit,
+	)
+}
+
+// instrumentOptions defines the optional instrumentation added to a module
+type instrumentOptions struct {
+	// metering adds instruction metering to the module
+	metering bool
+	// maxMemoryPages limits the size of the modules memory, 0 is unlimited
+	maxMemoryPages uint32
+}
+
+// instrumentModule rewrites the Wasm module so that the engine can control
+// its execution. The instrumented module exports the interrupt global, which
+// is checked at the start of every function, at the start of every loop and
+// after every call to an imported function.
+//
+// When metering is enabled every instruction consumes one unit of fuel from
+// the exported fuel global, fuel is charged at the start of each section of
+// code that has no branches. If there is insufficient fuel to execute the
+// section the fuel exhausted global is set and the module traps.
+//
+// When maxMemoryPages is set the maximum size of the modules memory is limited,
+// and every memory.grow instruction is replaced with a call to a function that
+// sets the memory exceeded global and traps when the memory can not be grown.
+//
+// Wasmer can only return i32 values from host functions, imported functions that
+// return i64, f32 or f64 values are changed to return no values, the host function
+// sets the exported result globals and the results are read from the globals after
+// every call to the function.
+//
+// The offsets of the instructions in the original module are returned for each function
+// keyed by the function index, see offsetMap.
+func instrumentModule(wasm []byte, opts instrumentOptions) ([]byte, map[uint32]offsetMap, error) {
+	m, err := parseWasmModule(wasm)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	imports, err := m.imports()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	inj := &injector{imports: imports, metering: opts.metering, offsets: map[uint32]offsetMap{}}
+
+	inj.interruptGlobal, err = m.addGlobal(globalInterrupt, valueI32, []byte{opI32Const, 0x00})
+	if err != nil {
+		return nil, nil, xerrors.Errorf("unable to add interrupt global: %w", err)
+	}
+
+	if opts.metering {
+		inj.fuelGlobal, err = m.addGlobal(globalFuel, valueI64, []byte{opI64Const, 0x00})
+		if err != nil {
+			return nil, nil, xerrors.Errorf("unable to add fuel global: %w", err)
+		}
+
+		inj.fuelExhaustedGlobal, err = m.addGlobal(globalFuelExhausted, valueI32, []byte{opI32Const, 0x00})
+		if err != nil {
+			return nil, nil, xerrors.Errorf("unable to add fuel exhausted global: %w", err)
+		}
+	}
+
+	if opts.maxMemoryPages > 0 {
+		err = m.limitMemory(imports, opts.maxMemoryPages)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		inj.limitMemory = true
+		inj.memoryExceededGlobal, err = m.addGlobal(globalMemoryExceeded, valueI32, []byte{opI32Const, 0x00})
+		if err != nil {
+			return nil, nil, xerrors.Errorf("unable to add memory exceeded global: %w", err)
+		}
+
+		// the grow function is added after all the other functions in the module
+		functions, _, err := m.vectorCount(sectionFunction)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		inj.growFunction = imports.functions + functions
+	}
+
+	inj.resultGlobals, err = m.replaceImportResults(imports)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("unable to replace import results: %w", err)
+	}
+
+	err = m.rewriteCode(inj.rewriteFunction)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// add the grow function after rewriting the code so that it is not instrumented
+	if inj.limitMemory {
+		err = m.addGrowFunction(inj.memoryExceededGlobal)
+		if err != nil {
+			return nil, nil, xerrors.Errorf("unable to add memory grow function: %w", err)
+		}
+	}
+
+	return m.bytes(), inj.offsets, nil
+}
+
+// injector injects the instrumentation into function bodies
+type injector struct {
+	imports         *wasmImports
+	interruptGlobal uint32
+
+	// resultGlobals contains the globals for the results of imported functions
+	// that return their results using globals, keyed by function index
+	resultGlobals map[uint32][]uint32
+
+	metering            bool
+	fuelGlobal          uint32
+	fuelExhaustedGlobal uint32
+
+	limitMemory          bool
+	memoryExceededGlobal uint32
+	growFunction         uint32
+
+	// offsets contains the offset map for each rewritten function keyed by the function
+	// index, functions are rewritten in order starting after the imported functions
+	offsets map[uint32]offsetMap
+}
+
+// offsetMap maps the offsets in an instrumented function body to the offsets in the
+// original function body, the entries are sorted by the instrumented offset
+type offsetMap []offsetMapping
+
+// offsetMapping is the start of a range of code in an instrumented function body
+type offsetMapping struct {
+	instrumented uint32
+	original     uint32
+	// inserted is true when the code was added by the instrumentation, all the offsets
+	// in the code map to the original offset of the instruction the code was added for
+	inserted bool
+}
+
+// add adds the start of a range of code to the map
+func (m *offsetMap) add(instrumented, original int, inserted bool) {
+	*m = append(*m, offsetMapping{instrumented: uint32(instrumented), original: uint32(original), inserted: inserted})
+}
+
+// original returns the offset in the original function body for the offset in the
+// instrumented function body
+func (m offsetMap) original(offset uint32) uint32 {
+	n := sort.Search(len(m), func(n int) bool { return m[n].instrumented > offset }) - 1
+	if n < 0 {
+		return offset
+	}
+
+	if m[n].inserted {
+		return m[n].original
+	}
+
+	return m[n].original + offset - m[n].instrumented
+}
+
+// rewriteFunction returns the instrumented function body, the offsets of the original
+// instructions are recorded so that trap frames can refer to the original module
+func (inj *injector) rewriteFunction(f *wasmFunctionBody) []byte {
+	// cost contains the fuel charged at the start of the instruction with the same index
+	cost := make([]int64, len(f.instructions))
+	if inj.metering {
+		segment := 0
+		for n, in := range f.instructions {
+			cost[segment]++
+
+			if endsSegment(in.opcode) {
+				segment = n + 1
+			}
+		}
+	}
+
+	// the offsets are from the start of the body, the local declarations are not changed
+	offsets := offsetMap{}
+	offsets.add(0, 0, false)
+
+	out := append([]byte{}, f.locals...)
+	offsets.add(len(out), len(f.locals), true)
+	out = inj.appendInterruptCheck(out)
+
+	for n, in := range f.instructions {
+		original := len(f.locals) + in.start
+
+		if cost[n] > 0 {
+			offsets.add(len(out), original, true)
+			out = inj.appendCharge(out, cost[n])
+		}
+
+		if inj.limitMemory && in.opcode == opMemoryGrow && in.index == 0 {
+			offsets.add(len(out), original, true)
+			out = append(out, opCall)
+			out = appendU32(out, inj.growFunction)
+			continue
+		}
+
+		offsets.add(len(out), original, false)
+		out = append(out, f.code[in.start:in.end]...)
+
+		switch {
+		case in.opcode == opLoop:
+			offsets.add(len(out), original, true)
+			out = inj.appendInterruptCheck(out)
+		case in.opcode == opCall && in.index < inj.imports.functions:
+			offsets.add(len(out), original, true)
+			out = inj.appendInterruptCheck(out)
+
+			for _, g := range inj.resultGlobals[in.index] {
+				out = append(out, opGlobalGet)
+				out = appendU32(out, g)
+			}
+		}
+	}
+
+	inj.offsets[inj.imports.functions+uint32(len(inj.offsets))] = offsets
+
+	return out
+}
+
+// endsSegment returns true when the instruction can change the flow of control,
+// the next instruction starts a new section of code that is charged separately
+func endsSegment(opcode byte) bool {
+	switch opcode {
+	case opUnreachable, opLoop, opIf, opElse, opEnd, opBr, opBrIf, opBrTable, opReturn,
+		opCall, 0x11, 0x12, 0x13: // call_indirect, return_call, return_call_indirect
+		return true
+	}
+
+	return false
+}
+
+// appendCharge appends code that deducts cost from the fuel global, when there
+// is insufficient fuel the fuel exhausted global is set and the module traps
+func (inj *injector) appendCharge(b []byte, cost int64) []byte {
+	// if fuel < cost
+	b = append(b, opGlobalGet)
+	b = appendU32(b, inj.fuelGlobal)
+	b = append(b, opI64Const)
+	b = appendS64(b, cost)
+	b = append(b, opI64LtU, opIf, blockTypeVoid)
+
+	// set exhausted and trap
+	b = append(b, opI32Const, 0x01, opGlobalSet)
+	b = appendU32(b, inj.fuelExhaustedGlobal)
+	b = append(b, opUnreachable, opEnd)
+
+	// fuel = fuel - cost
+	b = append(b, opGlobalGet)
+	b = appendU32(b, inj.fuelGlobal)
+	b = append(b, opI64Const)
+	b = appendS64(b, cost)
+	b = append(b, opI64Sub, opGlobalSet)
+	return appendU32(b, inj.fuelGlobal)
+}
+
+// appendInterruptCheck appends code that traps when the interrupt global is set
+func (inj *injector) appendInterruptCheck(b []byte) []byte {
+	b = append(b, opGlobalGet)
+	b = appendU32(b, inj.interruptGlobal)
+	return append(b, opIf, blockTypeVoid, opUnreachable, opEnd)
+}
+
+// limitMemory sets the maximum size of the modules memory to limit pages, an error
+// is returned if the module declares memory larger than the limit
+func (m *wasmModule) limitMemory(imports *wasmImports, limit uint32) error {
+	for _, l := range imports.memories {
+		if !l.hasMax {
+			return MemoryLimitError{Pages: wasmMaxPages, Limit: limit}
+		}
+
+		if l.max > limit {
+			return MemoryLimitError{Pages: l.max, Limit: limit}
+		}
+	}
+
+	count, rest, err := m.vectorCount(sectionMemory)
+	if err != nil {
+		return err
+	}
+
+	r := &wasmReader{data: rest}
+	out := appendU32(nil, count)
+
+	for n := uint32(0); n < count; n++ {
+		l := r.limits()
+		if r.err != nil {
+			return xerrors.Errorf("unable to read memory section: %w", r.err)
+		}
+
+		if l.min > limit {
+			return MemoryLimitError{Pages: l.min, Limit: limit}
+		}
+
+		if l.hasMax && l.max > limit {
+			return MemoryLimitError{Pages: l.max, Limit: limit}
+		}
+
+		if !l.hasMax {
+			l.max = limit
+			l.hasMax = true
+		}
+
+		out = appendLimits(out, l)
+	}
+
+	if count > 0 {
+		m.setSection(sectionMemory, out)
+	}
+
+	return nil
+}
+
+// addGrowFunction adds a function with the signature (i32) -> i32 that grows the modules
+// memory, when the memory can not be grown the memory exceeded global is set and the
+// module traps
+func (m *wasmModule) addGrowFunction(exceededGlobal uint32) error {
+	// function type (i32) -> i32
+	typeIndex, err := m.appendToVector(sectionType, 1, []byte{0x60, 0x01, valueI32, 0x01, valueI32})
+	if err != nil {
+		return err
+	}
+
+	_, err = m.appendToVector(sectionFunction, 1, appendU32(nil, typeIndex))
+	if err != nil {
+		return err
+	}
+
+	// one additional i32 local to store the result of memory.grow
+	body := []byte{0x01, 0x01, valueI32}
+	body = append(body, opLocalGet, 0x00, opMemoryGrow, 0x00, opLocalTee, 0x01)
+
+	// if result == -1
+	body = append(body, opI32Const, 0x7f, opI32Eq, opIf, blockTypeVoid)
+
+	// set exceeded and trap
+	body = append(body, opI32Const, 0x01, opGlobalSet)
+	body = appendU32(body, exceededGlobal)
+	body = append(body, opUnreachable, opEnd)
+
+	// return the result
+	body = append(body, opLocalGet, 0x01, opEnd)
+
+	_, err = m.appendToVector(sectionCode, 1, append(appendU32(nil, uint32(len(body))), body...))
+	return err
+}
+
+// replaceImportResults changes the type of imported functions that return i64, f32 or f64
+// values to a type with no results, and adds an exported global for each of the results.
+// The globals for the results of each of the changed functions are returned keyed by the
+// function index.
+//
+// Functions with changed types can not be called using call_indirect.
+func (m *wasmModule) replaceImportResults(imports *wasmImports) (map[uint32][]uint32, error) {
+	types, err := m.types()
+	if err != nil {
+		return nil, err
+	}
+
+	resultGlobals := map[uint32][]uint32{}
+	importTypes := map[uint32]uint32{}
+
+	// the globals and types are shared by all functions
+	globals := map[string]uint32{}
+	newTypes := map[uint32]uint32{}
+
+	function := uint32(0)
+	for _, e := range imports.entries {
+		if e.kind != externFunction {
+			continue
+		}
+
+		index := function
+		function++
+
+		if int(e.typeIndex) >= len(types) {
+			return nil, xerrors.Errorf("function %s.%s has invalid type %d", e.module, e.name, e.typeIndex)
+		}
+
+		ft := types[e.typeIndex]
+		if !needsResultGlobals(ft.results) {
+			continue
+		}
+
+		nt, ok := newTypes[e.typeIndex]
+		if !ok {
+			nt, err = m.appendToVector(sectionType, 1, wasmFuncType{params: ft.params}.encode())
+			if err != nil {
+				return nil, err
+			}
+
+			newTypes[e.typeIndex] = nt
+		}
+
+		importTypes[index] = nt
+
+		for n, r := range ft.results {
+			name := resultGlobal(n, valueTypeName(r))
+
+			g, ok := globals[name]
+			if !ok {
+				g, err = m.addGlobal(name, r, zeroConst(r))
+				if err != nil {
+					return nil, err
+				}
+
+				globals[name] = g
+			}
+
+			resultGlobals[index] = append(resultGlobals[index], g)
+		}
+	}
+
+	if len(importTypes) > 0 {
+		err = m.setImportFunctionTypes(importTypes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return resultGlobals, nil
+}
+
+// needsResultGlobals returns true when the results contain an i64, f32 or f64 value,
+// results that contain reference or vector types are not supported by Wasmer
+func needsResultGlobals(results []byte) bool {
+	needs := false
+	for _, t := range results {
+		switch t {
+		case valueI32:
+		case valueI64, valueF32, valueF64:
+			needs = true
+		default:
+			return false
+		}
+	}
+
+	return needs
+}
+
+// zeroConst returns the constant expression for the zero value of the
+// type without the end opcode
+func zeroConst(valueType byte) []byte {
+	switch valueType {
+	case valueI64:
+		return []byte{opI64Const, 0x00}
+	case valueF32:
+		return []byte{opF32Const, 0x00, 0x00, 0x00, 0x00}
+	case valueF64:
+		return []byte{opF64Const, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	}
+
+	return []byte{opI32Const, 0x00}
+}
+
+// addGlobal adds a mutable global to the module and exports it with the given name,
+// init is the constant expression for the initial value without the end opcode.
+// The index of the new global is returned.
+func (m *wasmModule) addGlobal(name string, valueType byte, init []byte) (uint32, error) {
+	imports, err := m.imports()
+	if err != nil {
+		return 0, err
+	}
+
+	g := []byte{valueType, 0x01}
+	g = append(g, init...)
+	g = append(g, opEnd)
+
+	n, err := m.appendToVector(sectionGlobal, 1, g)
+	if err != nil {
+		return 0, err
+	}
+
+	index := imports.globals + n
+
+	e := appendName(nil, name)
+	e = append(e, externGlobal)
+	e = appendU32(e, index)
+
+	_, err = m.appendToVector(sectionExport, 1, e)
+	if err != nil {
+		return 0, err
+	}
+
+	return index, nil
+}
+
+// rewriteCode replaces every function body in the code section with
+// the body returned from the rewrite function
+func (m *wasmModule) rewriteCode(rewrite func(*wasmFunctionBody) []byte) error {
+	count, rest, err := m.vectorCount(sectionCode)
+	if err != nil {
+		return err
+	}
+
+	r := &wasmReader{data: rest}
+	out := appendU32(nil, count)
+
+	for n := uint32(0); n < count; n++ {
+		size := r.u32()
+		body := r.bytes(int(size))
+
+		if r.err != nil {
+			return xerrors.Errorf("unable to read function %d: %w", n, r.err)
+		}
+
+		f, err := decodeFunctionBody(body)
+		if err != nil {
+			return xerrors.Errorf("unable to decode function %d: %w", n, err)
+		}
+
+		nb := rewrite(f)
+		out = appendU32(out, uint32(len(nb)))
+		out = append(out, nb...)
+	}
+
+	if count > 0 {
+		m.setSection(sectionCode, out)
+	}
+
+	return nil
+}
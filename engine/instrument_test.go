@@ -0,0 +1,69 @@
+package engine
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+func TestInstrumentModuleProducesValidModules(t *testing.T) {
+	modules := []string{
+		"../_test_fixtures/go/no_imports/module.wasm",
+		"../_test_fixtures/rust/no_imports/module.wasm",
+	}
+
+	for _, mod := range modules {
+		t.Run(mod, func(t *testing.T) {
+			wasm, err := ioutil.ReadFile(mod)
+			require.NoError(t, err)
+
+			iw, _, err := instrumentModule(wasm, instrumentOptions{metering: true})
+			require.NoError(t, err)
+
+			store := wasmer.NewStore(wasmer.NewEngine())
+			err = wasmer.ValidateModule(store, iw)
+			require.NoError(t, err)
+
+			m, err := wasmer.NewModule(store, iw)
+			require.NoError(t, err)
+
+			exports := map[string]bool{}
+			for _, e := range m.Exports() {
+				exports[e.Name()] = true
+			}
+
+			require.True(t, exports[globalInterrupt])
+			require.True(t, exports[globalFuel])
+			require.True(t, exports[globalFuelExhausted])
+		})
+	}
+}
+
+func TestInstrumentModuleAddsGlobalAndExportSections(t *testing.T) {
+	wasm, err := wasmer.Wat2Wasm(`(module (func (export "test")))`)
+	require.NoError(t, err)
+
+	iw, _, err := instrumentModule(wasm, instrumentOptions{})
+	require.NoError(t, err)
+
+	m, err := parseWasmModule(iw)
+	require.NoError(t, err)
+
+	count, _, err := m.vectorCount(sectionGlobal)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), count)
+
+	count, _, err = m.vectorCount(sectionExport)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), count)
+
+	store := wasmer.NewStore(wasmer.NewEngine())
+	require.NoError(t, wasmer.ValidateModule(store, iw))
+}
+
+func TestInstrumentModuleReturnsErrorForInvalidModule(t *testing.T) {
+	_, _, err := instrumentModule([]byte("not a module"), instrumentOptions{})
+	require.Error(t, err)
+}
@@ -0,0 +1,695 @@
+package engine
+
+import (
+	"bytes"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// Errors returned by the MemFS operations, the errors are converted to the WASI
+// error numbers when returned to a module
+var (
+	errNotDir   = xerrors.New("not a directory")
+	errIsDir    = xerrors.New("is a directory")
+	errNotEmpty = xerrors.New("directory not empty")
+	errInvalid  = xerrors.New("invalid argument")
+)
+
+// MemFS is an in-memory filesystem that can be mounted into a module instance using
+// InstanceOptions.Filesystems. Files are read from the optional base fs.FS, files
+// created or modified by the module are kept in memory and the base is never modified.
+//
+// MemFS implements fs.FS so that the files can be inspected after a function call,
+// Export writes the files to a directory on the host. A MemFS is safe for concurrent
+// use, mounting the same MemFS into multiple instances shares the files between them.
+type MemFS struct {
+	mutex sync.RWMutex
+	base  fs.FS
+
+	// nodes are the files and directories that have been created or modified
+	nodes map[string]*memNode
+	// deleted are the paths that have been removed from the base
+	deleted map[string]bool
+
+	lastIno uint64
+}
+
+// memNode is a file or directory in the overlay
+type memNode struct {
+	dir bool
+	// opaque is set for directories that do not contain the files from the base
+	opaque bool
+
+	data    []byte
+	mode    fs.FileMode
+	modTime time.Time
+	ino     uint64
+}
+
+// NewMemFS creates an in-memory filesystem, base contains the initial files and
+// can be nil for an empty filesystem
+func NewMemFS(base fs.FS) *MemFS {
+	m := &MemFS{base: base, nodes: map[string]*memNode{}, deleted: map[string]bool{}}
+	m.nodes["."] = &memNode{dir: true, mode: fs.ModeDir | 0755, modTime: time.Now(), ino: m.nextIno()}
+
+	return m
+}
+
+// Open opens the named file for reading, the file is a snapshot of the contents
+// when it is opened and is not affected by later changes
+func (m *MemFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	e, err := m.entry(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	if e.dir {
+		entries, err := m.list(name)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+
+		return &memDir{info: e, entries: entries}, nil
+	}
+
+	n, err := m.openFile(name, false)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return &memFile{info: e, r: bytes.NewReader(append([]byte{}, n.data...))}, nil
+}
+
+// ReadFile returns the contents of the named file
+func (m *MemFS) ReadFile(name string) ([]byte, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrInvalid}
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	n, err := m.openFile(name, false)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+
+	return append([]byte{}, n.data...), nil
+}
+
+// ReadDir returns the entries in the named directory sorted by name
+func (m *MemFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	entries, err := m.list(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	de := make([]fs.DirEntry, len(entries))
+	for n, e := range entries {
+		de[n] = e
+	}
+
+	return de, nil
+}
+
+// Stat returns the fs.FileInfo for the named file
+func (m *MemFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	e, err := m.entry(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+
+	return e, nil
+}
+
+// WriteFile writes data to the named file creating any missing directories,
+// an existing file is replaced
+func (m *MemFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "write", Path: name, Err: fs.ErrInvalid}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	err := m.mkdirAll(path.Dir(name))
+	if err != nil {
+		return &fs.PathError{Op: "write", Path: name, Err: err}
+	}
+
+	n, err := m.createFile(name, false)
+	if err != nil {
+		return &fs.PathError{Op: "write", Path: name, Err: err}
+	}
+
+	n.data = append([]byte{}, data...)
+	n.mode = perm & fs.ModePerm
+	n.modTime = time.Now()
+
+	return nil
+}
+
+// MkdirAll creates the named directory and any missing parents
+func (m *MemFS) MkdirAll(name string) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrInvalid}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	err := m.mkdirAll(name)
+	if err != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+// Export writes all the files and directories to the host directory dir, the
+// directory is created when it does not exist
+func (m *MemFS) Export(dir string) error {
+	return fs.WalkDir(m, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		host := filepath.Join(dir, filepath.FromSlash(p))
+
+		if d.IsDir() {
+			return os.MkdirAll(host, 0755)
+		}
+
+		data, err := m.ReadFile(p)
+		if err != nil {
+			return err
+		}
+
+		return os.WriteFile(host, data, 0644)
+	})
+}
+
+// nextIno returns the inode number for a new node
+func (m *MemFS) nextIno() uint64 {
+	m.lastIno++
+	return m.lastIno
+}
+
+// baseVisible returns true when the path in the base has not been hidden by
+// removing it or one of its parents from the filesystem
+func (m *MemFS) baseVisible(p string) bool {
+	if m.base == nil {
+		return false
+	}
+
+	for a := p; a != "."; a = path.Dir(a) {
+		if m.deleted[a] {
+			return false
+		}
+
+		if n, ok := m.nodes[a]; ok && a != p && (n.opaque || !n.dir) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// inBase returns true when the path exists in the base and is visible
+func (m *MemFS) inBase(p string) bool {
+	if !m.baseVisible(p) {
+		return false
+	}
+
+	_, err := fs.Stat(m.base, p)
+	return err == nil
+}
+
+// entry returns the details of the file or directory at p
+func (m *MemFS) entry(p string) (memEntry, error) {
+	if n, ok := m.nodes[p]; ok {
+		return n.entry(path.Base(p)), nil
+	}
+
+	if m.baseVisible(p) {
+		fi, err := fs.Stat(m.base, p)
+		if err == nil {
+			return memEntry{
+				name:    path.Base(p),
+				dir:     fi.IsDir(),
+				size:    fi.Size(),
+				mode:    fi.Mode(),
+				modTime: fi.ModTime(),
+				ino:     baseIno(p),
+			}, nil
+		}
+	}
+
+	return memEntry{}, fs.ErrNotExist
+}
+
+// list returns the entries in the directory at p sorted by name
+func (m *MemFS) list(p string) ([]memEntry, error) {
+	e, err := m.entry(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if !e.dir {
+		return nil, errNotDir
+	}
+
+	entries := map[string]memEntry{}
+
+	if n, ok := m.nodes[p]; m.baseVisible(p) && (!ok || !n.opaque) {
+		// the directory may only exist in the overlay
+		base, _ := fs.ReadDir(m.base, p)
+
+		for _, d := range base {
+			cp := path.Join(p, d.Name())
+			if m.deleted[cp] {
+				continue
+			}
+
+			ce, err := m.entry(cp)
+			if err == nil {
+				entries[d.Name()] = ce
+			}
+		}
+	}
+
+	for k, n := range m.nodes {
+		if k != "." && path.Dir(k) == p {
+			entries[path.Base(k)] = n.entry(path.Base(k))
+		}
+	}
+
+	sorted := make([]memEntry, 0, len(entries))
+	for _, e := range entries {
+		sorted = append(sorted, e)
+	}
+
+	sort.Slice(sorted, func(a, b int) bool { return sorted[a].name < sorted[b].name })
+
+	return sorted, nil
+}
+
+// openFile returns the node for the file at p, when write is true files from the
+// base are copied to the overlay so that they can be modified
+func (m *MemFS) openFile(p string, write bool) (*memNode, error) {
+	if n, ok := m.nodes[p]; ok {
+		if n.dir {
+			return nil, errIsDir
+		}
+
+		return n, nil
+	}
+
+	e, err := m.entry(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.dir {
+		return nil, errIsDir
+	}
+
+	data, err := fs.ReadFile(m.base, p)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &memNode{data: data, mode: e.mode & fs.ModePerm, modTime: e.modTime, ino: e.ino}
+	if write {
+		m.nodes[p] = n
+	}
+
+	return n, nil
+}
+
+// createFile creates the file at p returning the existing file when it exists
+// and exclusive is false
+func (m *MemFS) createFile(p string, exclusive bool) (*memNode, error) {
+	if p == "." {
+		return nil, errIsDir
+	}
+
+	e, err := m.entry(p)
+	if err == nil {
+		if exclusive {
+			return nil, fs.ErrExist
+		}
+
+		if e.dir {
+			return nil, errIsDir
+		}
+
+		return m.openFile(p, true)
+	}
+
+	err = m.checkParent(p)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &memNode{mode: 0644, modTime: time.Now(), ino: m.nextIno()}
+	m.nodes[p] = n
+	delete(m.deleted, p)
+
+	return n, nil
+}
+
+// mkdir creates the directory at p
+func (m *MemFS) mkdir(p string) error {
+	if _, err := m.entry(p); err == nil {
+		return fs.ErrExist
+	}
+
+	err := m.checkParent(p)
+	if err != nil {
+		return err
+	}
+
+	// a new directory does not contain any of the files in the base
+	m.nodes[p] = &memNode{dir: true, opaque: true, mode: fs.ModeDir | 0755, modTime: time.Now(), ino: m.nextIno()}
+	delete(m.deleted, p)
+
+	return nil
+}
+
+// mkdirAll creates the directory at p and any missing parents
+func (m *MemFS) mkdirAll(p string) error {
+	e, err := m.entry(p)
+	if err == nil {
+		if !e.dir {
+			return errNotDir
+		}
+
+		return nil
+	}
+
+	err = m.mkdirAll(path.Dir(p))
+	if err != nil {
+		return err
+	}
+
+	return m.mkdir(p)
+}
+
+// checkParent returns an error when the parent of p is not a directory
+func (m *MemFS) checkParent(p string) error {
+	e, err := m.entry(path.Dir(p))
+	if err != nil {
+		return err
+	}
+
+	if !e.dir {
+		return errNotDir
+	}
+
+	return nil
+}
+
+// remove removes the file at p, or the empty directory when dir is true
+func (m *MemFS) remove(p string, dir bool) error {
+	if p == "." {
+		return errInvalid
+	}
+
+	e, err := m.entry(p)
+	if err != nil {
+		return err
+	}
+
+	if dir {
+		if !e.dir {
+			return errNotDir
+		}
+
+		entries, err := m.list(p)
+		if err != nil {
+			return err
+		}
+
+		if len(entries) > 0 {
+			return errNotEmpty
+		}
+	} else if e.dir {
+		return errIsDir
+	}
+
+	m.hide(p)
+
+	return nil
+}
+
+// hide removes p and anything below it from the overlay and hides it in the base
+func (m *MemFS) hide(p string) {
+	inBase := m.inBase(p)
+
+	for k := range m.nodes {
+		if k == p || strings.HasPrefix(k, p+"/") {
+			delete(m.nodes, k)
+		}
+	}
+
+	if inBase {
+		m.deleted[p] = true
+	}
+}
+
+// rename moves the file or directory at from to to, an existing file or empty
+// directory at to is replaced
+func (m *MemFS) rename(from, to string) error {
+	if from == "." || to == "." || strings.HasPrefix(to, from+"/") {
+		return errInvalid
+	}
+
+	e, err := m.entry(from)
+	if err != nil {
+		return err
+	}
+
+	if from == to {
+		return nil
+	}
+
+	err = m.checkParent(to)
+	if err != nil {
+		return err
+	}
+
+	if te, err := m.entry(to); err == nil {
+		if e.dir && !te.dir {
+			return errNotDir
+		}
+
+		if !e.dir && te.dir {
+			return errIsDir
+		}
+
+		err = m.remove(to, te.dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	// copy the nodes to the new location before removing the original, nodes from
+	// the overlay are moved so that open files are not affected
+	moved := map[string]*memNode{}
+	err = m.collect(from, to, moved)
+	if err != nil {
+		return err
+	}
+
+	m.hide(from)
+
+	for k, n := range moved {
+		m.nodes[k] = n
+	}
+
+	delete(m.deleted, to)
+
+	return nil
+}
+
+// collect adds the nodes for p and anything below it to nodes using the path to
+func (m *MemFS) collect(p, to string, nodes map[string]*memNode) error {
+	e, err := m.entry(p)
+	if err != nil {
+		return err
+	}
+
+	if !e.dir {
+		n, err := m.openFile(p, false)
+		if err != nil {
+			return err
+		}
+
+		nodes[to] = n
+		return nil
+	}
+
+	n, ok := m.nodes[p]
+	if !ok {
+		n = &memNode{dir: true, mode: e.mode, modTime: e.modTime, ino: e.ino}
+	}
+
+	// all the files are copied so the directory no longer uses the base
+	n.opaque = true
+	nodes[to] = n
+
+	entries, err := m.list(p)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range entries {
+		err = m.collect(path.Join(p, c.name), path.Join(to, c.name), nodes)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setModTime sets the modification time of the file or directory at p
+func (m *MemFS) setModTime(p string, t time.Time) error {
+	e, err := m.entry(p)
+	if err != nil {
+		return err
+	}
+
+	n, ok := m.nodes[p]
+	if !ok {
+		if e.dir {
+			n = &memNode{dir: true, mode: e.mode, ino: e.ino}
+			m.nodes[p] = n
+		} else {
+			n, err = m.openFile(p, true)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	n.modTime = t
+
+	return nil
+}
+
+// entry returns the details of the node
+func (n *memNode) entry(name string) memEntry {
+	mode := n.mode
+	if n.dir {
+		mode |= fs.ModeDir
+	}
+
+	return memEntry{name: name, dir: n.dir, size: int64(len(n.data)), mode: mode, modTime: n.modTime, ino: n.ino}
+}
+
+// baseIno returns the inode number for a file in the base, the number has the
+// top bit set so that it does not clash with the numbers of the overlay nodes
+func baseIno(p string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(p))
+
+	return h.Sum64() | 1<<63
+}
+
+// memEntry is the details of a file or directory, it implements fs.FileInfo
+// and fs.DirEntry
+type memEntry struct {
+	name    string
+	dir     bool
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+	ino     uint64
+}
+
+func (e memEntry) Name() string               { return e.name }
+func (e memEntry) Size() int64                { return e.size }
+func (e memEntry) Mode() fs.FileMode          { return e.mode }
+func (e memEntry) ModTime() time.Time         { return e.modTime }
+func (e memEntry) IsDir() bool                { return e.dir }
+func (e memEntry) Sys() interface{}           { return nil }
+func (e memEntry) Type() fs.FileMode          { return e.mode.Type() }
+func (e memEntry) Info() (fs.FileInfo, error) { return e, nil }
+
+// memFile is a file opened with MemFS.Open
+type memFile struct {
+	info memEntry
+	r    *bytes.Reader
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *memFile) Read(b []byte) (int, error) { return f.r.Read(b) }
+func (f *memFile) Close() error               { return nil }
+
+// memDir is a directory opened with MemFS.Open
+type memDir struct {
+	info    memEntry
+	entries []memEntry
+	offset  int
+}
+
+func (d *memDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *memDir) Close() error               { return nil }
+
+func (d *memDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errIsDir}
+}
+
+// ReadDir implements fs.ReadDirFile
+func (d *memDir) ReadDir(count int) ([]fs.DirEntry, error) {
+	remaining := len(d.entries) - d.offset
+	if count > 0 && remaining == 0 {
+		return nil, io.EOF
+	}
+
+	if count <= 0 || count > remaining {
+		count = remaining
+	}
+
+	de := make([]fs.DirEntry, count)
+	for n := range de {
+		de[n] = d.entries[d.offset+n]
+	}
+
+	d.offset += count
+
+	return de, nil
+}
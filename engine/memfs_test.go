@@ -0,0 +1,115 @@
+package engine
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func setupMemFS() (*MemFS, fstest.MapFS) {
+	base := fstest.MapFS{
+		"in.txt":          {Data: []byte("base")},
+		"dir/one.txt":     {Data: []byte("one")},
+		"dir/sub/two.txt": {Data: []byte("two")},
+	}
+
+	return NewMemFS(base), base
+}
+
+func TestMemFSReadsFromBase(t *testing.T) {
+	m, _ := setupMemFS()
+
+	d, err := m.ReadFile("in.txt")
+	require.NoError(t, err)
+	require.Equal(t, "base", string(d))
+
+	err = fstest.TestFS(m, "in.txt", "dir/one.txt", "dir/sub/two.txt")
+	require.NoError(t, err)
+}
+
+func TestMemFSWritesDoNotModifyBase(t *testing.T) {
+	m, base := setupMemFS()
+
+	err := m.WriteFile("in.txt", []byte("changed"), 0644)
+	require.NoError(t, err)
+
+	err = m.WriteFile("new/file.txt", []byte("new"), 0644)
+	require.NoError(t, err)
+
+	d, err := m.ReadFile("in.txt")
+	require.NoError(t, err)
+	require.Equal(t, "changed", string(d))
+
+	d, err = m.ReadFile("new/file.txt")
+	require.NoError(t, err)
+	require.Equal(t, "new", string(d))
+
+	require.Equal(t, "base", string(base["in.txt"].Data))
+}
+
+func TestMemFSRemoveHidesBase(t *testing.T) {
+	m, _ := setupMemFS()
+
+	err := m.remove("dir/sub/two.txt", false)
+	require.NoError(t, err)
+
+	err = m.remove("dir/sub", true)
+	require.NoError(t, err)
+
+	_, err = m.Stat("dir/sub/two.txt")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	// a new directory does not contain the files from the base
+	err = m.mkdir("dir/sub")
+	require.NoError(t, err)
+
+	entries, err := m.ReadDir("dir/sub")
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	err = m.remove("dir", true)
+	require.ErrorIs(t, err, errNotEmpty)
+}
+
+func TestMemFSRenameDirectory(t *testing.T) {
+	m, _ := setupMemFS()
+
+	err := m.rename("dir", "moved")
+	require.NoError(t, err)
+
+	_, err = m.Stat("dir")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	d, err := m.ReadFile("moved/sub/two.txt")
+	require.NoError(t, err)
+	require.Equal(t, "two", string(d))
+
+	err = m.rename("moved", "moved/sub/inside")
+	require.ErrorIs(t, err, errInvalid)
+
+	err = m.rename("in.txt", "moved")
+	require.ErrorIs(t, err, errIsDir)
+}
+
+func TestMemFSExport(t *testing.T) {
+	m, _ := setupMemFS()
+
+	err := m.WriteFile("new.txt", []byte("new"), 0644)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	err = m.Export(dir)
+	require.NoError(t, err)
+
+	d, err := os.ReadFile(filepath.Join(dir, "new.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "new", string(d))
+
+	d, err = os.ReadFile(filepath.Join(dir, "dir", "sub", "two.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "two", string(d))
+}
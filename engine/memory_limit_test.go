@@ -0,0 +1,86 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+// watGrow is a module that grows its memory by the number of pages given in the parameter
+var watGrow = `
+(module
+	(import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+	(memory (export "memory") 1)
+	(func (export "grow") (param $n i32) (result i32)
+		(memory.grow (local.get $n)))
+	(func (export "size") (result i32)
+		(memory.size)))
+`
+
+func TestMemoryLimitAllowsGrowthWithinLimit(t *testing.T) {
+	i := setupWatInstance(t, watGrow, &PluginConfig{Callbacks: &Callbacks{}, MaxMemoryPages: 4})
+
+	var out int32
+	err := i.CallFunction("grow", &out, 3)
+	require.NoError(t, err)
+	require.Equal(t, int32(1), out)
+
+	err = i.CallFunction("size", &out)
+	require.NoError(t, err)
+	require.Equal(t, int32(4), out)
+}
+
+func TestMemoryLimitReturnsErrorWhenGrowthExceedsLimit(t *testing.T) {
+	i := setupWatInstance(t, watGrow, &PluginConfig{Callbacks: &Callbacks{}, MaxMemoryPages: 4})
+
+	err := i.CallFunction("grow", nil, 4)
+	require.Equal(t, ErrMemoryLimitExceeded, err)
+
+	// the error is reset for the next call
+	err = i.CallFunction("grow", nil, 1)
+	require.NoError(t, err)
+}
+
+func TestMemoryLimitInBytesIsConvertedToPages(t *testing.T) {
+	i := setupWatInstance(t, watGrow, &PluginConfig{Callbacks: &Callbacks{}, MaxMemoryBytes: 2*65536 + 100})
+
+	err := i.CallFunction("grow", nil, 1)
+	require.NoError(t, err)
+
+	err = i.CallFunction("grow", nil, 1)
+	require.Equal(t, ErrMemoryLimitExceeded, err)
+}
+
+func TestMemoryLimitRejectsModuleWithLargerMaximum(t *testing.T) {
+	wasm := watToWasm(t, `
+(module
+	(import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+	(memory (export "memory") 1 10))
+`)
+
+	e := New(nil)
+	err := e.RegisterPluginBytes("test", wasm, &PluginConfig{Callbacks: &Callbacks{}, MaxMemoryPages: 4})
+
+	mle := MemoryLimitError{}
+	require.True(t, xerrors.As(err, &mle))
+	require.Equal(t, uint32(10), mle.Pages)
+	require.Equal(t, uint32(4), mle.Limit)
+}
+
+func TestMemoryLimitRejectsModuleWithLargerMinimum(t *testing.T) {
+	e := New(nil)
+	err := e.RegisterPlugin("test", "../_test_fixtures/rust/no_imports/module.wasm", &PluginConfig{Callbacks: &Callbacks{}, MaxMemoryPages: 4})
+
+	mle := MemoryLimitError{}
+	require.True(t, xerrors.As(err, &mle))
+}
+
+func TestMemoryLimitedGoModuleCallsFunctions(t *testing.T) {
+	i, _ := testSetupEngine(t, "../_test_fixtures/go/no_imports/module.wasm", &PluginConfig{Callbacks: &Callbacks{}, MaxMemoryPages: 16})
+
+	var out string
+	err := i.CallFunction("string_func", &out, "Nic")
+	require.NoError(t, err)
+	require.Equal(t, "Hello Nic", out)
+}
@@ -0,0 +1,157 @@
+package engine
+
+import (
+	"sync/atomic"
+
+	"github.com/wasmerio/wasmer-go/wasmer"
+	"golang.org/x/xerrors"
+)
+
+// ErrOutOfFuel is returned by CallFunction when the function call exceeds
+// the fuel budget for the call or the instance
+var ErrOutOfFuel = xerrors.New("function call ran out of fuel")
+
+// meter tracks the fuel used by an instance, fuel is only tracked when
+// metering is enabled in the PluginConfig
+type meter struct {
+	// consumed is the total fuel consumed by the instance, it is the first field
+	// so that it is aligned for atomic access on 32 bit platforms
+	consumed uint64
+
+	// limits from the plugin config
+	callFuel     uint64
+	instanceFuel uint64
+
+	fuelGlobal      *wasmer.Global
+	exhaustedGlobal *wasmer.Global
+
+	// budget is the fuel available to the current call
+	budget uint64
+}
+
+// newMeter creates a meter for the instance, nil is returned when the plugin
+// is not metered
+func newMeter(instance *wasmer.Instance, config *PluginConfig) (*meter, error) {
+	if !config.metered() {
+		return nil, nil
+	}
+
+	fg, err := instance.Exports.GetGlobal(globalFuel)
+	if err != nil {
+		return nil, xerrors.Errorf("unable to find the fuel global for the plugin: %w", err)
+	}
+
+	eg, err := instance.Exports.GetGlobal(globalFuelExhausted)
+	if err != nil {
+		return nil, xerrors.Errorf("unable to find the fuel exhausted global for the plugin: %w", err)
+	}
+
+	return &meter{
+		callFuel:        config.Fuel,
+		instanceFuel:    config.InstanceFuel,
+		fuelGlobal:      fg,
+		exhaustedGlobal: eg,
+	}, nil
+}
+
+// start sets the fuel available to the module for the next call,
+// ErrOutOfFuel is returned when the instance has no fuel remaining
+func (m *meter) start() error {
+	if m == nil {
+		return nil
+	}
+
+	m.budget = m.callFuel
+	if m.instanceFuel > 0 {
+		if m.consumed >= m.instanceFuel {
+			return ErrOutOfFuel
+		}
+
+		remaining := m.instanceFuel - m.consumed
+		if m.budget == 0 || remaining < m.budget {
+			m.budget = remaining
+		}
+	}
+
+	// the fuel global is an i64 that is compared as unsigned by the module
+	err := m.fuelGlobal.Set(int64(m.budget), wasmer.I64)
+	if err != nil {
+		return xerrors.Errorf("unable to set fuel for the instance: %w", err)
+	}
+
+	err = m.exhaustedGlobal.Set(int32(0), wasmer.I32)
+	if err != nil {
+		return xerrors.Errorf("unable to reset fuel for the instance: %w", err)
+	}
+
+	return nil
+}
+
+// stop records the fuel used by the call, a call that runs out of fuel
+// consumes its entire budget
+func (m *meter) stop() {
+	if m == nil {
+		return
+	}
+
+	defer func() { m.budget = 0 }()
+
+	if m.exhausted() {
+		atomic.AddUint64(&m.consumed, m.budget)
+		return
+	}
+
+	v, err := m.fuelGlobal.Get()
+	if err != nil {
+		return
+	}
+
+	atomic.AddUint64(&m.consumed, m.budget-uint64(v.(int64)))
+}
+
+// suspend gives the module unlimited fuel without recording the fuel used, it is
+// used when the engine calls the module outside of a function call
+func (m *meter) suspend() error {
+	if m == nil {
+		return nil
+	}
+
+	// compared as unsigned by the module, -1 is the maximum fuel
+	err := m.fuelGlobal.Set(int64(-1), wasmer.I64)
+	if err != nil {
+		return xerrors.Errorf("unable to suspend fuel for the instance: %w", err)
+	}
+
+	err = m.exhaustedGlobal.Set(int32(0), wasmer.I32)
+	if err != nil {
+		return xerrors.Errorf("unable to reset fuel for the instance: %w", err)
+	}
+
+	return nil
+}
+
+// exhausted returns true when the last call trapped due to running out of fuel
+func (m *meter) exhausted() bool {
+	if m == nil {
+		return false
+	}
+
+	v, err := m.exhaustedGlobal.Get()
+	if err != nil {
+		return false
+	}
+
+	return v.(int32) != 0
+}
+
+// FuelConsumed returns the total fuel consumed by all the function calls made
+// to the instance, fuel is only tracked when the plugin has a fuel budget set
+// in the PluginConfig. FuelConsumed can be called while a function call is in
+// progress and returns the fuel consumed by the completed calls.
+func (i *wasmerInstance) FuelConsumed() uint64 {
+	if i.meter == nil {
+		return 0
+	}
+
+	return atomic.LoadUint64(&i.meter.consumed)
+}
@@ -0,0 +1,142 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// watCount is a module that loops the number of times given in the parameter
+var watCount = `
+(module
+	(import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+	(memory (export "memory") 1)
+	(func (export "count") (param $n i32) (result i32)
+		(local $i i32)
+		(block $done
+			(loop $l
+				(br_if $done (i32.ge_s (local.get $i) (local.get $n)))
+				(local.set $i (i32.add (local.get $i) (i32.const 1)))
+				(br $l)))
+		(local.get $i)))
+`
+
+// watAllocations is a module that counts the allocations that have not been freed
+var watAllocations = `
+(module
+	(import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+	(memory (export "memory") 1)
+	(global $next (mut i32) (i32.const 1024))
+	(global $allocated (export "allocated") (mut i32) (i32.const 0))
+	(func (export "allocate") (param $size i32) (result i32)
+		(local $addr i32)
+		(global.set $allocated (i32.add (global.get $allocated) (i32.const 1)))
+		(local.set $addr (global.get $next))
+		(global.set $next (i32.add (global.get $next) (local.get $size)))
+		(local.get $addr))
+	(func (export "deallocate") (param i32 i32)
+		(global.set $allocated (i32.sub (global.get $allocated) (i32.const 1))))
+	(func (export "spin") (param i32)
+		(loop $l (br $l))))
+`
+
+// allocated returns the number of allocations in the module that have not been freed
+func allocated(t *testing.T, i Instance) int32 {
+	g, err := i.(*wasmerInstance).instance.Exports.GetGlobal("allocated")
+	require.NoError(t, err)
+
+	v, err := g.Get()
+	require.NoError(t, err)
+
+	return v.(int32)
+}
+
+func TestMeteredInstanceReturnsFuelConsumed(t *testing.T) {
+	i := setupWatInstance(t, watCount, &PluginConfig{Callbacks: &Callbacks{}, Fuel: 100000})
+
+	var out int32
+	err := i.CallFunction("count", &out, 10)
+	require.NoError(t, err)
+	require.Equal(t, int32(10), out)
+
+	first := i.FuelConsumed()
+	require.Greater(t, first, uint64(10))
+
+	// metering is deterministic, the same call consumes the same fuel
+	err = i.CallFunction("count", &out, 10)
+	require.NoError(t, err)
+	require.Equal(t, first*2, i.FuelConsumed())
+}
+
+func TestMeteredInstanceFuelIncreasesWithWork(t *testing.T) {
+	i := setupWatInstance(t, watCount, &PluginConfig{Callbacks: &Callbacks{}, Fuel: 100000})
+
+	err := i.CallFunction("count", nil, 10)
+	require.NoError(t, err)
+	small := i.FuelConsumed()
+
+	err = i.CallFunction("count", nil, 100)
+	require.NoError(t, err)
+	large := i.FuelConsumed() - small
+
+	require.Greater(t, large, small*5)
+}
+
+func TestMeteredCallReturnsErrOutOfFuel(t *testing.T) {
+	i := setupWatInstance(t, watCount, &PluginConfig{Callbacks: &Callbacks{}, Fuel: 1000})
+
+	err := i.CallFunction("count", nil, 1000000)
+	require.Equal(t, ErrOutOfFuel, err)
+	require.True(t, i.failed())
+	require.Equal(t, uint64(1000), i.FuelConsumed())
+
+	// the budget is per call so the next call succeeds
+	err = i.CallFunction("count", nil, 1)
+	require.NoError(t, err)
+}
+
+func TestMeteredInstanceReturnsErrOutOfFuelWhenInstanceBudgetUsed(t *testing.T) {
+	i := setupWatInstance(t, watCount, &PluginConfig{Callbacks: &Callbacks{}, InstanceFuel: 500})
+
+	var err error
+	for n := 0; n < 100 && err == nil; n++ {
+		err = i.CallFunction("count", nil, 5)
+	}
+
+	require.Equal(t, ErrOutOfFuel, err)
+	require.Equal(t, uint64(500), i.FuelConsumed())
+
+	err = i.CallFunction("count", nil, 0)
+	require.Equal(t, ErrOutOfFuel, err)
+}
+
+func TestUnmeteredInstanceReturnsZeroFuelConsumed(t *testing.T) {
+	i := setupWatInstance(t, watCount, nil)
+
+	err := i.CallFunction("count", nil, 10)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), i.FuelConsumed())
+}
+
+func TestMeteredGoModuleCallsFunctions(t *testing.T) {
+	i, _ := testSetupEngine(t, "../_test_fixtures/go/no_imports/module.wasm", &PluginConfig{Callbacks: &Callbacks{}, Fuel: 1000000})
+
+	var out string
+	err := i.CallFunction("string_func", &out, "Nic")
+	require.NoError(t, err)
+	require.Equal(t, "Hello Nic", out)
+	require.Greater(t, i.FuelConsumed(), uint64(0))
+}
+
+func TestMeteredCallFreesMemoryWhenOutOfFuel(t *testing.T) {
+	i := setupWatInstance(t, watAllocations, &PluginConfig{Callbacks: &Callbacks{}, Fuel: 1000})
+
+	for n := 0; n < 3; n++ {
+		err := i.CallFunction("spin", nil, "hello")
+		require.Equal(t, ErrOutOfFuel, err)
+		require.Equal(t, int32(0), allocated(t, i))
+	}
+
+	// freeing the memory does not use the fuel budget
+	require.Equal(t, uint64(3000), i.FuelConsumed())
+}
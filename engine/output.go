@@ -0,0 +1,161 @@
+package engine
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/nicholasjackson/wasp/engine/logger"
+)
+
+// outputMode is the destination for the stdout or stderr of a module instance
+type outputMode int
+
+const (
+	outputInherit outputMode = iota
+	outputWriter
+	outputLog
+	outputDiscard
+	outputBuffer
+)
+
+// Output defines where the stdout or stderr of a module instance is written, the zero
+// value writes to the stdout or stderr of the host process.
+type Output struct {
+	mode   outputMode
+	writer io.Writer
+}
+
+// OutputTo writes the output of all the instances of the plugin to w, writes from
+// different instances may be concurrent and w must be safe for concurrent use
+func OutputTo(w io.Writer) Output {
+	return Output{mode: outputWriter, writer: w}
+}
+
+// OutputToLog forwards each line of output to the engine logger, lines are tagged
+// with the name of the plugin and the ID of the instance. Stdout is logged at the
+// info level and stderr at the error level.
+func OutputToLog() Output {
+	return Output{mode: outputLog}
+}
+
+// OutputDiscard discards the output
+func OutputDiscard() Output {
+	return Output{mode: outputDiscard}
+}
+
+// OutputBuffer keeps the output in the instance, the output can be read using
+// Instance.Stdout and Instance.Stderr
+func OutputBuffer() Output {
+	return Output{mode: outputBuffer}
+}
+
+// captured returns true when the output is not written to the host process
+func (o Output) captured() bool {
+	return o.mode != outputInherit
+}
+
+// newWriter returns the writer for the output of an instance, stream is
+// either stdout or stderr
+func (o Output) newWriter(log *logger.Wrapper, plugin string, id uint64, stream string) io.Writer {
+	switch o.mode {
+	case outputWriter:
+		return o.writer
+	case outputLog:
+		logFunc := log.Info
+		if stream == "stderr" {
+			logFunc = log.Error
+		}
+
+		return &lineWriter{
+			log: func(line string) {
+				logFunc("Plugin output", "plugin", plugin, "instance", id, "stream", stream, "line", line)
+			},
+		}
+	case outputBuffer:
+		return &outputBuf{}
+	}
+
+	return io.Discard
+}
+
+// lineWriter calls log for each complete line written, the newline is
+// not included in the line
+type lineWriter struct {
+	mutex sync.Mutex
+	log   func(line string)
+	buf   []byte
+}
+
+// Write implements io.Writer
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.buf = append(l.buf, p...)
+
+	for {
+		n := bytes.IndexByte(l.buf, '\n')
+		if n < 0 {
+			break
+		}
+
+		l.log(string(bytes.TrimSuffix(l.buf[:n], []byte("\r"))))
+		l.buf = l.buf[n+1:]
+	}
+
+	return len(p), nil
+}
+
+// Flush logs any incomplete line
+func (l *lineWriter) Flush() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if len(l.buf) > 0 {
+		l.log(string(l.buf))
+		l.buf = nil
+	}
+}
+
+// outputBuf is a buffer that is safe to read while the module is writing
+type outputBuf struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+// Write implements io.Writer
+func (o *outputBuf) Write(p []byte) (int, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return o.buf.Write(p)
+}
+
+// Bytes returns a copy of the output
+func (o *outputBuf) Bytes() []byte {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return append([]byte{}, o.buf.Bytes()...)
+}
+
+// Stdout returns the output written to stdout by the module when the
+// PluginConfig uses OutputBuffer for Stdout, otherwise nil is returned
+func (i *wasmerInstance) Stdout() []byte {
+	if b, ok := i.stdout.(*outputBuf); ok {
+		return b.Bytes()
+	}
+
+	return nil
+}
+
+// Stderr returns the output written to stderr by the module when the
+// PluginConfig uses OutputBuffer for Stderr, otherwise nil is returned
+func (i *wasmerInstance) Stderr() []byte {
+	if b, ok := i.stderr.(*outputBuf); ok {
+		return b.Bytes()
+	}
+
+	return nil
+}
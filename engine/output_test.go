@@ -0,0 +1,147 @@
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/nicholasjackson/wasp/engine/logger"
+	"github.com/stretchr/testify/require"
+)
+
+// watOutput is a module that writes to stdout and stderr using WASI
+var watOutput = `
+(module
+	(import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+	(import "wasi_snapshot_preview1" "fd_write"
+		(func $fd_write (param i32 i32 i32 i32) (result i32)))
+	(memory (export "memory") 1)
+	(data (i32.const 0x100) "hello\nwor")
+	(data (i32.const 0x110) "ld\n")
+	(data (i32.const 0x120) "oops\n")
+	;; iovecs for stdout, two buffers
+	(data (i32.const 0x200) "\00\01\00\00\09\00\00\00\10\01\00\00\03\00\00\00")
+	;; iovec for stderr
+	(data (i32.const 0x210) "\20\01\00\00\05\00\00\00")
+
+	(func (export "print") (result i32)
+		(drop (call $fd_write (i32.const 1) (i32.const 0x200) (i32.const 2) (i32.const 0x300)))
+		(drop (call $fd_write (i32.const 2) (i32.const 0x210) (i32.const 1) (i32.const 0x300)))
+		(i32.load (i32.const 0x300))))
+`
+
+func TestOutputBufferCapturesStdoutAndStderr(t *testing.T) {
+	i := setupWatInstance(t, watOutput, &PluginConfig{Stdout: OutputBuffer(), Stderr: OutputBuffer()})
+
+	var written int32
+	err := i.CallFunction("print", &written)
+	require.NoError(t, err)
+	require.Equal(t, int32(5), written)
+
+	require.Equal(t, "hello\nworld\n", string(i.Stdout()))
+	require.Equal(t, "oops\n", string(i.Stderr()))
+}
+
+func TestOutputToWritesToWriter(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	i := setupWatInstance(t, watOutput, &PluginConfig{Stdout: OutputTo(stdout), Stderr: OutputDiscard()})
+
+	err := i.CallFunction("print", nil)
+	require.NoError(t, err)
+
+	require.Equal(t, "hello\nworld\n", stdout.String())
+	require.Nil(t, i.Stdout())
+	require.Nil(t, i.Stderr())
+}
+
+func TestOutputToLogForwardsLines(t *testing.T) {
+	info := []string{}
+	errors := []string{}
+
+	logFunc := func(lines *[]string) logger.LogFunc {
+		return func(message string, params ...interface{}) {
+			*lines = append(*lines, fmt.Sprint(params...))
+		}
+	}
+
+	e := New(logger.New(logFunc(&info), nil, logFunc(&errors), nil))
+	conf := &PluginConfig{Stdout: OutputToLog(), Stderr: OutputToLog()}
+
+	err := e.RegisterPluginBytes("test", watToWasm(t, watOutput), conf)
+	require.NoError(t, err)
+
+	i, err := e.GetInstance("test", "")
+	require.NoError(t, err)
+
+	err = i.CallFunction("print", nil)
+	require.NoError(t, err)
+
+	id := i.(*wasmerInstance).id
+	require.Equal(t, []string{
+		fmt.Sprint("plugin", "test", "instance", id, "stream", "stdout", "line", "hello"),
+		fmt.Sprint("plugin", "test", "instance", id, "stream", "stdout", "line", "world"),
+	}, info)
+	require.Equal(t, []string{
+		fmt.Sprint("plugin", "test", "instance", id, "stream", "stderr", "line", "oops"),
+	}, errors)
+}
+
+func TestRemoveFlushesIncompleteLine(t *testing.T) {
+	info := []string{}
+	logFunc := func(message string, params ...interface{}) {
+		info = append(info, fmt.Sprint(params...))
+	}
+
+	e := New(logger.New(logFunc, nil, nil, nil))
+	conf := &PluginConfig{Stdout: OutputToLog()}
+
+	err := e.RegisterPluginBytes("test", watToWasm(t, watOutput), conf)
+	require.NoError(t, err)
+
+	i, err := e.GetInstance("test", "")
+	require.NoError(t, err)
+
+	_, err = i.(*wasmerInstance).stdout.Write([]byte("partial"))
+	require.NoError(t, err)
+	require.Empty(t, info)
+
+	err = i.Remove()
+	require.NoError(t, err)
+
+	id := i.(*wasmerInstance).id
+	require.Equal(t, []string{
+		fmt.Sprint("plugin", "test", "instance", id, "stream", "stdout", "line", "partial"),
+	}, info)
+}
+
+func TestInstancesHaveSeparateOutput(t *testing.T) {
+	e := New(logger.New(nil, nil, nil, nil))
+
+	err := e.RegisterPluginBytes("test", watToWasm(t, watOutput), &PluginConfig{Stdout: OutputBuffer()})
+	require.NoError(t, err)
+
+	i1, err := e.GetInstance("test", "")
+	require.NoError(t, err)
+
+	i2, err := e.GetInstance("test", "")
+	require.NoError(t, err)
+
+	err = i1.CallFunction("print", nil)
+	require.NoError(t, err)
+
+	require.Equal(t, "hello\nworld\n", string(i1.Stdout()))
+	require.Empty(t, i2.Stdout())
+	require.NotEqual(t, i1.(*wasmerInstance).id, i2.(*wasmerInstance).id)
+}
+
+func TestLineWriterFlushesIncompleteLine(t *testing.T) {
+	lines := []string{}
+	lw := &lineWriter{log: func(line string) { lines = append(lines, line) }}
+
+	_, err := lw.Write([]byte("one\r\ntw"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"one"}, lines)
+
+	lw.Flush()
+	require.Equal(t, []string{"one", "tw"}, lines)
+}
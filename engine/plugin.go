@@ -1,19 +1,151 @@
 package engine
 
-import "github.com/wasmerio/wasmer-go/wasmer"
+import (
+	"io"
+	"time"
+
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
 
 type plugin struct {
 	module *wasmer.Module
 	config *PluginConfig
+
+	// size is the size of the Wasm module in bytes before instrumentation
+	size int
+	// registered is the time the plugin was registered or reloaded
+	registered time.Time
+	// imports are the imports declared by the module before instrumentation
+	imports []ExternInfo
+	// functionNames are the names of the functions from the name section, used
+	// for the frames in a TrapError
+	functionNames map[uint32]string
+	// offsets map the offsets in the instrumented functions to the offsets in the
+	// original module, used for the frames in a TrapError
+	offsets map[uint32]offsetMap
+
+	// path is the location of the Wasm module for plugins registered from a file
+	path string
+	// modTime and fileSize are the details of the file at path when it was loaded
+	modTime  time.Time
+	fileSize int64
 }
 
 // PluginConfig defines configuration for the plugin environment
 type PluginConfig struct {
 	// Environment variables that are available to the module instance
 	Environment map[string]string
-	// Volumes are globally writable volumes for the module instances
+	// InheritEnv is the allow list of host environment variables that are passed to the
+	// module instances, entries ending in * match any variable with the prefix i.e. AWS_*.
+	// Variables in Environment replace inherited variables with the same name.
+	InheritEnv []string
+	// Args are the command line arguments for the module instances, the name of the
+	// plugin is always passed as the first argument
+	Args []string
+	// Stdin is read by the module instances when reading from stdin, when nil stdin
+	// is empty. Stdin is shared by all instances, use InstanceOptions to give each
+	// instance its own input.
+	Stdin io.Reader
+	// Volumes are globally writable volumes for the module instances, the host directory
+	// is keyed by the guest path, i.e. /data. Volumes are mounted in the root of the module
+	// filesystem and the host directory must exist when the plugin is registered.
 	Volumes map[string]string
+	// ReadOnlyVolumes are mounted in the same way as Volumes, the module can not create,
+	// modify or remove files in a read only volume
+	ReadOnlyVolumes map[string]string
+
+	// Stdout and Stderr define where the output of the module instances is written,
+	// by default the output is written to the stdout and stderr of the host process
+	Stdout Output
+	Stderr Output
 
 	// Callbacks contains functions that can be imported by the plugin
 	Callbacks *Callbacks
+
+	// Codec is used to marshal structs passed to and returned from callbacks and
+	// structured arguments, defaults to JSONCodec
+	Codec Codec
+
+	// EncodeArguments enables structured arguments for CallFunction, any struct, map or
+	// slice other than []byte passed to CallFunction is marshalled using the Codec and
+	// passed as bytes. An outputParam that is a pointer to a struct, map or slice is
+	// unmarshalled from the bytes returned by the function.
+	EncodeArguments bool
+
+	// Fuel is the maximum number of instructions that a single function call can
+	// execute before it is stopped with ErrOutOfFuel, when 0 calls are not limited
+	Fuel uint64
+	// InstanceFuel is the maximum number of instructions that an instance can execute
+	// over all function calls, when 0 the instance is not limited
+	InstanceFuel uint64
+
+	// MaxMemoryPages is the maximum number of 64KiB pages of linear memory an instance
+	// can use, when 0 the memory is not limited
+	MaxMemoryPages uint32
+	// MaxMemoryBytes is the maximum size of the linear memory for an instance in bytes,
+	// the size is rounded down to a whole number of pages, when 0 the memory is not limited
+	MaxMemoryBytes uint64
+}
+
+// codec returns the Codec for the plugin, JSONCodec when one is not configured
+func (p *PluginConfig) codec() Codec {
+	if p.Codec == nil {
+		return JSONCodec{}
+	}
+
+	return p.Codec
+}
+
+// hasReadOnlyVolumes returns true when any of the volumes is read only
+func (p *PluginConfig) hasReadOnlyVolumes() bool {
+	return len(p.ReadOnlyVolumes) > 0
+}
+
+// volumes returns the read write and read only volumes keyed by the guest path
+func (p *PluginConfig) volumes() map[string]volume {
+	volumes := map[string]volume{}
+	for g, h := range p.Volumes {
+		volumes[g] = volume{hostPath: h}
+	}
+
+	for g, h := range p.ReadOnlyVolumes {
+		volumes[g] = volume{hostPath: h, readOnly: true}
+	}
+
+	return volumes
+}
+
+// capturesOutput returns true when the stdout or stderr of the instances is captured
+func (p *PluginConfig) capturesOutput() bool {
+	return p.Stdout.captured() || p.Stderr.captured()
+}
+
+// metered returns true when the plugin has a fuel budget, metering
+// is added to the module at registration only when it is required
+func (p *PluginConfig) metered() bool {
+	return p.Fuel > 0 || p.InstanceFuel > 0
+}
+
+// memoryLimit returns the maximum number of memory pages for an instance
+// derived from MaxMemoryPages and MaxMemoryBytes, 0 when memory is not limited
+func (p *PluginConfig) memoryLimit() uint32 {
+	limit := p.MaxMemoryPages
+
+	if p.MaxMemoryBytes > 0 {
+		pages := p.MaxMemoryBytes / uint64(wasmer.WasmPageSize)
+		if pages > wasmMaxPages {
+			pages = wasmMaxPages
+		}
+
+		// a limit of 0 pages would disable the limit so always allow the minimum of 1 page
+		if pages == 0 {
+			pages = 1
+		}
+
+		if limit == 0 || uint32(pages) < limit {
+			limit = uint32(pages)
+		}
+	}
+
+	return limit
 }
@@ -0,0 +1,27 @@
+package engine
+
+import (
+	"fmt"
+)
+
+// PluginError is returned by CallFunction when the plugin raises an error with
+// a code using raise_error_v2, i.e. abi.ErrorWithCode, the error can be found
+// with errors.As
+//
+//	pe := engine.PluginError{}
+//	if errors.As(err, &pe) {
+//		w.WriteHeader(pe.Code)
+//	}
+type PluginError struct {
+	// Code is an application defined code for the error
+	Code int `json:"code"`
+	// Message describes the error
+	Message string `json:"message"`
+	// Details contains optional metadata for the error
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// Error implements the error interface
+func (p PluginError) Error() string {
+	return fmt.Sprintf("plugin error %d: %s", p.Code, p.Message)
+}
@@ -0,0 +1,62 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+// watRaiseError is a module that raises errors using raise_error and raise_error_v2
+var watRaiseError = `
+(module
+	(import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+	(import "env" "raise_error" (func $raise_error (param i32)))
+	(import "env" "raise_error_v2" (func $raise_error_v2 (param i32)))
+	(memory (export "memory") 1)
+	(data (i32.const 16) "100%d done\00")
+	(data (i32.const 64) "\3a\00\00\00{\"code\":404,\"message\":\"not found\",\"details\":{\"key\":\"abc\"}}")
+	(data (i32.const 192) "\07\00\00\00invalid")
+	(func (export "deallocate") (param i32 i32))
+	(func (export "get_string_size") (param i32) (result i32)
+		(i32.const 10))
+	(func (export "raise") (result i32)
+		(call $raise_error (i32.const 16))
+		(i32.const 0))
+	(func (export "raise_code") (result i32)
+		(call $raise_error_v2 (i32.const 64))
+		(i32.const 0))
+	(func (export "raise_invalid") (result i32)
+		(call $raise_error_v2 (i32.const 192))
+		(i32.const 0)))
+`
+
+func TestRaiseErrorReturnsMessage(t *testing.T) {
+	i := setupWatInstance(t, watRaiseError, nil)
+
+	err := i.CallFunction("raise", nil)
+	require.Error(t, err)
+	require.Equal(t, "100%d done", err.Error())
+}
+
+func TestRaiseErrorV2ReturnsPluginError(t *testing.T) {
+	i := setupWatInstance(t, watRaiseError, nil)
+
+	err := i.CallFunction("raise_code", nil)
+
+	pe := PluginError{}
+	require.True(t, xerrors.As(err, &pe))
+	require.Equal(t, 404, pe.Code)
+	require.Equal(t, "not found", pe.Message)
+	require.Equal(t, map[string]string{"key": "abc"}, pe.Details)
+	require.Equal(t, "plugin error 404: not found", err.Error())
+}
+
+func TestRaiseErrorV2ReturnsErrorForInvalidPayload(t *testing.T) {
+	i := setupWatInstance(t, watRaiseError, nil)
+
+	err := i.CallFunction("raise_invalid", nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unable to decode error raised by plugin")
+	require.False(t, xerrors.As(err, &PluginError{}))
+}
@@ -0,0 +1,179 @@
+package engine
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+// PluginInfo contains the details of a registered plugin
+type PluginInfo struct {
+	// Name the plugin was registered with
+	Name string
+	// Path of the Wasm module, empty when the plugin was not registered from a file
+	Path string
+	// Compiler used to compile the Wasm module
+	Compiler Compiler
+	// Size of the Wasm module in bytes
+	Size int
+	// Registered is the time the plugin was registered or last reloaded
+	Registered time.Time
+
+	// Exports are the functions, globals, memories and tables exported by the module
+	Exports []ExternInfo
+	// Imports are the functions, globals, memories and tables imported by the module
+	Imports []ExternInfo
+}
+
+// ExternInfo describes an import or export of a Wasm module
+type ExternInfo struct {
+	// Module is the namespace of an import, empty for exports
+	Module string
+	// Name of the import or export
+	Name string
+	// Kind is one of func, global, memory or table
+	Kind string
+	// Signature is the Wasm type of a function or global i.e. "(i32, i32) -> (i32)",
+	// empty for memories and tables
+	Signature string
+}
+
+// Plugins returns the details of all the registered plugins ordered by name
+func (w *Wasm) Plugins() []PluginInfo {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+
+	pi := []PluginInfo{}
+	for name, p := range w.plugins {
+		pi = append(pi, w.pluginInfo(name, p))
+	}
+
+	sort.Slice(pi, func(a, b int) bool { return pi[a].Name < pi[b].Name })
+
+	return pi
+}
+
+// PluginInfo returns the details of the plugin with the given name,
+// a PluginNotFoundError is returned when the plugin is not registered
+func (w *Wasm) PluginInfo(name string) (*PluginInfo, error) {
+	p, ok := w.getPlugin(name)
+	if !ok {
+		return nil, PluginNotFoundError{name}
+	}
+
+	pi := w.pluginInfo(name, p)
+
+	return &pi, nil
+}
+
+func (w *Wasm) pluginInfo(name string, p *plugin) PluginInfo {
+	pi := PluginInfo{
+		Name:       name,
+		Path:       p.path,
+		Compiler:   w.compiler,
+		Size:       p.size,
+		Registered: p.registered,
+		Exports:    []ExternInfo{},
+		Imports:    []ExternInfo{},
+	}
+
+	for _, e := range p.module.Exports() {
+		// hide the exports added by the engine when instrumenting the module
+		if isInstrumentation(e.Name()) {
+			continue
+		}
+
+		pi.Exports = append(pi.Exports, externInfo("", e.Name(), e.Type()))
+	}
+
+	// the imports are read from the module before it was instrumented as the
+	// instrumentation can change the signature of imported functions
+	pi.Imports = append(pi.Imports, p.imports...)
+
+	return pi
+}
+
+// importInfo returns the details of the imports declared by the Wasm module
+func importInfo(wasm []byte) ([]ExternInfo, error) {
+	m, err := parseWasmModule(wasm)
+	if err != nil {
+		return nil, err
+	}
+
+	imports, err := m.imports()
+	if err != nil {
+		return nil, err
+	}
+
+	types, err := m.types()
+	if err != nil {
+		return nil, err
+	}
+
+	info := []ExternInfo{}
+	for _, e := range imports.entries {
+		ei := ExternInfo{Module: e.module, Name: e.name}
+
+		switch e.kind {
+		case externFunction:
+			ei.Kind = wasmer.FUNCTION.String()
+			if int(e.typeIndex) < len(types) {
+				ft := types[e.typeIndex]
+				ei.Signature = "(" + valueTypeNames(ft.params) + ") -> (" + valueTypeNames(ft.results) + ")"
+			}
+		case externTable:
+			ei.Kind = wasmer.TABLE.String()
+		case externMemory:
+			ei.Kind = wasmer.MEMORY.String()
+		case externGlobal:
+			ei.Kind = wasmer.GLOBAL.String()
+			ei.Signature = valueTypeName(e.valueType)
+			if e.mutable {
+				ei.Signature = "mut " + ei.Signature
+			}
+		}
+
+		info = append(info, ei)
+	}
+
+	return info, nil
+}
+
+// valueTypeNames returns a comma separated list of the encoded types
+func valueTypeNames(types []byte) string {
+	s := []string{}
+	for _, t := range types {
+		s = append(s, valueTypeName(t))
+	}
+
+	return strings.Join(s, ", ")
+}
+
+func externInfo(module, name string, et *wasmer.ExternType) ExternInfo {
+	ei := ExternInfo{
+		Module: module,
+		Name:   name,
+		Kind:   et.Kind().String(),
+	}
+
+	switch et.Kind() {
+	case wasmer.FUNCTION:
+		ft := et.IntoFunctionType()
+		ei.Signature = "(" + valueTypes(ft.Params()) + ") -> (" + valueTypes(ft.Results()) + ")"
+	case wasmer.GLOBAL:
+		gt := et.IntoGlobalType()
+		ei.Signature = gt.ValueType().Kind().String()
+		if gt.Mutability() == wasmer.MUTABLE {
+			ei.Signature = "mut " + ei.Signature
+		}
+	}
+
+	return ei
+}
+
+// valueTypes returns a comma separated list of the types
+func valueTypes(types []*wasmer.ValueType) string {
+	return strings.Join(kindNames(types), ", ")
+}
@@ -0,0 +1,106 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+func TestPluginInfoReturnsDetails(t *testing.T) {
+	wasm := watToWasm(t, watVersion(1))
+
+	e := New(nil)
+	err := e.RegisterPluginBytes("test", wasm, nil)
+	require.NoError(t, err)
+
+	pi, err := e.PluginInfo("test")
+	require.NoError(t, err)
+
+	require.Equal(t, "test", pi.Name)
+	require.Equal(t, "", pi.Path)
+	require.Equal(t, CompilerSinglepass, pi.Compiler)
+	require.Equal(t, len(wasm), pi.Size)
+	require.False(t, pi.Registered.IsZero())
+
+	require.ElementsMatch(t, []ExternInfo{
+		{Name: "memory", Kind: "memory"},
+		{Name: "version", Kind: "func", Signature: "() -> (i32)"},
+	}, pi.Exports)
+
+	require.Equal(t, []ExternInfo{
+		{Module: "wasi_snapshot_preview1", Name: "proc_exit", Kind: "func", Signature: "(i32) -> ()"},
+	}, pi.Imports)
+}
+
+func TestPluginInfoReturnsPathForFilePlugins(t *testing.T) {
+	e, path := setupReloadTests(t)
+
+	pi, err := e.PluginInfo("test")
+	require.NoError(t, err)
+	require.Equal(t, path, pi.Path)
+}
+
+func TestPluginInfoReturnsErrorWhenNotFound(t *testing.T) {
+	e := New(nil)
+
+	_, err := e.PluginInfo("test")
+	require.True(t, xerrors.As(err, &PluginNotFoundError{}))
+}
+
+func TestPluginsReturnsAllPluginsOrderedByName(t *testing.T) {
+	wasm := watToWasm(t, watVersion(1))
+
+	e := New(nil)
+	require.NoError(t, e.RegisterPluginBytes("b", wasm, nil))
+	require.NoError(t, e.RegisterPluginBytes("a", wasm, nil))
+
+	pi := e.Plugins()
+	require.Len(t, pi, 2)
+	require.Equal(t, "a", pi[0].Name)
+	require.Equal(t, "b", pi[1].Name)
+}
+
+func TestUnregisterPluginRemovesPlugin(t *testing.T) {
+	e := New(nil)
+	err := e.RegisterPluginBytes("test", watToWasm(t, watVersion(1)), nil)
+	require.NoError(t, err)
+
+	i, err := e.GetInstance("test", "")
+	require.NoError(t, err)
+
+	err = e.UnregisterPlugin("test")
+	require.NoError(t, err)
+	require.Empty(t, e.Plugins())
+
+	_, err = e.GetInstance("test", "")
+	require.True(t, xerrors.As(err, &PluginNotFoundError{}))
+
+	// existing instances can still be used
+	require.Equal(t, int32(1), callVersion(t, i))
+}
+
+func TestUnregisterPluginReturnsErrorWhenNotFound(t *testing.T) {
+	e := New(nil)
+
+	err := e.UnregisterPlugin("test")
+	require.True(t, xerrors.As(err, &PluginNotFoundError{}))
+}
+
+func TestPluginInfoReturnsImportSignaturesBeforeInstrumentation(t *testing.T) {
+	cb := &Callbacks{}
+	cb.AddCallback("env", "scale", func(in float64) float64 { return in })
+
+	e := New(nil)
+	err := e.RegisterPluginBytes("test", watToWasm(t, watNumeric), &PluginConfig{Callbacks: cb})
+	require.NoError(t, err)
+
+	pi, err := e.PluginInfo("test")
+	require.NoError(t, err)
+
+	require.Contains(t, pi.Imports, ExternInfo{Module: "env", Name: "scale", Kind: "func", Signature: "(f64) -> (f64)"})
+
+	for _, ex := range pi.Exports {
+		require.False(t, isInstrumentation(ex.Name))
+	}
+}
@@ -0,0 +1,350 @@
+package engine
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// ErrPoolExhausted is returned by Pool.Get when the pool is configured to fail fast
+// and all instances are currently checked out
+var ErrPoolExhausted = xerrors.New("all instances in the pool are in use")
+
+// ErrPoolClosed is returned by Pool.Get when the pool has been closed
+var ErrPoolClosed = xerrors.New("pool has been closed")
+
+// PoolOptions defines the configuration for an instance pool
+type PoolOptions struct {
+	// Min is the number of instances that are created when the pool is created
+	// and that are kept warm regardless of the IdleTimeout, instances that are
+	// discarded are replaced so that the pool contains at least Min instances
+	Min int
+	// Max is the maximum number of instances that can be checked out from the pool
+	// at any one time, if Max is 0 the pool is unbounded
+	Max int
+	// IdleTimeout is the duration after which instances above Min that have not
+	// been used are removed from the pool, if 0 idle instances are never removed.
+	// Idle instances are checked by Get and Put and in the background every IdleTimeout.
+	IdleTimeout time.Duration
+	// FailFast causes Get to return ErrPoolExhausted rather than blocking when
+	// Max instances are checked out
+	FailFast bool
+}
+
+// Pool manages a collection of pre-warmed instances for a plugin, instances
+// are checked out using Get and must be returned using Put once the caller
+// has finished with them.
+type Pool struct {
+	engine  *Wasm
+	name    string
+	options PoolOptions
+
+	// tokens limits the number of instances that can be checked out when
+	// Max is set, a token is taken on Get and returned on Put
+	tokens chan struct{}
+
+	mutex  sync.Mutex
+	idle   []pooledInstance
+	closed bool
+
+	// checkedOut are the instances that have been returned by Get and not yet
+	// returned with Put, only these instances can be put back into the pool
+	checkedOut map[Instance]bool
+
+	// done is closed when the pool is closed to stop the reaper, reaperDone is
+	// closed once the reaper has stopped
+	done       chan struct{}
+	reaperDone chan struct{}
+}
+
+type pooledInstance struct {
+	instance Instance
+	lastUsed time.Time
+}
+
+/*
+	NewPool creates a pool of instances for the plugin registered with the given name,
+	Min instances are created immediately so that they are ready for use.
+
+	Parameters:
+		name: The name of the plugin to create instances for
+		options: The configuration for the pool
+*/
+func (w *Wasm) NewPool(name string, options PoolOptions) (*Pool, error) {
+	if options.Max > 0 && options.Min > options.Max {
+		return nil, xerrors.Errorf("pool minimum %d is greater than the maximum %d", options.Min, options.Max)
+	}
+
+	p := &Pool{
+		engine:     w,
+		name:       name,
+		options:    options,
+		checkedOut: map[Instance]bool{},
+		done:       make(chan struct{}),
+	}
+
+	if options.Max > 0 {
+		p.tokens = make(chan struct{}, options.Max)
+	}
+
+	// pre-warm the pool
+	for n := 0; n < options.Min; n++ {
+		inst, err := w.GetInstance(name, "")
+		if err != nil {
+			p.Close()
+			return nil, xerrors.Errorf("unable to create instance for pool: %w", err)
+		}
+
+		p.idle = append(p.idle, pooledInstance{instance: inst, lastUsed: time.Now()})
+	}
+
+	if options.IdleTimeout > 0 {
+		p.reaperDone = make(chan struct{})
+		go p.reaper()
+	}
+
+	return p, nil
+}
+
+// Get checks out an instance from the pool, if there are no idle instances
+// a new instance is created. When Max instances are checked out Get blocks
+// until an instance is returned or the context is done, unless the pool is
+// configured with FailFast.
+func (p *Pool) Get(ctx context.Context) (Instance, error) {
+	if p.tokens != nil {
+		if p.options.FailFast {
+			select {
+			case p.tokens <- struct{}{}:
+			default:
+				return nil, ErrPoolExhausted
+			}
+		} else {
+			select {
+			case p.tokens <- struct{}{}:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		p.release()
+		return nil, ErrPoolClosed
+	}
+
+	expired := append(p.reapIdle(), p.reapStale()...)
+
+	// take the most recently used instance, this allows the older instances
+	// to expire when the pool is not under load
+	if len(p.idle) > 0 {
+		pi := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.checkedOut[pi.instance] = true
+		p.mutex.Unlock()
+
+		removeInstances(expired)
+		p.fill()
+
+		return pi.instance, nil
+	}
+	p.mutex.Unlock()
+
+	removeInstances(expired)
+
+	inst, err := p.engine.GetInstance(p.name, "")
+	if err != nil {
+		p.release()
+		return nil, xerrors.Errorf("unable to create instance for pool: %w", err)
+	}
+
+	p.mutex.Lock()
+	p.checkedOut[inst] = true
+	p.mutex.Unlock()
+
+	return inst, nil
+}
+
+// Put returns an instance to the pool, instances where the last call trapped,
+// was interrupted or a callback returned an error, or that were created from a
+// version of the plugin that has since been reloaded, are removed rather than
+// being returned to the pool and replaced when the pool is below Min.
+// Instances that are not checked out from the pool, including instances that have
+// already been returned, are ignored.
+func (p *Pool) Put(inst Instance) {
+	if inst == nil {
+		return
+	}
+
+	p.mutex.Lock()
+	if !p.checkedOut[inst] {
+		p.mutex.Unlock()
+		p.engine.log.Error("Ignoring instance that is not checked out from the pool", "plugin", p.name)
+		return
+	}
+
+	delete(p.checkedOut, inst)
+	defer p.release()
+
+	if p.closed || inst.failed() || p.stale(inst) {
+		p.mutex.Unlock()
+		p.engine.log.Debug("Discarding pool instance", "plugin", p.name, "failed", inst.failed())
+		inst.Remove()
+		p.fill()
+		return
+	}
+
+	p.idle = append(p.idle, pooledInstance{instance: inst, lastUsed: time.Now()})
+	expired := p.reapIdle()
+	p.mutex.Unlock()
+
+	removeInstances(expired)
+}
+
+// Close removes all the idle instances in the pool, instances that are checked
+// out are removed when they are returned with Put.
+func (p *Pool) Close() {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return
+	}
+
+	p.closed = true
+	close(p.done)
+
+	idle := p.idle
+	p.idle = nil
+	p.mutex.Unlock()
+
+	if p.reaperDone != nil {
+		<-p.reaperDone
+	}
+
+	for _, pi := range idle {
+		pi.instance.Remove()
+	}
+}
+
+// reaper removes idle and stale instances every IdleTimeout so that instances
+// are removed when the pool is not being used, it stops when the pool is closed
+func (p *Pool) reaper() {
+	defer close(p.reaperDone)
+
+	t := time.NewTicker(p.options.IdleTimeout)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-t.C:
+		}
+
+		p.mutex.Lock()
+		if p.closed {
+			p.mutex.Unlock()
+			return
+		}
+
+		expired := append(p.reapIdle(), p.reapStale()...)
+		p.mutex.Unlock()
+
+		removeInstances(expired)
+		p.fill()
+	}
+}
+
+// fill creates instances until the pool contains at least Min instances, including
+// the instances that are checked out, the pools mutex must not be held
+func (p *Pool) fill() {
+	for {
+		p.mutex.Lock()
+		if p.closed || len(p.idle)+len(p.checkedOut) >= p.options.Min {
+			p.mutex.Unlock()
+			return
+		}
+		p.mutex.Unlock()
+
+		inst, err := p.engine.GetInstance(p.name, "")
+		if err != nil {
+			p.engine.log.Error("Unable to create instance for pool", "plugin", p.name, "error", err)
+			return
+		}
+
+		p.mutex.Lock()
+		if p.closed {
+			p.mutex.Unlock()
+			inst.Remove()
+			return
+		}
+
+		p.idle = append(p.idle, pooledInstance{instance: inst, lastUsed: time.Now()})
+		p.mutex.Unlock()
+	}
+}
+
+// release returns a token to the pool allowing another instance to be checked out
+func (p *Pool) release() {
+	if p.tokens != nil {
+		<-p.tokens
+	}
+}
+
+// reapIdle takes any instances above the pool minimum that have not been used
+// within the IdleTimeout out of the pool and returns them so that they can be
+// removed once the pools mutex, which must be held when calling reapIdle, is released
+func (p *Pool) reapIdle() []Instance {
+	if p.options.IdleTimeout == 0 {
+		return nil
+	}
+
+	// idle is ordered by last use, the oldest instances are at the start
+	expired := []Instance{}
+	for len(expired) < len(p.idle)-p.options.Min &&
+		time.Since(p.idle[len(expired)].lastUsed) > p.options.IdleTimeout {
+
+		expired = append(expired, p.idle[len(expired)].instance)
+	}
+
+	p.idle = p.idle[len(expired):]
+
+	return expired
+}
+
+// stale returns true when the instance was not created from the currently
+// registered version of the plugin
+func (p *Pool) stale(inst Instance) bool {
+	current, ok := p.engine.getPlugin(p.name)
+	return !ok || inst.getPlugin() != current
+}
+
+// reapStale takes any idle instances that were created from a previous version of
+// the plugin out of the pool and returns them in the same way as reapIdle
+func (p *Pool) reapStale() []Instance {
+	stale := []Instance{}
+	current := p.idle[:0]
+	for _, pi := range p.idle {
+		if p.stale(pi.instance) {
+			stale = append(stale, pi.instance)
+			continue
+		}
+
+		current = append(current, pi)
+	}
+
+	p.idle = current
+
+	return stale
+}
+
+// removeInstances removes the instances taken out of the pool, removing an instance
+// waits for any call in progress so the pools mutex must not be held
+func removeInstances(instances []Instance) {
+	for _, inst := range instances {
+		inst.Remove()
+	}
+}
@@ -0,0 +1,303 @@
+package engine
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nicholasjackson/wasp/engine/logger"
+	"github.com/stretchr/testify/require"
+)
+
+// watPool is a module with a function that can be called and a function that traps
+var watPool = `
+(module
+	(import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+	(memory (export "memory") 1)
+	(func (export "add") (param i32 i32) (result i32)
+		(i32.add (local.get 0) (local.get 1)))
+	(func (export "unreachable")
+		unreachable))
+`
+
+func setupPoolTests(t *testing.T, opts PoolOptions) *Pool {
+	e := New(logger.New(nil, nil, nil, nil))
+
+	err := e.RegisterPlugin("test", "../_test_fixtures/go/no_imports/module.wasm", nil)
+	require.NoError(t, err)
+
+	p, err := e.NewPool("test", opts)
+	require.NoError(t, err)
+
+	t.Cleanup(p.Close)
+
+	return p
+}
+
+func setupWatPool(t *testing.T, opts PoolOptions) *Pool {
+	e := New(logger.New(nil, nil, nil, nil))
+
+	err := e.RegisterPluginBytes("test", watToWasm(t, watPool), nil)
+	require.NoError(t, err)
+
+	p, err := e.NewPool("test", opts)
+	require.NoError(t, err)
+
+	t.Cleanup(p.Close)
+
+	return p
+}
+
+// idleInstances returns the idle instances, the reaper may change the instances
+// in the background so the pools mutex is held
+func idleInstances(p *Pool) []pooledInstance {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return append([]pooledInstance{}, p.idle...)
+}
+
+func TestNewPoolPrewarmsMinInstances(t *testing.T) {
+	p := setupPoolTests(t, PoolOptions{Min: 2, Max: 4})
+
+	require.Len(t, p.idle, 2)
+}
+
+func TestNewPoolReturnsErrorWhenMinGreaterThanMax(t *testing.T) {
+	e := New(nil)
+
+	_, err := e.NewPool("test", PoolOptions{Min: 2, Max: 1})
+	require.Error(t, err)
+}
+
+func TestPoolGetReturnsInstanceThatCanBeCalled(t *testing.T) {
+	p := setupPoolTests(t, PoolOptions{Min: 1, Max: 1})
+
+	i, err := p.Get(context.Background())
+	require.NoError(t, err)
+	defer p.Put(i)
+
+	var out int32
+	err = i.CallFunction("int_func", &out, 3, 2)
+	require.NoError(t, err)
+	require.Equal(t, int32(5), out)
+}
+
+func TestPoolPutReturnsInstanceForReuse(t *testing.T) {
+	p := setupPoolTests(t, PoolOptions{Max: 1})
+
+	i, err := p.Get(context.Background())
+	require.NoError(t, err)
+	p.Put(i)
+
+	i2, err := p.Get(context.Background())
+	require.NoError(t, err)
+	defer p.Put(i2)
+
+	require.Same(t, i, i2)
+}
+
+func TestPoolPutDiscardsFailedInstances(t *testing.T) {
+	p := setupWatPool(t, PoolOptions{Max: 1})
+
+	i, err := p.Get(context.Background())
+	require.NoError(t, err)
+
+	err = i.CallFunction("unreachable", nil)
+	require.ErrorAs(t, err, &TrapError{})
+
+	p.Put(i)
+	require.Len(t, p.idle, 0)
+
+	i2, err := p.Get(context.Background())
+	require.NoError(t, err)
+	defer p.Put(i2)
+
+	require.NotSame(t, i, i2)
+}
+
+func TestPoolPutKeepsInstancesWhenCallIsRejected(t *testing.T) {
+	p := setupWatPool(t, PoolOptions{Max: 1})
+
+	i, err := p.Get(context.Background())
+	require.NoError(t, err)
+
+	var out int32
+	err = i.CallFunction("add", &out, 1.5, 2)
+	requireSignatureMismatch(t, err)
+
+	err = i.CallFunction("not_exist", nil)
+	require.Error(t, err)
+
+	p.Put(i)
+	require.Len(t, p.idle, 1)
+
+	i2, err := p.Get(context.Background())
+	require.NoError(t, err)
+	defer p.Put(i2)
+
+	require.Same(t, i, i2)
+}
+
+func TestPoolReplacesDiscardedInstancesUpToMin(t *testing.T) {
+	p := setupWatPool(t, PoolOptions{Min: 1, Max: 2})
+
+	i, err := p.Get(context.Background())
+	require.NoError(t, err)
+
+	err = i.CallFunction("unreachable", nil)
+	require.Error(t, err)
+
+	p.Put(i)
+	require.Len(t, p.idle, 1)
+	require.NotSame(t, i, p.idle[0].instance)
+}
+
+func TestPoolGetFailsFastWhenExhausted(t *testing.T) {
+	p := setupPoolTests(t, PoolOptions{Max: 1, FailFast: true})
+
+	i, err := p.Get(context.Background())
+	require.NoError(t, err)
+	defer p.Put(i)
+
+	_, err = p.Get(context.Background())
+	require.Equal(t, ErrPoolExhausted, err)
+}
+
+func TestPoolGetBlocksUntilContextDoneWhenExhausted(t *testing.T) {
+	p := setupPoolTests(t, PoolOptions{Max: 1})
+
+	i, err := p.Get(context.Background())
+	require.NoError(t, err)
+	defer p.Put(i)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err = p.Get(ctx)
+	require.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestPoolGetUnblocksWhenInstanceReturned(t *testing.T) {
+	p := setupPoolTests(t, PoolOptions{Max: 1})
+
+	i, err := p.Get(context.Background())
+	require.NoError(t, err)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		p.Put(i)
+	}()
+
+	i2, err := p.Get(context.Background())
+	require.NoError(t, err)
+	defer p.Put(i2)
+
+	require.Same(t, i, i2)
+}
+
+func TestPoolRemovesIdleInstancesAboveMin(t *testing.T) {
+	p := setupPoolTests(t, PoolOptions{Min: 1, Max: 2, IdleTimeout: 50 * time.Millisecond})
+
+	i1, err := p.Get(context.Background())
+	require.NoError(t, err)
+	i2, err := p.Get(context.Background())
+	require.NoError(t, err)
+
+	p.Put(i1)
+	p.Put(i2)
+	require.Len(t, idleInstances(p), 2)
+
+	time.Sleep(60 * time.Millisecond)
+
+	i3, err := p.Get(context.Background())
+	require.NoError(t, err)
+	defer p.Put(i3)
+
+	require.Len(t, idleInstances(p), 0)
+	require.Same(t, i2, i3)
+}
+
+func TestPoolRemovesIdleInstancesInBackground(t *testing.T) {
+	p := setupPoolTests(t, PoolOptions{Min: 1, Max: 2, IdleTimeout: 10 * time.Millisecond})
+
+	i1, err := p.Get(context.Background())
+	require.NoError(t, err)
+	i2, err := p.Get(context.Background())
+	require.NoError(t, err)
+
+	p.Put(i1)
+	p.Put(i2)
+
+	// the pool is not used again, the reaper removes the instance above Min
+	require.Eventually(t, func() bool {
+		idle := idleInstances(p)
+		return len(idle) == 1 && idle[0].instance == i2
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestPoolCloseStopsReaper(t *testing.T) {
+	p := setupPoolTests(t, PoolOptions{IdleTimeout: time.Millisecond})
+	p.Close()
+
+	select {
+	case <-p.reaperDone:
+	default:
+		t.Fatal("reaper is still running after the pool was closed")
+	}
+
+	// closing the pool again does nothing
+	p.Close()
+}
+
+func TestPoolGetReturnsErrorWhenClosed(t *testing.T) {
+	p := setupPoolTests(t, PoolOptions{Max: 1})
+	p.Close()
+
+	_, err := p.Get(context.Background())
+	require.Equal(t, ErrPoolClosed, err)
+}
+
+func TestPoolPutIgnoresInstanceReturnedTwice(t *testing.T) {
+	p := setupPoolTests(t, PoolOptions{Max: 1})
+
+	i, err := p.Get(context.Background())
+	require.NoError(t, err)
+
+	p.Put(i)
+	p.Put(i)
+	require.Len(t, p.idle, 1)
+
+	// the token was only released once so the instance can only be checked out once
+	i2, err := p.Get(context.Background())
+	require.NoError(t, err)
+	defer p.Put(i2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err = p.Get(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestPoolPutIgnoresInstanceNotFromPool(t *testing.T) {
+	p := setupPoolTests(t, PoolOptions{Max: 1})
+
+	i, err := p.engine.GetInstance("test", "")
+	require.NoError(t, err)
+	defer i.Remove()
+
+	done := make(chan struct{})
+	go func() {
+		p.Put(i)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Put blocked for an instance that was not checked out from the pool")
+	}
+
+	require.Empty(t, p.idle)
+}
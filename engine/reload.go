@@ -0,0 +1,177 @@
+package engine
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// defaultWatchInterval is used by WatchPlugins when the interval is not positive
+const defaultWatchInterval = time.Second
+
+// ErrPluginChanged is returned by ReloadPlugin when the plugin is unregistered or
+// registered again while it is being reloaded, the new version is discarded
+var ErrPluginChanged = xerrors.New("plugin was changed while it was being reloaded")
+
+// ReloadPlugin recompiles the plugin from the file it was registered with and
+// replaces the registered version of the plugin. The new version is compiled and
+// its imports are validated using the existing PluginConfig, if this fails an error
+// is returned and the existing version of the plugin remains registered.
+//
+// Instances created before the reload continue to use the previous version of the
+// plugin until they are removed, calls to GetInstance after the reload return
+// instances of the new version. Pools discard instances of the previous version
+// when they are returned.
+//
+// Only plugins registered with RegisterPlugin can be reloaded.
+func (w *Wasm) ReloadPlugin(name string) error {
+	old, ok := w.getPlugin(name)
+	if !ok {
+		return PluginNotFoundError{name}
+	}
+
+	if old.path == "" {
+		return xerrors.Errorf("plugin %s was not registered from a file and can not be reloaded", name)
+	}
+
+	p, err := w.newPluginFromFile(old.path, old.config)
+	if err != nil {
+		return xerrors.Errorf("unable to reload plugin %s: %w", name, err)
+	}
+
+	if !w.swapPlugin(name, old, p) {
+		return xerrors.Errorf("unable to reload plugin %s: %w", name, ErrPluginChanged)
+	}
+
+	w.log.Info("Reloaded plugin", "name", name, "path", p.path)
+
+	return nil
+}
+
+// WatchPlugins checks the files for all plugins registered with RegisterPlugin
+// every interval, when the modification time or size of a file changes the
+// plugin is reloaded with ReloadPlugin. Reloads that fail are logged and the
+// previous version of the plugin continues to be used.
+//
+// The returned function stops watching the plugins. When interval is not positive
+// the files are checked every second.
+func (w *Wasm) WatchPlugins(interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		interval = defaultWatchInterval
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				w.reloadChanged()
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// reloadChanged reloads any plugins where the file has changed since
+// the plugin was loaded
+func (w *Wasm) reloadChanged() {
+	w.mutex.RLock()
+	changed := map[string]os.FileInfo{}
+	for name, p := range w.plugins {
+		if p.path == "" {
+			continue
+		}
+
+		fi, err := os.Stat(p.path)
+		if err != nil {
+			continue
+		}
+
+		if !fi.ModTime().Equal(p.modTime) || fi.Size() != p.fileSize {
+			changed[name] = fi
+		}
+	}
+	w.mutex.RUnlock()
+
+	for name, fi := range changed {
+		err := w.ReloadPlugin(name)
+		if err != nil {
+			w.log.Error("Unable to reload plugin", "name", name, "error", err)
+
+			// do not try to reload the same file again until it changes, the details
+			// from before the reload are used so that a change made while the plugin
+			// was being compiled is picked up
+			w.updateFileInfo(name, fi)
+		}
+	}
+}
+
+// swapPlugin replaces the plugin with new when the registered plugin is still old,
+// false is returned when the plugin has been unregistered or replaced
+func (w *Wasm) swapPlugin(name string, old, new *plugin) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.plugins[name] != old {
+		return false
+	}
+
+	w.plugins[name] = new
+
+	return true
+}
+
+// updateFileInfo sets the file details for the registered plugin to fi
+func (w *Wasm) updateFileInfo(name string, fi os.FileInfo) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	p, ok := w.plugins[name]
+	if !ok {
+		return
+	}
+
+	p.modTime = fi.ModTime()
+	p.fileSize = fi.Size()
+}
+
+// newPluginFromFile creates a plugin from the Wasm module at path
+func (w *Wasm) newPluginFromFile(path string, pluginConfig *PluginConfig) (*plugin, error) {
+	// stat the file before reading it so that any change made while the
+	// file is being read is picked up by the watcher
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, xerrors.Errorf("unable to load WASM module: %w", err)
+	}
+
+	wasmBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, xerrors.Errorf("unable to load WASM module: %w", err)
+	}
+
+	p, err := w.newPlugin(wasmBytes, pluginConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	p.path = path
+	p.modTime = fi.ModTime()
+	p.fileSize = fi.Size()
+
+	return p, nil
+}
@@ -0,0 +1,215 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nicholasjackson/wasp/engine/logger"
+	"github.com/stretchr/testify/require"
+)
+
+// watVersion returns a module where the version function returns v
+func watVersion(v int) string {
+	return fmt.Sprintf(`
+(module
+	(import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+	(memory (export "memory") 1)
+	(func (export "version") (result i32)
+		(i32.const %d)))
+`, v)
+}
+
+func setupReloadTests(t *testing.T) (*Wasm, string) {
+	path := filepath.Join(t.TempDir(), "module.wasm")
+	writeVersion(t, path, 1)
+
+	e := New(logger.New(nil, nil, nil, nil))
+	err := e.RegisterPlugin("test", path, nil)
+	require.NoError(t, err)
+
+	return e, path
+}
+
+func writeVersion(t *testing.T, path string, v int) {
+	err := ioutil.WriteFile(path, watToWasm(t, watVersion(v)), 0644)
+	require.NoError(t, err)
+}
+
+func callVersion(t *testing.T, i Instance) int32 {
+	var out int32
+	err := i.CallFunction("version", &out)
+	require.NoError(t, err)
+
+	return out
+}
+
+func TestReloadPluginReplacesPlugin(t *testing.T) {
+	e, path := setupReloadTests(t)
+
+	old, err := e.GetInstance("test", "")
+	require.NoError(t, err)
+
+	writeVersion(t, path, 2)
+	err = e.ReloadPlugin("test")
+	require.NoError(t, err)
+
+	i, err := e.GetInstance("test", "")
+	require.NoError(t, err)
+	require.Equal(t, int32(2), callVersion(t, i))
+
+	// existing instances continue to use the old version
+	require.Equal(t, int32(1), callVersion(t, old))
+}
+
+func TestReloadPluginKeepsOldVersionWhenReloadFails(t *testing.T) {
+	e, path := setupReloadTests(t)
+
+	i := `
+(module
+	(import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+	(import "env" "missing" (func))
+	(memory (export "memory") 1))
+`
+	err := ioutil.WriteFile(path, watToWasm(t, i), 0644)
+	require.NoError(t, err)
+
+	err = e.ReloadPlugin("test")
+	require.Error(t, err)
+
+	inst, err := e.GetInstance("test", "")
+	require.NoError(t, err)
+	require.Equal(t, int32(1), callVersion(t, inst))
+}
+
+func TestReloadPluginReturnsErrorWhenNotRegisteredFromFile(t *testing.T) {
+	e := New(nil)
+	err := e.RegisterPluginBytes("test", watToWasm(t, watVersion(1)), nil)
+	require.NoError(t, err)
+
+	err = e.ReloadPlugin("test")
+	require.Error(t, err)
+}
+
+func TestReloadPluginReturnsErrorWhenNotFound(t *testing.T) {
+	e := New(nil)
+
+	err := e.ReloadPlugin("test")
+	require.Error(t, err)
+}
+
+func TestWatchPluginsReloadsChangedPlugins(t *testing.T) {
+	e, path := setupReloadTests(t)
+
+	stop := e.WatchPlugins(10 * time.Millisecond)
+	defer stop()
+
+	// the larger version changes the size of the file as well as the contents so the
+	// change is detected on file systems with a coarse modification time
+	writeVersion(t, path, 1000)
+
+	require.Eventually(t, func() bool {
+		i, err := e.GetInstance("test", "")
+		if err != nil {
+			return false
+		}
+
+		var out int32
+		err = i.CallFunction("version", &out)
+		return err == nil && out == 1000
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestReloadPluginDoesNotReplaceChangedPlugin(t *testing.T) {
+	e, path := setupReloadTests(t)
+
+	old, ok := e.getPlugin("test")
+	require.True(t, ok)
+
+	p, err := e.newPluginFromFile(path, old.config)
+	require.NoError(t, err)
+
+	// a plugin unregistered during the reload is not registered again
+	err = e.UnregisterPlugin("test")
+	require.NoError(t, err)
+	require.False(t, e.swapPlugin("test", old, p))
+
+	_, ok = e.getPlugin("test")
+	require.False(t, ok)
+
+	// a plugin registered with the same name during the reload is not replaced
+	err = e.RegisterPlugin("test", path, nil)
+	require.NoError(t, err)
+
+	current, _ := e.getPlugin("test")
+	require.False(t, e.swapPlugin("test", old, p))
+
+	registered, _ := e.getPlugin("test")
+	require.Same(t, current, registered)
+}
+
+func TestReloadChangedRecordsFileDetailsFromBeforeFailedReload(t *testing.T) {
+	e, path := setupReloadTests(t)
+
+	err := ioutil.WriteFile(path, []byte("not wasm"), 0644)
+	require.NoError(t, err)
+
+	e.reloadChanged()
+
+	i, err := e.GetInstance("test", "")
+	require.NoError(t, err)
+	require.Equal(t, int32(1), callVersion(t, i))
+
+	p, _ := e.getPlugin("test")
+	require.Equal(t, int64(len("not wasm")), p.fileSize)
+
+	// the file is fixed while the invalid version is being compiled, the details
+	// recorded for the failed reload must not hide the change
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+
+	writeVersion(t, path, 1000)
+	e.updateFileInfo("test", fi)
+
+	e.reloadChanged()
+
+	i, err = e.GetInstance("test", "")
+	require.NoError(t, err)
+	require.Equal(t, int32(1000), callVersion(t, i))
+}
+
+func TestWatchPluginsUsesDefaultInterval(t *testing.T) {
+	e, _ := setupReloadTests(t)
+
+	stop := e.WatchPlugins(0)
+	stop()
+}
+
+func TestPoolDiscardsInstancesOfReloadedPlugin(t *testing.T) {
+	e, path := setupReloadTests(t)
+
+	p, err := e.NewPool("test", PoolOptions{Min: 1, Max: 2})
+	require.NoError(t, err)
+	defer p.Close()
+
+	old, err := p.Get(context.Background())
+	require.NoError(t, err)
+
+	writeVersion(t, path, 2)
+	err = e.ReloadPlugin("test")
+	require.NoError(t, err)
+
+	// the idle instance is stale and must be replaced
+	i, err := p.Get(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, int32(2), callVersion(t, i))
+
+	p.Put(old)
+	p.Put(i)
+	require.Len(t, p.idle, 1)
+	require.Equal(t, int32(2), callVersion(t, p.idle[0].instance))
+}
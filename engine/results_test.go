@@ -0,0 +1,108 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/nicholasjackson/wasp/engine/logger"
+	"github.com/stretchr/testify/require"
+)
+
+// watMulti is a module with functions that return multiple values
+var watMulti = `
+(module
+	(import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+	(memory (export "memory") 1)
+	(data (i32.const 16) "Hello\00")
+	(func (export "deallocate") (param i32 i32))
+	(func (export "get_string_size") (param i32) (result i32)
+		(i32.const 5))
+	(func (export "greet") (param i32) (result i32 i32)
+		(i32.const 16)
+		(local.get 0))
+	(func (export "split") (param f64) (result i64 f64)
+		(i64.trunc_f64_s (local.get 0))
+		(f64.sub (local.get 0) (f64.trunc (local.get 0)))))
+`
+
+// setupMultiInstance creates an instance of watMulti, the Singlepass compiler does
+// not support multiple return values so the module is compiled with Cranelift
+func setupMultiInstance(t *testing.T) Instance {
+	e := NewWithCompiler(logger.New(nil, nil, nil, nil), CompilerCranelift)
+
+	err := e.RegisterPluginBytes("test", watToWasm(t, watMulti), nil)
+	require.NoError(t, err)
+
+	i, err := e.GetInstance("test", "")
+	require.NoError(t, err)
+
+	return i
+}
+
+func TestCallFunctionReturnsMultipleValues(t *testing.T) {
+	i := setupMultiInstance(t)
+
+	var s string
+	var status int32
+	err := i.CallFunction("greet", Results{&s, &status}, 3)
+	require.NoError(t, err)
+	require.Equal(t, "Hello", s)
+	require.Equal(t, int32(3), status)
+
+	var whole int
+	var frac float64
+	err = i.CallFunction("split", Results{&whole, &frac}, 2.5)
+	require.NoError(t, err)
+	require.Equal(t, 2, whole)
+	require.Equal(t, 0.5, frac)
+}
+
+func TestCallFunctionIgnoresResults(t *testing.T) {
+	i := setupMultiInstance(t)
+
+	var status int32
+	err := i.CallFunction("greet", Results{nil, &status}, 3)
+	require.NoError(t, err)
+	require.Equal(t, int32(3), status)
+
+	// a single output parameter is set from the first result
+	var s string
+	err = i.CallFunction("greet", &s, 3)
+	require.NoError(t, err)
+	require.Equal(t, "Hello", s)
+}
+
+func TestCallFunctionReturnsErrorWhenResultsDoNotMatch(t *testing.T) {
+	i := setupMultiInstance(t)
+
+	var s string
+	var status int32
+	var extra int32
+	err := i.CallFunction("greet", Results{&s, &status, &extra}, 3)
+	requireSignatureMismatch(t, err)
+
+	var f float64
+	err = i.CallFunction("greet", Results{&s, &f}, 3)
+	requireSignatureMismatch(t, err)
+}
+
+func TestBindReturnsMultipleValues(t *testing.T) {
+	i := setupMultiInstance(t)
+
+	var greet func(int32) (string, int32, error)
+	err := i.Bind("greet", &greet)
+	require.NoError(t, err)
+
+	s, status, err := greet(7)
+	require.NoError(t, err)
+	require.Equal(t, "Hello", s)
+	require.Equal(t, int32(7), status)
+
+	var split func(float64) (int64, float64, error)
+	err = i.Bind("split", &split)
+	require.NoError(t, err)
+
+	whole, frac, err := split(3.25)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), whole)
+	require.Equal(t, 0.25, frac)
+}
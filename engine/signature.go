@@ -0,0 +1,156 @@
+package engine
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+// SignatureMismatchError is returned by CallFunction and Bind when the parameters or
+// output parameter do not match the signature of the exported function
+type SignatureMismatchError struct {
+	// Name of the exported function
+	Name string
+	// ExpectedParams and ExpectedResults are the Wasm types of the exported function
+	ExpectedParams  []string
+	ExpectedResults []string
+	// ProvidedParams and ProvidedResults are the Go types that were provided
+	ProvidedParams  []string
+	ProvidedResults []string
+}
+
+// Error implements the error interface
+func (s SignatureMismatchError) Error() string {
+	return fmt.Sprintf(
+		"function %s expects (%s) -> (%s), provided (%s) -> (%s)",
+		s.Name,
+		strings.Join(s.ExpectedParams, ", "),
+		strings.Join(s.ExpectedResults, ", "),
+		strings.Join(s.ProvidedParams, ", "),
+		strings.Join(s.ProvidedResults, ", "),
+	)
+}
+
+// checkSignature returns a SignatureMismatchError when the Go types of the parameters
+// and results can not be passed to and returned from the exported function fn, a nil
+// type in params is a nil parameter and a nil type in results is an ignored result
+func (i *wasmerInstance) checkSignature(name string, fn *exportedFunction, params, results []reflect.Type) error {
+	ok := len(params) == len(fn.params) && len(results) <= len(fn.results)
+
+	for n := 0; ok && n < len(params); n++ {
+		ok = compatibleKind(params[n], fn.params[n].Kind(), i.encodeArguments())
+	}
+
+	for n := 0; ok && n < len(results); n++ {
+		ok = results[n] == nil || compatibleKind(results[n], fn.results[n].Kind(), i.encodeArguments())
+	}
+
+	if ok {
+		return nil
+	}
+
+	return signatureMismatch(name, fn, params, results)
+}
+
+// signatureMismatch returns the SignatureMismatchError for the exported function fn
+// called with the Go types of the parameters and results
+func signatureMismatch(name string, fn *exportedFunction, params, results []reflect.Type) error {
+	return SignatureMismatchError{
+		Name:            name,
+		ExpectedParams:  kindNames(fn.params),
+		ExpectedResults: kindNames(fn.results),
+		ProvidedParams:  typeNames(params),
+		ProvidedResults: typeNames(results),
+	}
+}
+
+// paramTypesOf returns the types of the parameters passed to CallFunction
+func paramTypesOf(params []interface{}) []reflect.Type {
+	types := make([]reflect.Type, len(params))
+	for n, p := range params {
+		types[n] = reflect.TypeOf(p)
+	}
+
+	return types
+}
+
+// outputTypesOf returns the types of the values pointed to by the output parameter passed
+// to CallFunction, or by each element when the output parameter is Results. No types are
+// returned when the output parameter is nil or is not a pointer, output parameters that
+// are not pointers are rejected when the result is set.
+func outputTypesOf(outputParam interface{}) []reflect.Type {
+	results, ok := outputParam.(Results)
+	if !ok {
+		results = Results{outputParam}
+	}
+
+	types := []reflect.Type{}
+	for _, r := range results {
+		t := reflect.TypeOf(r)
+		if t == nil || t.Kind() != reflect.Ptr {
+			// a nil element ignores the result at that position
+			types = append(types, nil)
+			continue
+		}
+
+		types = append(types, t.Elem())
+	}
+
+	// trailing results that are ignored do not need to be checked
+	for len(types) > 0 && types[len(types)-1] == nil {
+		types = types[:len(types)-1]
+	}
+
+	return types
+}
+
+// compatibleKind returns true when values of the Go type t can be passed to or returned
+// from a Wasm function as the Wasm type kind. Integers can be passed as i32 or i64 and
+// floats as f32 or f64 as the values are range checked when they are converted, a float64
+// is only converted to an f32 when it does not lose precision. Strings,
+// byte slices and, when encode is true, structured types are passed as an i32 pointer.
+func compatibleKind(t reflect.Type, kind wasmer.ValueKind, encode bool) bool {
+	if t == nil {
+		return false
+	}
+
+	if t == stringType || t == bytesType || (encode && isStructured(t)) {
+		return kind == wasmer.I32
+	}
+
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Bool:
+		return kind == wasmer.I32 || kind == wasmer.I64
+	case reflect.Float32, reflect.Float64:
+		return kind == wasmer.F32 || kind == wasmer.F64
+	}
+
+	return false
+}
+
+func kindNames(types []*wasmer.ValueType) []string {
+	s := []string{}
+	for _, t := range types {
+		s = append(s, t.Kind().String())
+	}
+
+	return s
+}
+
+func typeNames(types []reflect.Type) []string {
+	s := []string{}
+	for _, t := range types {
+		if t == nil {
+			s = append(s, "nil")
+			continue
+		}
+
+		s = append(s, t.String())
+	}
+
+	return s
+}
@@ -0,0 +1,126 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+// watSignature is a module with functions that have different signatures
+var watSignature = `
+(module
+	(import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+	(memory (export "memory") 1)
+	(func (export "add_i64") (param i64 i64) (result i64)
+		(i64.add (local.get 0) (local.get 1)))
+	(func (export "half") (param f64) (result f64)
+		(f64.div (local.get 0) (f64.const 2)))
+	(func (export "half_f32") (param f32) (result f32)
+		(f32.div (local.get 0) (f32.const 2)))
+	(func (export "nothing") (param i32)))
+`
+
+func requireSignatureMismatch(t *testing.T, err error) SignatureMismatchError {
+	sme := SignatureMismatchError{}
+	require.True(t, xerrors.As(err, &sme), "expected SignatureMismatchError, got %v", err)
+
+	return sme
+}
+
+func TestCallFunctionReturnsErrorWhenArityDoesNotMatch(t *testing.T) {
+	i := setupWatInstance(t, watSignature, nil)
+
+	var out int64
+	err := i.CallFunction("add_i64", &out, int64(1))
+
+	sme := requireSignatureMismatch(t, err)
+	require.Equal(t, "add_i64", sme.Name)
+	require.Equal(t, []string{"i64", "i64"}, sme.ExpectedParams)
+	require.Equal(t, []string{"i64"}, sme.ExpectedResults)
+	require.Equal(t, []string{"int64"}, sme.ProvidedParams)
+	require.Equal(t, []string{"int64"}, sme.ProvidedResults)
+	require.Equal(t, "function add_i64 expects (i64, i64) -> (i64), provided (int64) -> (int64)", err.Error())
+}
+
+func TestCallFunctionReturnsErrorWhenKindsDoNotMatch(t *testing.T) {
+	i := setupWatInstance(t, watSignature, nil)
+
+	var out int64
+	err := i.CallFunction("add_i64", &out, "1", 2)
+	requireSignatureMismatch(t, err)
+
+	err = i.CallFunction("add_i64", &out, 1.5, 2)
+	requireSignatureMismatch(t, err)
+
+	err = i.CallFunction("add_i64", &out, nil, 2)
+	sme := requireSignatureMismatch(t, err)
+	require.Equal(t, []string{"nil", "int"}, sme.ProvidedParams)
+
+	var f float64
+	err = i.CallFunction("half", &f, 1)
+	requireSignatureMismatch(t, err)
+}
+
+func TestCallFunctionReturnsErrorWhenOutputDoesNotMatch(t *testing.T) {
+	i := setupWatInstance(t, watSignature, nil)
+
+	var s string
+	err := i.CallFunction("add_i64", &s, 1, 2)
+	requireSignatureMismatch(t, err)
+
+	var n int32
+	err = i.CallFunction("nothing", &n, 1)
+	sme := requireSignatureMismatch(t, err)
+	require.Empty(t, sme.ExpectedResults)
+	require.Equal(t, []string{"int32"}, sme.ProvidedResults)
+}
+
+func TestCallFunctionAcceptsCompatibleKinds(t *testing.T) {
+	i := setupWatInstance(t, watSignature, nil)
+
+	var out int64
+	err := i.CallFunction("add_i64", &out, 1, int32(2))
+	require.NoError(t, err)
+	require.Equal(t, int64(3), out)
+
+	var f float32
+	err = i.CallFunction("half", &f, float32(3))
+	require.NoError(t, err)
+	require.Equal(t, float32(1.5), f)
+
+	// the result of a function can be ignored
+	err = i.CallFunction("add_i64", nil, 1, 2)
+	require.NoError(t, err)
+
+	err = i.CallFunction("nothing", nil, 1)
+	require.NoError(t, err)
+}
+
+func TestCallFunctionReturnsErrorWhenFloatLosesPrecision(t *testing.T) {
+	i := setupWatInstance(t, watSignature, nil)
+
+	var out float64
+	err := i.CallFunction("half_f32", &out, 1.5)
+	require.NoError(t, err)
+	require.Equal(t, 0.75, out)
+
+	for _, f := range []float64{0.1, 16777217} {
+		err = i.CallFunction("half_f32", &out, f)
+
+		sme := requireSignatureMismatch(t, err)
+		require.Equal(t, []string{"f32"}, sme.ExpectedParams)
+		require.Equal(t, []string{"float64"}, sme.ProvidedParams)
+	}
+}
+
+func TestBindReturnsSignatureMismatchError(t *testing.T) {
+	i := setupWatInstance(t, watSignature, nil)
+
+	var fn func(string) (int64, error)
+	err := i.Bind("add_i64", &fn)
+
+	sme := requireSignatureMismatch(t, err)
+	require.Equal(t, []string{"string"}, sme.ProvidedParams)
+	require.Nil(t, fn)
+}
@@ -0,0 +1,158 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+// TrapKind is the cause of a trap
+type TrapKind string
+
+const (
+	// TrapUnreachable is caused by the unreachable instruction, i.e. a panic in the module
+	TrapUnreachable TrapKind = "unreachable"
+	// TrapDivideByZero is caused by an integer division by zero
+	TrapDivideByZero TrapKind = "divide_by_zero"
+	// TrapIntegerOverflow is caused by an integer division that overflows
+	TrapIntegerOverflow TrapKind = "integer_overflow"
+	// TrapInvalidConversion is caused by converting a float that is NaN or out of range to an integer
+	TrapInvalidConversion TrapKind = "invalid_conversion"
+	// TrapOutOfBounds is caused by accessing memory outside of the modules linear memory
+	TrapOutOfBounds TrapKind = "out_of_bounds"
+	// TrapStackOverflow is caused by exhausting the call stack
+	TrapStackOverflow TrapKind = "stack_overflow"
+	// TrapIndirectCall is caused by an indirect call to a missing function or with the wrong signature
+	TrapIndirectCall TrapKind = "indirect_call"
+	// TrapHostPanic is caused by a callback that panics
+	TrapHostPanic TrapKind = "host_panic"
+	// TrapUnknown is used for traps that do not have a known cause
+	TrapUnknown TrapKind = "unknown"
+)
+
+// maxTrapFrames is the maximum number of frames recorded for a trap, the stack for
+// a trap caused by unbounded recursion can contain many thousands of frames
+const maxTrapFrames = 64
+
+// TrapFrame is a function in the stack of a trap
+type TrapFrame struct {
+	// FunctionIndex is the index of the function in the module including imported functions
+	FunctionIndex uint32
+	// FunctionName is the name of the function from the name section of the module,
+	// empty when the module does not contain names
+	FunctionName string
+	// FunctionOffset is the offset of the instruction from the start of the function body
+	// in the plugin's module
+	FunctionOffset uint
+}
+
+// String returns the name of the function and the offset of the instruction
+func (f TrapFrame) String() string {
+	name := f.FunctionName
+	if name == "" {
+		name = fmt.Sprintf("func[%d]", f.FunctionIndex)
+	}
+
+	return fmt.Sprintf("%s+0x%x", name, f.FunctionOffset)
+}
+
+// TrapError is returned by CallFunction when the module traps, or when a callback
+// panics
+type TrapError struct {
+	// Function is the name of the exported function that was called
+	Function string
+	// Kind is the cause of the trap
+	Kind TrapKind
+	// Message is the message for the trap, or the value passed to panic
+	Message string
+	// Frames is the stack for the trap, starting with the function that trapped
+	Frames []TrapFrame
+}
+
+// Error implements the error interface
+func (t TrapError) Error() string {
+	if len(t.Frames) == 0 {
+		return fmt.Sprintf("function %s trapped: %s", t.Function, t.Message)
+	}
+
+	return fmt.Sprintf("function %s trapped: %s at %s", t.Function, t.Message, t.Frames[0])
+}
+
+// StackTrace returns the frames for the trap with one frame per line
+func (t TrapError) StackTrace() string {
+	lines := []string{}
+	for _, f := range t.Frames {
+		lines = append(lines, f.String())
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// trapKind returns the kind of trap from the message returned by Wasmer
+func trapKind(message string) TrapKind {
+	switch {
+	case strings.Contains(message, "unreachable"):
+		return TrapUnreachable
+	case strings.Contains(message, "divide by zero"):
+		return TrapDivideByZero
+	case strings.Contains(message, "integer overflow"):
+		return TrapIntegerOverflow
+	case strings.Contains(message, "invalid conversion"):
+		return TrapInvalidConversion
+	case strings.Contains(message, "out of bounds memory"):
+		return TrapOutOfBounds
+	case strings.Contains(message, "call stack exhausted"):
+		return TrapStackOverflow
+	case strings.Contains(message, "element"), strings.Contains(message, "indirect call"):
+		return TrapIndirectCall
+	}
+
+	return TrapUnknown
+}
+
+// trapFrames converts the frames for a Wasmer trap, the names of the functions and the
+// offsets in the original module are found in the plugin. The instructions added to the
+// module by the engine are reported at the instruction they were added for, frames for
+// the functions added by the engine are not included.
+func trapFrames(trap *wasmer.TrapError, p *plugin) []TrapFrame {
+	frames := []TrapFrame{}
+	if p == nil {
+		return frames
+	}
+
+	for _, f := range trap.Trace() {
+		if len(frames) == maxTrapFrames {
+			break
+		}
+
+		offsets, ok := p.offsets[f.FunctionIndex()]
+		if !ok {
+			continue
+		}
+
+		frames = append(frames, TrapFrame{
+			FunctionIndex:  f.FunctionIndex(),
+			FunctionName:   p.functionNames[f.FunctionIndex()],
+			FunctionOffset: uint(offsets.original(uint32(f.FunctionOffset()))),
+		})
+	}
+
+	return frames
+}
+
+// functionNames returns the function names from the name section of the module, names
+// are only used for trap frames so a module with an invalid name section can still be used
+func functionNames(wasm []byte) map[uint32]string {
+	m, err := parseWasmModule(wasm)
+	if err != nil {
+		return nil
+	}
+
+	names, err := m.functionNames()
+	if err != nil {
+		return nil
+	}
+
+	return names
+}
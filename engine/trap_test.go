@@ -0,0 +1,173 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/nicholasjackson/wasp/engine/logger"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+// watTrap is a module with functions that trap
+var watTrap = `
+(module
+	(import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+	(import "env" "explode" (func $explode))
+	(memory (export "memory") 1)
+	(table 1 funcref)
+	(type $t (func))
+	(func $divide (param i32) (result i32)
+		(i32.div_s (i32.const 1) (local.get 0)))
+	(func (export "div") (param i32) (result i32)
+		(call $divide (local.get 0)))
+	(func (export "unreachable")
+		unreachable)
+	(func (export "oob") (result i32)
+		(i32.load (i32.const 100000000)))
+	(func $recurse (export "recurse")
+		(call $recurse))
+	(func (export "indirect")
+		(call_indirect (type $t) (i32.const 0)))
+	(func (export "explode")
+		(call $explode)))
+`
+
+func setupTrapInstance(t *testing.T, c Compiler) Instance {
+	cb := &Callbacks{}
+	cb.AddCallback("env", "explode", func() { panic("boom") })
+
+	e := NewWithCompiler(logger.New(nil, nil, nil, nil), c)
+
+	err := e.RegisterPluginBytes("test", watToWasm(t, watTrap), &PluginConfig{Callbacks: cb})
+	require.NoError(t, err)
+
+	i, err := e.GetInstance("test", "")
+	require.NoError(t, err)
+
+	return i
+}
+
+func requireTrap(t *testing.T, err error, kind TrapKind) TrapError {
+	te := TrapError{}
+	require.True(t, xerrors.As(err, &te), "expected TrapError, got %v", err)
+	require.Equal(t, kind, te.Kind)
+
+	return te
+}
+
+func TestCallFunctionReturnsTrapError(t *testing.T) {
+	i := setupTrapInstance(t, CompilerSinglepass)
+
+	err := i.CallFunction("unreachable", nil)
+	te := requireTrap(t, err, TrapUnreachable)
+	require.Equal(t, "unreachable", te.Function)
+	require.Equal(t, "unreachable", te.Message)
+
+	err = i.CallFunction("oob", nil)
+	requireTrap(t, err, TrapOutOfBounds)
+
+	err = i.CallFunction("recurse", nil)
+	te = requireTrap(t, err, TrapStackOverflow)
+	require.LessOrEqual(t, len(te.Frames), maxTrapFrames)
+
+	err = i.CallFunction("indirect", nil)
+	requireTrap(t, err, TrapIndirectCall)
+}
+
+func TestTrapErrorContainsFunctionNames(t *testing.T) {
+	i := setupTrapInstance(t, CompilerCranelift)
+
+	var out int32
+	err := i.CallFunction("div", &out, 0)
+	te := requireTrap(t, err, TrapDivideByZero)
+	require.Equal(t, "div", te.Function)
+	require.Equal(t, "integer divide by zero", te.Message)
+
+	require.Len(t, te.Frames, 2)
+	require.Equal(t, uint32(2), te.Frames[0].FunctionIndex)
+	require.Equal(t, "divide", te.Frames[0].FunctionName)
+	require.Contains(t, te.Error(), "at divide+0x")
+	require.Contains(t, te.StackTrace(), "divide+0x")
+}
+
+func TestTrapFrameOffsetsAreInOriginalModule(t *testing.T) {
+	cb := &Callbacks{}
+	cb.AddCallback("env", "explode", func() {})
+
+	e := NewWithCompiler(logger.New(nil, nil, nil, nil), CompilerCranelift)
+
+	// metering and the memory limit add the most instructions to the functions
+	conf := &PluginConfig{Callbacks: cb, Fuel: 1000, MaxMemoryPages: 2}
+	err := e.RegisterPluginBytes("test", watToWasm(t, watTrap), conf)
+	require.NoError(t, err)
+
+	i, err := e.GetInstance("test", "")
+	require.NoError(t, err)
+
+	// the function bodies start with a single byte for the local declarations
+	err = i.CallFunction("unreachable", nil)
+	te := requireTrap(t, err, TrapUnreachable)
+	require.Equal(t, uint(0x1), te.Frames[0].FunctionOffset)
+
+	// i32.const 100000000 is five bytes
+	var out int32
+	err = i.CallFunction("oob", &out)
+	te = requireTrap(t, err, TrapOutOfBounds)
+	require.Equal(t, uint(0x6), te.Frames[0].FunctionOffset)
+
+	err = i.CallFunction("div", &out, 0)
+	te = requireTrap(t, err, TrapDivideByZero)
+	require.Len(t, te.Frames, 2)
+	require.Equal(t, "divide+0x5", te.Frames[0].String())
+	require.Equal(t, "func[3]+0x3", te.Frames[1].String())
+}
+
+func TestInstanceCanBeUsedAfterTrap(t *testing.T) {
+	i := setupTrapInstance(t, CompilerSinglepass)
+
+	var out int32
+	err := i.CallFunction("div", &out, 0)
+	requireTrap(t, err, TrapDivideByZero)
+
+	err = i.CallFunction("div", &out, 1)
+	require.NoError(t, err)
+	require.Equal(t, int32(1), out)
+}
+
+func TestCallbackPanicReturnsTrapError(t *testing.T) {
+	i := setupTrapInstance(t, CompilerSinglepass)
+
+	err := i.CallFunction("explode", nil)
+	te := requireTrap(t, err, TrapHostPanic)
+	require.Equal(t, "explode", te.Function)
+	require.Contains(t, te.Message, "env.explode panicked: boom")
+
+	// the instance is still usable after the panic
+	var out int32
+	err = i.CallFunction("div", &out, 1)
+	require.NoError(t, err)
+}
+
+func TestCallbackPanicFreesMemory(t *testing.T) {
+	panics := true
+
+	cb := &Callbacks{}
+	cb.AddCallback("env", "callback", func(addr int32) {
+		if panics {
+			panic("boom")
+		}
+	})
+
+	i := setupWatInstance(t, watCallbackAllocations, &PluginConfig{Callbacks: cb})
+
+	err := i.CallFunction("call", nil, "hello")
+	requireTrap(t, err, TrapHostPanic)
+	require.Equal(t, int32(0), allocated(t, i))
+
+	// the instance can be called again without leaking the arguments
+	panics = false
+
+	err = i.CallFunction("call", nil, "hello")
+	require.NoError(t, err)
+	require.Equal(t, int32(0), allocated(t, i))
+}
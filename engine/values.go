@@ -0,0 +1,244 @@
+package engine
+
+import (
+	"math"
+	"reflect"
+
+	"github.com/wasmerio/wasmer-go/wasmer"
+	"golang.org/x/xerrors"
+)
+
+// The Go types that can be passed to and returned from Wasm functions and callbacks
+// are mapped to the Wasm numeric types as follows:
+//
+//	int32, int, uint32, bool: i32
+//	int64, uint64:            i64
+//	float32:                  f32
+//	float64:                  f64
+//
+// Strings, byte slices and structs are passed as an i32 pointer to the data in the
+// modules memory, see passedByPointer.
+//
+// Values are range checked when they are converted, converting a value that does not
+// fit in the destination type returns an error. Unsigned values are converted to and from
+// the Wasm integer types using the same bits, i.e. the uint32 4294967295 is the i32 -1.
+
+// wasmKind returns the Wasm type used to pass the Go type t
+func wasmKind(t reflect.Type) (wasmer.ValueKind, error) {
+	switch t.Kind() {
+	case reflect.Int32, reflect.Int, reflect.Uint32, reflect.Bool, reflect.String:
+		return wasmer.I32, nil
+	case reflect.Int64, reflect.Uint64:
+		return wasmer.I64, nil
+	case reflect.Float32:
+		return wasmer.F32, nil
+	case reflect.Float64:
+		return wasmer.F64, nil
+	}
+
+	if passedByPointer(t) {
+		return wasmer.I32, nil
+	}
+
+	return wasmer.I32, xerrors.Errorf("type %s can not be passed to or from a Wasm module", t)
+}
+
+// passedByPointer returns true when values of the type are copied to the modules memory and
+// passed as a pointer. Strings are passed as null terminated strings, byte slices, structs and
+// pointers to structs are passed as length prefixed data. Structs are marshalled using the
+// codec for the plugin.
+func passedByPointer(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Struct:
+		return true
+	case reflect.Slice:
+		return t.Elem().Kind() == reflect.Uint8
+	case reflect.Ptr:
+		return t.Elem().Kind() == reflect.Struct
+	}
+
+	return false
+}
+
+// isStructured returns true when the type is a struct, map, array or slice other
+// than []byte, or a pointer to one of these types. Structured values are marshalled
+// when passed to CallFunction with PluginConfig.EncodeArguments enabled.
+func isStructured(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map, reflect.Array:
+		return true
+	case reflect.Slice:
+		return t.Elem().Kind() != reflect.Uint8
+	}
+
+	return false
+}
+
+var (
+	stringType = reflect.TypeOf("")
+	bytesType  = reflect.TypeOf([]byte(nil))
+)
+
+// errFloatPrecision is returned when a float64 can not be converted to a float32 without
+// losing precision, i.e. 0.1
+var errFloatPrecision = xerrors.New("value can not be represented as a float32 without losing precision")
+
+// losesPrecision returns true when the float64 is not exactly representable as a float32
+func losesPrecision(f float64) bool {
+	return !math.IsNaN(f) && float64(float32(f)) != f
+}
+
+// toWasmValue converts the Go value v to the Go type used by Wasmer for the Wasm type kind,
+// int32, int64, float32 or float64
+func toWasmValue(v reflect.Value, kind wasmer.ValueKind) (interface{}, error) {
+	if !v.IsValid() {
+		return nil, xerrors.Errorf("unable to convert nil to %s", kind)
+	}
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n := v.Int()
+
+		switch kind {
+		case wasmer.I32:
+			if n < math.MinInt32 || n > math.MaxInt32 {
+				return nil, xerrors.Errorf("value %d of type %s overflows i32", n, v.Type())
+			}
+
+			return int32(n), nil
+		case wasmer.I64:
+			return n, nil
+		}
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n := v.Uint()
+
+		switch kind {
+		case wasmer.I32:
+			if n > math.MaxUint32 {
+				return nil, xerrors.Errorf("value %d of type %s overflows i32", n, v.Type())
+			}
+
+			return int32(uint32(n)), nil
+		case wasmer.I64:
+			return int64(n), nil
+		}
+
+	case reflect.Bool:
+		var n int32
+		if v.Bool() {
+			n = 1
+		}
+
+		switch kind {
+		case wasmer.I32:
+			return n, nil
+		case wasmer.I64:
+			return int64(n), nil
+		}
+
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+
+		switch kind {
+		case wasmer.F32:
+			if !math.IsInf(f, 0) && !math.IsNaN(f) && math.Abs(f) > math.MaxFloat32 {
+				return nil, xerrors.Errorf("value %g of type %s overflows f32", f, v.Type())
+			}
+
+			if losesPrecision(f) {
+				return nil, xerrors.Errorf("unable to convert %g to f32: %w", f, errFloatPrecision)
+			}
+
+			return float32(f), nil
+		case wasmer.F64:
+			return f, nil
+		}
+	}
+
+	return nil, xerrors.Errorf("unable to convert type %s to %s", v.Type(), kind)
+}
+
+// fromWasmValue converts the value returned by Wasmer, int32, int64, float32 or float64,
+// to the Go type t
+func fromWasmValue(v interface{}, t reflect.Type) (reflect.Value, error) {
+	out := reflect.New(t).Elem()
+
+	var n int64
+	var u uint64
+	var f float64
+	var isFloat bool
+
+	switch w := v.(type) {
+	case int32:
+		n = int64(w)
+		u = uint64(uint32(w))
+	case int64:
+		n = w
+		u = uint64(w)
+	case float32:
+		f = float64(w)
+		isFloat = true
+	case float64:
+		f = w
+		isFloat = true
+	default:
+		return out, xerrors.Errorf("unable to convert %T to %s", v, t)
+	}
+
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if isFloat {
+			break
+		}
+
+		if out.OverflowInt(n) {
+			return out, xerrors.Errorf("value %v overflows %s", v, t)
+		}
+
+		out.SetInt(n)
+		return out, nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if isFloat {
+			break
+		}
+
+		if out.OverflowUint(u) {
+			return out, xerrors.Errorf("value %v overflows %s", v, t)
+		}
+
+		out.SetUint(u)
+		return out, nil
+
+	case reflect.Bool:
+		if isFloat {
+			break
+		}
+
+		out.SetBool(n != 0)
+		return out, nil
+
+	case reflect.Float32, reflect.Float64:
+		if !isFloat {
+			break
+		}
+
+		if !math.IsInf(f, 0) && !math.IsNaN(f) && out.OverflowFloat(f) {
+			return out, xerrors.Errorf("value %v overflows %s", v, t)
+		}
+
+		if t.Kind() == reflect.Float32 && losesPrecision(f) {
+			return out, xerrors.Errorf("unable to convert %v to %s: %w", v, t, errFloatPrecision)
+		}
+
+		out.SetFloat(f)
+		return out, nil
+	}
+
+	return out, xerrors.Errorf("unable to convert %T to %s", v, t)
+}
@@ -0,0 +1,131 @@
+package engine
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+func TestWasmKindReturnsKindForGoType(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		kind  wasmer.ValueKind
+	}{
+		{int32(0), wasmer.I32},
+		{int(0), wasmer.I32},
+		{uint32(0), wasmer.I32},
+		{false, wasmer.I32},
+		{"", wasmer.I32},
+		{int64(0), wasmer.I64},
+		{uint64(0), wasmer.I64},
+		{float32(0), wasmer.F32},
+		{float64(0), wasmer.F64},
+	}
+
+	for _, tc := range tests {
+		k, err := wasmKind(reflect.TypeOf(tc.value))
+		require.NoError(t, err)
+		require.Equal(t, tc.kind, k, "%T", tc.value)
+	}
+}
+
+func TestWasmKindReturnsErrorForUnsupportedType(t *testing.T) {
+	_, err := wasmKind(reflect.TypeOf(map[string]string{}))
+	require.Error(t, err)
+}
+
+func TestToWasmValueConvertsValues(t *testing.T) {
+	tests := []struct {
+		value    interface{}
+		kind     wasmer.ValueKind
+		expected interface{}
+	}{
+		{int32(-1), wasmer.I32, int32(-1)},
+		{int(math.MaxInt32), wasmer.I32, int32(math.MaxInt32)},
+		{uint32(math.MaxUint32), wasmer.I32, int32(-1)},
+		{true, wasmer.I32, int32(1)},
+		{int32(-1), wasmer.I64, int64(-1)},
+		{int64(math.MinInt64), wasmer.I64, int64(math.MinInt64)},
+		{uint64(math.MaxUint64), wasmer.I64, int64(-1)},
+		{float32(1.5), wasmer.F32, float32(1.5)},
+		{float64(1.5), wasmer.F32, float32(1.5)},
+		{math.Inf(1), wasmer.F32, float32(math.Inf(1))},
+		{float32(1.5), wasmer.F64, float64(1.5)},
+		{math.MaxFloat64, wasmer.F64, math.MaxFloat64},
+	}
+
+	for _, tc := range tests {
+		v, err := toWasmValue(reflect.ValueOf(tc.value), tc.kind)
+		require.NoError(t, err)
+		require.Equal(t, tc.expected, v, "%T %v", tc.value, tc.value)
+	}
+}
+
+func TestToWasmValueReturnsErrorWhenOutOfRange(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		kind  wasmer.ValueKind
+	}{
+		{int64(math.MaxInt32 + 1), wasmer.I32},
+		{int(math.MinInt32 - 1), wasmer.I32},
+		{uint64(math.MaxUint32 + 1), wasmer.I32},
+		{math.MaxFloat64, wasmer.F32},
+		{0.1, wasmer.F32},
+		{float64(16777217), wasmer.F32},
+		{1.5, wasmer.I32},
+		{int32(1), wasmer.F64},
+		{"abc", wasmer.I32},
+	}
+
+	for _, tc := range tests {
+		_, err := toWasmValue(reflect.ValueOf(tc.value), tc.kind)
+		require.Error(t, err, "%T %v", tc.value, tc.value)
+	}
+}
+
+func TestFromWasmValueConvertsValues(t *testing.T) {
+	tests := []struct {
+		value    interface{}
+		expected interface{}
+	}{
+		{int32(-1), int32(-1)},
+		{int32(-1), int(-1)},
+		{int32(-1), uint32(math.MaxUint32)},
+		{int32(-1), int64(-1)},
+		{int32(2), true},
+		{int32(0), false},
+		{int64(-1), uint64(math.MaxUint64)},
+		{int64(math.MaxUint32), uint32(math.MaxUint32)},
+		{float32(1.5), float64(1.5)},
+		{float64(1.5), float32(1.5)},
+	}
+
+	for _, tc := range tests {
+		v, err := fromWasmValue(tc.value, reflect.TypeOf(tc.expected))
+		require.NoError(t, err)
+		require.Equal(t, tc.expected, v.Interface(), "%T %v", tc.value, tc.value)
+	}
+}
+
+func TestFromWasmValueReturnsErrorWhenOutOfRange(t *testing.T) {
+	tests := []struct {
+		value  interface{}
+		target interface{}
+	}{
+		{int64(math.MaxInt32 + 1), int32(0)},
+		{int64(-1), uint32(0)},
+		{math.MaxFloat64, float32(0)},
+		{0.1, float32(0)},
+		{float64(1), int32(0)},
+		{int32(1), float64(0)},
+		{int32(1), ""},
+	}
+
+	for _, tc := range tests {
+		_, err := fromWasmValue(tc.value, reflect.TypeOf(tc.target))
+		require.Error(t, err, "%T %v to %T", tc.value, tc.value, tc.target)
+	}
+}
@@ -0,0 +1,191 @@
+package engine
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/wasmerio/wasmer-go/wasmer"
+	"golang.org/x/xerrors"
+)
+
+// workspaceMount is the name of the directory the workspace is mounted to
+const workspaceMount = "workspace"
+
+// volume is a directory on the host that is mounted into the module instances
+type volume struct {
+	// hostPath is the directory on the host, it must exist when the plugin is registered
+	hostPath string
+	// readOnly prevents the module from creating, modifying or removing files in the volume
+	readOnly bool
+}
+
+// mountName returns the name of the directory in the root of the module
+// filesystem for the guest path, i.e. /data is mounted as data
+func mountName(guestPath string) string {
+	return strings.TrimPrefix(path.Clean("/"+guestPath), "/")
+}
+
+// validateVolumes checks the guest path of each volume is a single directory in the
+// root of the module filesystem and that the host path is an existing directory
+func validateVolumes(config *PluginConfig) error {
+	for guestPath := range config.ReadOnlyVolumes {
+		if _, ok := config.Volumes[guestPath]; ok {
+			return xerrors.Errorf("volume %s is in both Volumes and ReadOnlyVolumes", guestPath)
+		}
+	}
+
+	names := map[string]string{}
+
+	for guestPath, v := range config.volumes() {
+		name := mountName(guestPath)
+		if name == "" || strings.Contains(name, "/") {
+			return xerrors.Errorf("volume %s must be mounted to a directory in the root of the filesystem, i.e. /data", guestPath)
+		}
+
+		if name == workspaceMount {
+			return xerrors.Errorf("volume %s can not be mounted to /%s, the directory is reserved for the workspace", guestPath, workspaceMount)
+		}
+
+		if other, ok := names[name]; ok {
+			return xerrors.Errorf("volumes %s and %s are mounted to the same directory", other, guestPath)
+		}
+
+		names[name] = guestPath
+
+		fi, err := os.Stat(v.hostPath)
+		if err != nil {
+			return xerrors.Errorf("unable to find host path %s for volume %s: %w", v.hostPath, guestPath, err)
+		}
+
+		if !fi.IsDir() {
+			return xerrors.Errorf("host path %s for volume %s is not a directory", v.hostPath, guestPath)
+		}
+	}
+
+	return nil
+}
+
+// newMount creates a mount for the host directory, the host path is resolved so
+// that paths opened by the module can be checked against the real location
+func newMount(name, hostPath string, readOnly bool) (*wasiMount, error) {
+	root, err := filepath.Abs(hostPath)
+	if err != nil {
+		return nil, xerrors.Errorf("unable to resolve host path %s: %w", hostPath, err)
+	}
+
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, xerrors.Errorf("unable to resolve host path %s: %w", hostPath, err)
+	}
+
+	return &wasiMount{name: name, hostPath: hostPath, root: root, readOnly: readOnly}, nil
+}
+
+// mapVolumes maps the volumes and the workspace directory into the module filesystem and
+// returns the mounts, volumes are mapped in order of the guest path
+func mapVolumes(wasi *wasmer.WasiStateBuilder, volumes map[string]volume, workspaceDir string) ([]*wasiMount, error) {
+	guestPaths := make([]string, 0, len(volumes))
+	for g := range volumes {
+		guestPaths = append(guestPaths, g)
+	}
+
+	sort.Strings(guestPaths)
+
+	mounts := []*wasiMount{}
+	for _, g := range guestPaths {
+		v := volumes[g]
+
+		m, err := newMount(mountName(g), v.hostPath, v.readOnly)
+		if err != nil {
+			return nil, xerrors.Errorf("unable to mount volume %s: %w", g, err)
+		}
+
+		wasi.MapDirectory(m.name, v.hostPath)
+		mounts = append(mounts, m)
+	}
+
+	if workspaceDir != "" {
+		m, err := newMount(workspaceMount, workspaceDir, false)
+		if err != nil {
+			return nil, xerrors.Errorf("unable to mount workspace: %w", err)
+		}
+
+		wasi.MapDirectory(workspaceMount, workspaceDir)
+		mounts = append(mounts, m)
+	}
+
+	return mounts, nil
+}
+
+// mapFilesystems maps the virtual filesystems into the module filesystem, each
+// filesystem is mapped to the same empty scratch directory which is returned
+func mapFilesystems(wasi *wasmer.WasiStateBuilder, volumes map[string]volume, filesystems map[string]*MemFS) ([]*virtualMount, string, error) {
+	if len(filesystems) == 0 {
+		return nil, "", nil
+	}
+
+	names := map[string]bool{}
+	for g := range volumes {
+		names[mountName(g)] = true
+	}
+
+	guestPaths := make([]string, 0, len(filesystems))
+	for g, f := range filesystems {
+		name := mountName(g)
+		if name == "" || strings.Contains(name, "/") {
+			return nil, "", xerrors.Errorf("filesystem %s must be mounted to a directory in the root of the filesystem, i.e. /data", g)
+		}
+
+		if name == workspaceMount || names[name] {
+			return nil, "", xerrors.Errorf("filesystem %s is mounted to the same directory as a volume or the workspace", g)
+		}
+
+		if f == nil {
+			return nil, "", xerrors.Errorf("filesystem %s is nil", g)
+		}
+
+		names[name] = true
+		guestPaths = append(guestPaths, g)
+	}
+
+	sort.Strings(guestPaths)
+
+	scratch, err := os.MkdirTemp("", "wasp-instance-")
+	if err != nil {
+		return nil, "", xerrors.Errorf("unable to create scratch directory for filesystems: %w", err)
+	}
+
+	mounts := []*virtualMount{}
+	for _, g := range guestPaths {
+		m := &virtualMount{name: mountName(g), fs: filesystems[g], fd: -1}
+
+		wasi.MapDirectory(m.name, scratch)
+		mounts = append(mounts, m)
+	}
+
+	return mounts, scratch, nil
+}
+
+// importsNamespace returns true when the module imports from the namespace
+func importsNamespace(module *wasmer.Module, namespace string) bool {
+	for _, i := range module.Imports() {
+		if i.Module() == namespace {
+			return true
+		}
+	}
+
+	return false
+}
+
+// moduleNamespaces returns the namespaces imported by the module
+func moduleNamespaces(module *wasmer.Module) []string {
+	namespaces := []string{}
+	for _, i := range module.Imports() {
+		namespaces = append(namespaces, i.Module())
+	}
+
+	return namespaces
+}
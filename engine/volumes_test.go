@@ -0,0 +1,224 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nicholasjackson/wasp/engine/logger"
+	"github.com/stretchr/testify/require"
+)
+
+// watVolumes is a module that opens, writes and creates files using WASI, paths
+// are passed as a pointer and length to the strings in the data segments
+var watVolumes = `
+(module
+	(import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+	(import "wasi_snapshot_preview1" "path_open"
+		(func $path_open (param i32 i32 i32 i32 i32 i64 i64 i32 i32) (result i32)))
+	(import "wasi_snapshot_preview1" "fd_write"
+		(func $fd_write (param i32 i32 i32 i32) (result i32)))
+	(import "wasi_snapshot_preview1" "path_create_directory"
+		(func $path_create_directory (param i32 i32 i32) (result i32)))
+	(memory (export "memory") 1)
+	(data (i32.const 0x100) "in.txt")
+	(data (i32.const 0x120) "out.txt")
+	(data (i32.const 0x140) "newdir")
+	(data (i32.const 0x160) "escape/secret.txt")
+	(data (i32.const 0x180) "data/out.txt")
+	(data (i32.const 0x1a0) "../in.txt")
+	(data (i32.const 0x300) "hi")
+	(data (i32.const 0x400) "\00\03\00\00\02\00\00\00")
+
+	;; open opens the path relative to the directory fd and stores the new fd at 0x500
+	(func (export "open") (param $dir i32) (param $ptr i32) (param $len i32) (param $oflags i32) (result i32)
+		(call $path_open
+			(local.get $dir) (i32.const 1) (local.get $ptr) (local.get $len) (local.get $oflags)
+			(i64.const 0x1fffffff) (i64.const 0x1fffffff) (i32.const 0) (i32.const 0x500)))
+
+	;; write writes hi to the last file opened
+	(func (export "write") (result i32)
+		(call $fd_write (i32.load (i32.const 0x500)) (i32.const 0x400) (i32.const 1) (i32.const 0x410)))
+
+	(func (export "mkdir") (param $dir i32) (param $ptr i32) (param $len i32) (result i32)
+		(call $path_create_directory (local.get $dir) (local.get $ptr) (local.get $len))))
+`
+
+const (
+	fdRoot = 3
+	fdData = 4
+
+	pathIn     = 0x100
+	pathOut    = 0x120
+	pathNewDir = 0x140
+	pathEscape = 0x160
+	pathRoot   = 0x180
+	pathParent = 0x1a0
+)
+
+func setupVolumeInstance(t *testing.T, readOnly bool) (Instance, string) {
+	return setupVolumeInstanceWithWat(t, watVolumes, readOnly)
+}
+
+func setupVolumeInstanceWithWat(t *testing.T, wat string, readOnly bool) (Instance, string) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "in.txt"), []byte("input"), 0644)
+	require.NoError(t, err)
+
+	conf := &PluginConfig{Volumes: map[string]string{"/data": dir}}
+	if readOnly {
+		conf = &PluginConfig{ReadOnlyVolumes: map[string]string{"/data": dir}}
+	}
+
+	return setupWatInstance(t, wat, conf), dir
+}
+
+func callErrno(t *testing.T, i Instance, name string, params ...interface{}) int32 {
+	var errno int32
+	err := i.CallFunction(name, &errno, params...)
+	require.NoError(t, err)
+
+	return errno
+}
+
+func TestReadOnlyVolumeAllowsRead(t *testing.T) {
+	i, _ := setupVolumeInstance(t, true)
+
+	errno := callErrno(t, i, "open", fdData, pathIn, 6, 0)
+	require.Equal(t, wasiErrnoSuccess, errno)
+}
+
+func TestReadOnlyVolumePreventsWrites(t *testing.T) {
+	i, dir := setupVolumeInstance(t, true)
+
+	errno := callErrno(t, i, "open", fdData, pathOut, 7, wasiOflagsCreat)
+	require.Equal(t, wasiErrnoRofs, errno)
+
+	errno = callErrno(t, i, "open", fdRoot, pathRoot, 12, wasiOflagsCreat)
+	require.Equal(t, wasiErrnoRofs, errno)
+
+	errno = callErrno(t, i, "mkdir", fdData, pathNewDir, 6)
+	require.Equal(t, wasiErrnoRofs, errno)
+
+	// files opened without create can not be written to
+	errno = callErrno(t, i, "open", fdData, pathIn, 6, 0)
+	require.Equal(t, wasiErrnoSuccess, errno)
+
+	errno = callErrno(t, i, "write")
+	require.Equal(t, wasiErrnoRofs, errno)
+
+	require.NoFileExists(t, filepath.Join(dir, "out.txt"))
+	require.NoDirExists(t, filepath.Join(dir, "newdir"))
+
+	d, err := os.ReadFile(filepath.Join(dir, "in.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "input", string(d))
+}
+
+func TestReadWriteVolumeAllowsWrites(t *testing.T) {
+	i, dir := setupVolumeInstance(t, false)
+
+	errno := callErrno(t, i, "open", fdData, pathOut, 7, wasiOflagsCreat)
+	require.Equal(t, wasiErrnoSuccess, errno)
+
+	errno = callErrno(t, i, "write")
+	require.Equal(t, wasiErrnoSuccess, errno)
+
+	errno = callErrno(t, i, "mkdir", fdData, pathNewDir, 6)
+	require.Equal(t, wasiErrnoSuccess, errno)
+
+	d, err := os.ReadFile(filepath.Join(dir, "out.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "hi", string(d))
+	require.DirExists(t, filepath.Join(dir, "newdir"))
+}
+
+func TestVolumePreventsPathTraversal(t *testing.T) {
+	i, dir := setupVolumeInstance(t, false)
+
+	outside := t.TempDir()
+	err := os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644)
+	require.NoError(t, err)
+
+	err = os.Symlink(outside, filepath.Join(dir, "escape"))
+	require.NoError(t, err)
+
+	errno := callErrno(t, i, "open", fdData, pathEscape, 17, 0)
+	require.Equal(t, wasiErrnoNotCapable, errno)
+
+	errno = callErrno(t, i, "open", fdData, pathParent, 9, 0)
+	require.Equal(t, wasiErrnoNotCapable, errno)
+}
+
+func TestRegisterPluginValidatesVolumes(t *testing.T) {
+	e := New(logger.New(nil, nil, nil, nil))
+	wasm := watToWasm(t, watVolumes)
+
+	file := filepath.Join(t.TempDir(), "file")
+	err := os.WriteFile(file, []byte{}, 0644)
+	require.NoError(t, err)
+
+	tt := map[string]*PluginConfig{
+		"missing host path": {Volumes: map[string]string{"/data": filepath.Join(t.TempDir(), "missing")}},
+		"host path is file": {Volumes: map[string]string{"/data": file}},
+		"nested guest path": {Volumes: map[string]string{"/data/nested": t.TempDir()}},
+		"root guest path":   {Volumes: map[string]string{"/": t.TempDir()}},
+		"workspace":         {ReadOnlyVolumes: map[string]string{"/workspace": t.TempDir()}},
+		"duplicate": {
+			Volumes: map[string]string{"/data": t.TempDir(), "data/.": t.TempDir()},
+		},
+		"read only duplicate": {
+			Volumes:         map[string]string{"/data": t.TempDir()},
+			ReadOnlyVolumes: map[string]string{"/data": t.TempDir()},
+		},
+		"read only same directory": {
+			Volumes:         map[string]string{"/data": t.TempDir()},
+			ReadOnlyVolumes: map[string]string{"data/.": t.TempDir()},
+		},
+	}
+
+	for name, conf := range tt {
+		t.Run(name, func(t *testing.T) {
+			err := e.RegisterPluginBytes("test", wasm, conf)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestVolumeChecksModulesImportingWasiUnstable(t *testing.T) {
+	wat := strings.ReplaceAll(watVolumes, wasiNamespace, wasiUnstableNamespace)
+
+	i, dir := setupVolumeInstanceWithWat(t, wat, false)
+
+	outside := t.TempDir()
+	err := os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644)
+	require.NoError(t, err)
+
+	err = os.Symlink(outside, filepath.Join(dir, "escape"))
+	require.NoError(t, err)
+
+	require.Equal(t, wasiErrnoSuccess, callErrno(t, i, "open", fdData, pathIn, 6, 0))
+	require.Equal(t, wasiErrnoNotCapable, callErrno(t, i, "open", fdData, pathEscape, 17, 0))
+	require.Equal(t, wasiErrnoNotCapable, callErrno(t, i, "open", fdData, pathParent, 9, 0))
+
+	i, _ = setupVolumeInstanceWithWat(t, wat, true)
+	require.Equal(t, wasiErrnoRofs, callErrno(t, i, "open", fdData, pathOut, 7, wasiOflagsCreat))
+}
+
+func TestRegisterPluginRejectsUnsupportedWasiVersions(t *testing.T) {
+	e := New(logger.New(nil, nil, nil, nil))
+	conf := &PluginConfig{Volumes: map[string]string{"/data": t.TempDir()}}
+
+	tt := map[string]string{
+		"unknown version": strings.ReplaceAll(watVolumes, wasiNamespace, "wasi_snapshot_preview2"),
+		"both versions":   strings.Replace(watVolumes, wasiNamespace, wasiUnstableNamespace, 1),
+	}
+
+	for name, wat := range tt {
+		t.Run(name, func(t *testing.T) {
+			err := e.RegisterPluginBytes("test", watToWasm(t, wat), conf)
+			require.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+// InstanceOptions configures a single instance of a plugin, the options override
+// the PluginConfig for the plugin
+type InstanceOptions struct {
+	// WorkspaceDir is an optional directory that is mounted to /workspace in the module
+	WorkspaceDir string
+	// Workspace is an optional Workspace that is mounted to /workspace in the module, the
+	// plugin can lock files in the workspace. Workspace can not be used with WorkspaceDir.
+	Workspace *Workspace
+	// Filesystems are in-memory filesystems mounted into the instance, keyed by the guest
+	// path in the same way as PluginConfig.Volumes
+	Filesystems map[string]*MemFS
+
+	// Environment variables for the instance, the variables are added to the variables
+	// in the PluginConfig replacing any with the same name
+	Environment map[string]string
+	// Args replace PluginConfig.Args when not nil
+	Args []string
+	// Stdin replaces PluginConfig.Stdin when not nil
+	Stdin io.Reader
+}
+
+// ExitError is returned when a WASI module exits with a non zero exit code, i.e.
+// when a command style module returns an error from main
+type ExitError struct {
+	// Function is the function that was called when the module exited
+	Function string
+	// Code is the exit code passed to proc_exit
+	Code int
+}
+
+// Error implements the error interface
+func (e ExitError) Error() string {
+	return fmt.Sprintf("function %s exited with code %d", e.Function, e.Code)
+}
+
+// wasiExit matches the message of the trap raised by Wasmer for proc_exit
+var wasiExit = regexp.MustCompile(`WASI exited with code: (\d+)`)
+
+// exitCode returns the exit code when the trap was raised by proc_exit
+func exitCode(trap *wasmer.TrapError) (int, bool) {
+	m := wasiExit.FindStringSubmatch(trap.Error())
+	if m == nil {
+		return 0, false
+	}
+
+	code, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0, false
+	}
+
+	return code, true
+}
+
+// environment returns the environment variables for an instance, host variables
+// are inherited when they match inheritEnv then the variables from the plugin and
+// the instance are added in order
+func environment(inheritEnv []string, plugin, instance map[string]string) map[string]string {
+	env := map[string]string{}
+
+	for _, kv := range os.Environ() {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 && inherited(inheritEnv, parts[0]) {
+			env[parts[0]] = parts[1]
+		}
+	}
+
+	for k, v := range plugin {
+		env[k] = v
+	}
+
+	for k, v := range instance {
+		env[k] = v
+	}
+
+	return env
+}
+
+// inherited returns true when the host environment variable is in the allow list,
+// entries ending in * match any variable with the prefix
+func inherited(allow []string, name string) bool {
+	for _, a := range allow {
+		if a == name || (strings.HasSuffix(a, "*") && strings.HasPrefix(name, strings.TrimSuffix(a, "*"))) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newWasiState creates the builder for the WASI environment of an instance, the
+// name of the plugin is passed to the module as the first argument
+func newWasiState(name string, config *PluginConfig, opts InstanceOptions) *wasmer.WasiStateBuilder {
+	wasi := wasmer.NewWasiStateBuilder(name)
+
+	args := config.Args
+	if opts.Args != nil {
+		args = opts.Args
+	}
+
+	for _, a := range args {
+		wasi.Argument(a)
+	}
+
+	env := environment(config.InheritEnv, config.Environment, opts.Environment)
+
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		wasi.Environment(k, env[k])
+	}
+
+	return wasi
+}
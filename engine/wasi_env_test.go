@@ -0,0 +1,190 @@
+package engine
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nicholasjackson/wasp/engine/logger"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+// watCommand is a command style module, _start copies stdin to stdout and exits with
+// the number of arguments after the program name, args and env write the arguments
+// and environment to stdout separated by null bytes
+var watCommand = `
+(module
+	(import "wasi_snapshot_preview1" "proc_exit" (func $proc_exit (param i32)))
+	(import "wasi_snapshot_preview1" "fd_read"
+		(func $fd_read (param i32 i32 i32 i32) (result i32)))
+	(import "wasi_snapshot_preview1" "fd_write"
+		(func $fd_write (param i32 i32 i32 i32) (result i32)))
+	(import "wasi_snapshot_preview1" "args_sizes_get"
+		(func $args_sizes_get (param i32 i32) (result i32)))
+	(import "wasi_snapshot_preview1" "args_get"
+		(func $args_get (param i32 i32) (result i32)))
+	(import "wasi_snapshot_preview1" "environ_sizes_get"
+		(func $environ_sizes_get (param i32 i32) (result i32)))
+	(import "wasi_snapshot_preview1" "environ_get"
+		(func $environ_get (param i32 i32) (result i32)))
+	(memory (export "memory") 1)
+
+	;; print writes size bytes at 0x1000 to stdout
+	(func $print (param $size i32)
+		(i32.store (i32.const 0x20) (i32.const 0x1000))
+		(i32.store (i32.const 0x24) (local.get $size))
+		(drop (call $fd_write (i32.const 1) (i32.const 0x20) (i32.const 1) (i32.const 0x28))))
+
+	(func (export "_start")
+		(local $read i32)
+		(i32.store (i32.const 0x20) (i32.const 0x1000))
+		(i32.store (i32.const 0x24) (i32.const 0x400))
+		(loop $copy
+			(drop (call $fd_read (i32.const 0) (i32.const 0x20) (i32.const 1) (i32.const 0x28)))
+			(local.set $read (i32.load (i32.const 0x28)))
+			(if (i32.gt_u (local.get $read) (i32.const 0))
+				(then
+					(call $print (local.get $read))
+					(i32.store (i32.const 0x24) (i32.const 0x400))
+					(br $copy))))
+		(drop (call $args_sizes_get (i32.const 0x10) (i32.const 0x14)))
+		(call $proc_exit (i32.sub (i32.load (i32.const 0x10)) (i32.const 1))))
+
+	(func (export "args")
+		(drop (call $args_sizes_get (i32.const 0x10) (i32.const 0x14)))
+		(drop (call $args_get (i32.const 0x100) (i32.const 0x1000)))
+		(call $print (i32.load (i32.const 0x14))))
+
+	(func (export "env")
+		(drop (call $environ_sizes_get (i32.const 0x10) (i32.const 0x14)))
+		(drop (call $environ_get (i32.const 0x100) (i32.const 0x1000)))
+		(call $print (i32.load (i32.const 0x14)))))
+`
+
+func setupCommandInstance(t *testing.T, conf *PluginConfig, opts InstanceOptions) Instance {
+	conf.Stdout = OutputBuffer()
+
+	e := New(logger.New(nil, nil, nil, nil))
+
+	err := e.RegisterPluginBytes("command", watToWasm(t, watCommand), conf)
+	require.NoError(t, err)
+
+	i, err := e.GetInstanceWithOptions("command", opts)
+	require.NoError(t, err)
+
+	return i
+}
+
+// nullSeparated splits the null terminated strings written by the module
+func nullSeparated(b []byte) []string {
+	return strings.Split(strings.TrimSuffix(string(b), "\x00"), "\x00")
+}
+
+func TestStartCopiesStdinAndExits(t *testing.T) {
+	i := setupCommandInstance(t, &PluginConfig{Stdin: strings.NewReader("hello world")}, InstanceOptions{})
+
+	err := i.CallFunction("_start", nil)
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(i.Stdout()))
+}
+
+func TestStartDoesNotReadHostStdin(t *testing.T) {
+	// Wasmer reads the stdin of the process so the test runs in a new process with stdin set
+	if os.Getenv("WASP_TEST_HOST_STDIN") != "" {
+		i := setupCommandInstance(t, &PluginConfig{}, InstanceOptions{})
+
+		err := i.CallFunction("_start", nil)
+		require.NoError(t, err)
+		require.Empty(t, i.Stdout())
+
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestStartDoesNotReadHostStdin$")
+	cmd.Env = append(os.Environ(), "WASP_TEST_HOST_STDIN=1")
+	cmd.Stdin = strings.NewReader("HOST-SECRET\n")
+
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+}
+
+func TestStartReturnsExitError(t *testing.T) {
+	i := setupCommandInstance(t, &PluginConfig{Args: []string{"one", "two"}}, InstanceOptions{})
+
+	err := i.CallFunction("_start", nil)
+
+	ee := ExitError{}
+	require.True(t, xerrors.As(err, &ee), "expected ExitError, got %v", err)
+	require.Equal(t, 2, ee.Code)
+	require.Equal(t, "_start", ee.Function)
+}
+
+func TestInstanceOptionsOverrideStdinAndArgs(t *testing.T) {
+	conf := &PluginConfig{
+		Args:  []string{"one"},
+		Stdin: strings.NewReader("plugin"),
+	}
+
+	i := setupCommandInstance(t, conf, InstanceOptions{Args: []string{"a", "b"}, Stdin: strings.NewReader("instance")})
+
+	err := i.CallFunction("args", nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"command", "a", "b"}, nullSeparated(i.Stdout()))
+
+	err = i.CallFunction("_start", nil)
+	require.Error(t, err)
+	require.True(t, strings.HasSuffix(string(i.Stdout()), "instance"))
+}
+
+func TestEnvironmentIsInheritedAndOverridden(t *testing.T) {
+	os.Setenv("WASP_TEST_ALLOWED", "host")
+	os.Setenv("WASP_TEST_PREFIX_ONE", "one")
+	os.Setenv("WASP_TEST_DENIED", "secret")
+	defer func() {
+		os.Unsetenv("WASP_TEST_ALLOWED")
+		os.Unsetenv("WASP_TEST_PREFIX_ONE")
+		os.Unsetenv("WASP_TEST_DENIED")
+	}()
+
+	conf := &PluginConfig{
+		InheritEnv:  []string{"WASP_TEST_ALLOWED", "WASP_TEST_PREFIX_*"},
+		Environment: map[string]string{"PLUGIN": "plugin", "OVERRIDE": "plugin"},
+	}
+
+	i := setupCommandInstance(t, conf, InstanceOptions{Environment: map[string]string{"OVERRIDE": "instance"}})
+
+	err := i.CallFunction("env", nil)
+	require.NoError(t, err)
+
+	require.ElementsMatch(t, []string{
+		"OVERRIDE=instance",
+		"PLUGIN=plugin",
+		"WASP_TEST_ALLOWED=host",
+		"WASP_TEST_PREFIX_ONE=one",
+	}, nullSeparated(i.Stdout()))
+}
+
+func TestGetInstanceWithOptionsCleansUpWhenInstanceFails(t *testing.T) {
+	scratch := func() []string {
+		dirs, err := filepath.Glob(filepath.Join(os.TempDir(), "wasp-instance-*"))
+		require.NoError(t, err)
+
+		return dirs
+	}
+
+	before := scratch()
+
+	e := New(logger.New(nil, nil, nil, nil))
+
+	// the codec for the plugin does not match so the instance fails after it is created
+	err := e.RegisterPluginBytes("test", watToWasm(t, watCodecName), nil)
+	require.NoError(t, err)
+
+	_, err = e.GetInstanceWithOptions("test", InstanceOptions{Filesystems: map[string]*MemFS{"/files": NewMemFS(nil)}})
+	require.ErrorAs(t, err, &CodecMismatchError{})
+
+	require.Equal(t, before, scratch())
+}
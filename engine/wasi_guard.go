@@ -0,0 +1,727 @@
+package engine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/wasmerio/wasmer-go/wasmer"
+	"golang.org/x/xerrors"
+)
+
+// wasiNamespace is the namespace of the WASI functions checked by the guard
+const wasiNamespace = "wasi_snapshot_preview1"
+
+// wasiUnstableNamespace is the namespace of the previous version of WASI, the functions
+// replaced by the guard have the same parameters in both versions. Virtual filesystems
+// are only supported for wasiNamespace as the structures written by the MemFS differ.
+const wasiUnstableNamespace = "wasi_unstable"
+
+// wasiGuardNamespace returns the WASI namespace in the imported namespaces that is replaced
+// by the guard, an empty string is returned when no WASI namespace is imported. Modules
+// importing another version of WASI, or more than one version, would access files and
+// stdio without being checked by the guard and an error is returned.
+func wasiGuardNamespace(namespaces []string) (string, error) {
+	namespace := ""
+	for _, ns := range namespaces {
+		if !strings.HasPrefix(ns, "wasi_") || ns == namespace {
+			continue
+		}
+
+		if ns != wasiNamespace && ns != wasiUnstableNamespace {
+			return "", xerrors.Errorf("module imports %s, only %s and %s are supported", ns, wasiNamespace, wasiUnstableNamespace)
+		}
+
+		if namespace != "" {
+			return "", xerrors.Errorf("module imports both %s and %s", namespace, ns)
+		}
+
+		namespace = ns
+	}
+
+	return namespace, nil
+}
+
+// WASI error numbers returned by the guard
+const (
+	wasiErrnoSuccess    int32 = 0
+	wasiErrnoFault      int32 = 21
+	wasiErrnoIO         int32 = 29
+	wasiErrnoRofs       int32 = 69
+	wasiErrnoNotCapable int32 = 76
+)
+
+// WASI flags used by the guard
+const (
+	wasiLookupSymlinkFollow int32 = 1
+
+	wasiOflagsCreat int32 = 1
+	wasiOflagsExcl  int32 = 4
+	wasiOflagsTrunc int32 = 8
+)
+
+// wasiGuardFunctions are the parameters for the WASI functions that are checked by the
+// guard, all the functions return an errno
+var wasiGuardFunctions = map[string]string{
+	"path_open":               "i32 i32 i32 i32 i32 i64 i64 i32 i32",
+	"path_create_directory":   "i32 i32 i32",
+	"path_remove_directory":   "i32 i32 i32",
+	"path_unlink_file":        "i32 i32 i32",
+	"path_rename":             "i32 i32 i32 i32 i32 i32",
+	"path_link":               "i32 i32 i32 i32 i32 i32 i32",
+	"path_symlink":            "i32 i32 i32 i32 i32",
+	"path_filestat_get":       "i32 i32 i32 i32 i32",
+	"path_filestat_set_times": "i32 i32 i32 i32 i64 i64 i32",
+	"path_readlink":           "i32 i32 i32 i32 i32 i32",
+	"fd_write":                "i32 i32 i32 i32",
+	"fd_read":                 "i32 i32 i32 i32",
+	"fd_pwrite":               "i32 i32 i32 i64 i32",
+	"fd_pread":                "i32 i32 i32 i64 i32",
+	"fd_seek":                 "i32 i64 i32 i32",
+	"fd_tell":                 "i32 i32",
+	"fd_readdir":              "i32 i32 i32 i64 i32",
+	"fd_allocate":             "i32 i64 i64",
+	"fd_advise":               "i32 i64 i64 i32",
+	"fd_sync":                 "i32",
+	"fd_datasync":             "i32",
+	"fd_fdstat_get":           "i32 i32",
+	"fd_fdstat_set_flags":     "i32 i32",
+	"fd_fdstat_set_rights":    "i32 i64 i64",
+	"fd_filestat_get":         "i32 i32",
+	"fd_filestat_set_size":    "i32 i64",
+	"fd_filestat_set_times":   "i32 i64 i64 i32",
+	"fd_close":                "i32",
+	"fd_renumber":             "i32 i32",
+	"fd_prestat_get":          "i32 i32",
+	"fd_prestat_dir_name":     "i32 i32 i32",
+}
+
+// wasiGuardHelper returns the module used to call the WASI functions in the namespace that
+// are replaced by the guard. Wasmer only initializes the WASI functions that are imported by
+// an instance, the helper imports the functions and the memory of the plugin instance and
+// exports the functions so that they can be called by the guard.
+func (w *Wasm) wasiGuardHelper(namespace string) (*wasmer.Module, error) {
+	w.helperMutex.Lock()
+	defer w.helperMutex.Unlock()
+
+	if m, ok := w.helpers[namespace]; ok {
+		return m, nil
+	}
+
+	wat := "(module\n\t(import \"env\" \"memory\" (memory 0))\n\t(export \"memory\" (memory 0))\n"
+	for name, params := range wasiGuardFunctions {
+		wat += fmt.Sprintf(
+			"\t(import %q %q (func $%s (param %s) (result i32)))\n\t(export %q (func $%s))\n",
+			namespace, name, name, params, name, name,
+		)
+	}
+	wat += ")"
+
+	wasm, err := wasmer.Wat2Wasm(wat)
+	if err != nil {
+		return nil, xerrors.Errorf("unable to create WASI guard: %w", err)
+	}
+
+	m, err := wasmer.NewModule(w.store, wasm)
+	if err != nil {
+		return nil, xerrors.Errorf("unable to create WASI guard: %w", err)
+	}
+
+	if w.helpers == nil {
+		w.helpers = map[string]*wasmer.Module{}
+	}
+
+	w.helpers[namespace] = m
+
+	return m, nil
+}
+
+// wasiMount is a host directory mounted into the module filesystem
+type wasiMount struct {
+	// name is the directory in the root of the module filesystem
+	name string
+	// hostPath is the directory on the host and root is the resolved host path
+	hostPath string
+	root     string
+	readOnly bool
+}
+
+// wasiFile is an open file descriptor for a file or directory in a mount
+type wasiFile struct {
+	// mount is nil for the root of the module filesystem
+	mount *wasiMount
+	// path is relative to the root of the mount
+	path string
+}
+
+// wasiGuard replaces the WASI filesystem functions for an instance, and checks that the
+// module does not modify files in read only volumes, or access files outside of a mount
+// using symlinks or relative paths. When the stdout or stderr of the instance is captured
+// the guard writes the output to the writer for the instance, files in a virtual mount
+// are read and written by the guard using the MemFS for the mount.
+//
+// The guard tracks the mount for each file descriptor opened by the module, file
+// descriptors that are not in a mount are passed to Wasmer without being checked.
+type wasiGuard struct {
+	instance *wasmerInstance
+	mounts   []*wasiMount
+
+	// stdio are the writers for the captured stdout and stderr file descriptors
+	stdio map[int32]io.Writer
+	// stdin are the readers for the stdin file descriptor
+	stdin map[int32]io.Reader
+
+	// virtual are the MemFS mounts and vfs the open files in the mounts
+	virtual []*virtualMount
+	vfs     map[int32]*virtualFile
+
+	memory *wasmer.Memory
+	funcs  map[string]*wasmer.Function
+
+	mutex sync.Mutex
+	files map[int32]wasiFile
+}
+
+// newWasiGuard adds the guard functions for the WASI namespace to the import object for the module
+func newWasiGuard(
+	store *wasmer.Store,
+	helper, module *wasmer.Module,
+	namespace string,
+	io *wasmer.ImportObject,
+	i *wasmerInstance,
+	mounts []*wasiMount,
+	stdio map[int32]io.Writer,
+	stdin map[int32]io.Reader,
+	virtual []*virtualMount,
+) *wasiGuard {
+	g := &wasiGuard{
+		instance: i,
+		mounts:   mounts,
+		stdio:    stdio,
+		stdin:    stdin,
+		virtual:  virtual,
+		vfs:      map[int32]*virtualFile{},
+		files:    map[int32]wasiFile{},
+		funcs:    map[string]*wasmer.Function{},
+	}
+
+	imported := map[string]bool{}
+	for _, imp := range module.Imports() {
+		if imp.Module() == namespace {
+			imported[imp.Name()] = true
+		}
+	}
+
+	externs := map[string]wasmer.IntoExtern{}
+	for _, imp := range helper.Imports() {
+		if imp.Module() != namespace || !imported[imp.Name()] {
+			continue
+		}
+
+		name := imp.Name()
+		ft := imp.Type().IntoFunctionType()
+
+		externs[name] = wasmer.NewFunction(store, ft, func(args []wasmer.Value) ([]wasmer.Value, error) {
+			return []wasmer.Value{wasmer.NewI32(g.call(name, args))}, nil
+		})
+	}
+
+	io.Register(namespace, externs)
+
+	return g
+}
+
+// attach creates the helper instance for the plugin instance and finds the
+// file descriptors for the mounts
+func (g *wasiGuard) attach(store *wasmer.Store, helper *wasmer.Module, wasi *wasmer.WasiEnvironment, instance *wasmer.Instance) error {
+	mem, err := instance.Exports.GetMemory("memory")
+	if err != nil {
+		return xerrors.Errorf("unable to mount volumes, ensure the Wasm module exports the memory named 'memory': %w", err)
+	}
+
+	io, err := wasi.GenerateImportObject(store, helper)
+	if err != nil {
+		return xerrors.Errorf("unable to create WASI guard: %w", err)
+	}
+
+	io.Register("env", map[string]wasmer.IntoExtern{"memory": mem})
+
+	hi, err := wasmer.NewInstance(helper, io)
+	if err != nil {
+		return xerrors.Errorf("unable to create WASI guard: %w", err)
+	}
+
+	for name := range wasiGuardFunctions {
+		f, err := hi.Exports.GetRawFunction(name)
+		if err != nil {
+			return xerrors.Errorf("unable to create WASI guard: %w", err)
+		}
+
+		g.funcs[name] = f
+	}
+
+	g.memory = mem
+
+	return g.findPreopens()
+}
+
+// findPreopens finds the file descriptor for each mount, the names of the
+// preopened directories are written to the end of the module memory which is
+// restored afterwards
+func (g *wasiGuard) findPreopens() error {
+	errno := g.withScratch(func(scratch int32) int32 {
+		// file descriptors 0-2 are stdin, stdout and stderr, the preopened
+		// directories start at 3 and end with the first invalid descriptor
+		for fd := int32(3); ; fd++ {
+			if g.invoke("fd_prestat_get", fd, scratch) != wasiErrnoSuccess {
+				return wasiErrnoSuccess
+			}
+
+			size := int32(binary.LittleEndian.Uint32(g.memory.Data()[scratch+4:]))
+			if size <= 0 || size > wasiScratchSize-8 {
+				continue
+			}
+
+			if g.invoke("fd_prestat_dir_name", fd, scratch+8, size) != wasiErrnoSuccess {
+				continue
+			}
+
+			// Wasmer includes the null terminator in the length of the name
+			name := strings.Trim(string(g.memory.Data()[scratch+8:scratch+8+size]), "/\x00")
+			if name == "" {
+				g.files[fd] = wasiFile{}
+				continue
+			}
+
+			if m := g.mount(name); m != nil {
+				g.files[fd] = wasiFile{mount: m}
+			}
+
+			if m := g.virtualMount(name); m != nil {
+				m.fd = fd
+				g.vfs[fd] = &virtualFile{mount: m, path: ".", dir: true}
+			}
+		}
+	})
+
+	if errno != wasiErrnoSuccess {
+		return xerrors.Errorf("unable to mount volumes, the Wasm module memory is too small")
+	}
+
+	return nil
+}
+
+// wasiScratchSize is the size of the memory used by the guard to call WASI functions
+const wasiScratchSize = 512
+
+// withScratch calls fn with the address of an area of memory at the end of the
+// module memory, the contents of the memory are restored after fn returns
+func (g *wasiGuard) withScratch(fn func(scratch int32) int32) int32 {
+	data := g.memory.Data()
+	if len(data) < wasiScratchSize {
+		return wasiErrnoFault
+	}
+
+	scratch := int32(len(data) - wasiScratchSize)
+	saved := append([]byte{}, data[scratch:]...)
+	defer copy(g.memory.Data()[scratch:], saved)
+
+	return fn(scratch)
+}
+
+// mount returns the mount with the given name
+func (g *wasiGuard) mount(name string) *wasiMount {
+	for _, m := range g.mounts {
+		if m.name == name {
+			return m
+		}
+	}
+
+	return nil
+}
+
+// invoke calls the WASI function and returns the errno
+func (g *wasiGuard) invoke(name string, params ...interface{}) int32 {
+	r, err := g.funcs[name].Call(params...)
+	if err != nil {
+		// the WASI function trapped, errors can not be returned from a host function
+		// so the module is interrupted and the error returned from the function call
+		g.instance.setError(xerrors.Errorf("WASI function %s failed: %w", name, err))
+		g.instance.interrupt()
+
+		return wasiErrnoIO
+	}
+
+	return r.(int32)
+}
+
+// call checks the arguments for the WASI function and calls the function when
+// the operation is allowed
+func (g *wasiGuard) call(name string, args []wasmer.Value) int32 {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if name == "fd_write" {
+		if w, ok := g.stdio[args[0].I32()]; ok {
+			return g.writeStdio(w, args[1].I32(), args[2].I32(), args[3].I32())
+		}
+	}
+
+	if name == "fd_read" {
+		if r, ok := g.stdin[args[0].I32()]; ok {
+			return g.readStdin(r, args[1].I32(), args[2].I32(), args[3].I32())
+		}
+	}
+
+	if errno, ok := g.virtualCall(name, args); ok {
+		return errno
+	}
+
+	if errno := g.check(name, args); errno != wasiErrnoSuccess {
+		return errno
+	}
+
+	params := make([]interface{}, len(args))
+	for n, a := range args {
+		params[n] = a.Unwrap()
+	}
+
+	errno := g.invoke(name, params...)
+	if errno == wasiErrnoSuccess {
+		g.track(name, args)
+	}
+
+	return errno
+}
+
+// check returns an errno when the operation is not allowed
+func (g *wasiGuard) check(name string, args []wasmer.Value) int32 {
+	arg := func(n int) int32 { return args[n].I32() }
+
+	switch name {
+	case "path_open":
+		oflags := arg(4)
+		write := oflags&(wasiOflagsCreat|wasiOflagsExcl|wasiOflagsTrunc) != 0
+
+		// the path is always resolved as the file that is opened can be a symlink
+		return g.checkPath(arg(0), arg(2), arg(3), true, write)
+
+	case "path_create_directory", "path_remove_directory", "path_unlink_file":
+		return g.checkPath(arg(0), arg(1), arg(2), false, true)
+
+	case "path_rename":
+		if errno := g.checkPath(arg(0), arg(1), arg(2), false, true); errno != wasiErrnoSuccess {
+			return errno
+		}
+
+		return g.checkPath(arg(3), arg(4), arg(5), false, true)
+
+	case "path_link":
+		// a link to a file in a read only volume would allow the file to be modified
+		if errno := g.checkPath(arg(0), arg(2), arg(3), arg(1)&wasiLookupSymlinkFollow != 0, true); errno != wasiErrnoSuccess {
+			return errno
+		}
+
+		return g.checkPath(arg(4), arg(5), arg(6), false, true)
+
+	case "path_symlink":
+		return g.checkSymlink(arg(0), arg(1), arg(2), arg(3), arg(4))
+
+	case "path_filestat_get":
+		return g.checkPath(arg(0), arg(2), arg(3), arg(1)&wasiLookupSymlinkFollow != 0, false)
+
+	case "path_filestat_set_times":
+		return g.checkPath(arg(0), arg(2), arg(3), arg(1)&wasiLookupSymlinkFollow != 0, true)
+
+	case "path_readlink":
+		return g.checkPath(arg(0), arg(1), arg(2), false, false)
+
+	case "fd_write", "fd_pwrite", "fd_allocate", "fd_filestat_set_size", "fd_filestat_set_times":
+		if f, ok := g.files[arg(0)]; ok && f.mount != nil && f.mount.readOnly {
+			return wasiErrnoRofs
+		}
+	}
+
+	return wasiErrnoSuccess
+}
+
+// track records the file descriptors opened, closed or renumbered by a successful call
+func (g *wasiGuard) track(name string, args []wasmer.Value) {
+	arg := func(n int) int32 { return args[n].I32() }
+
+	switch name {
+	case "path_open":
+		m, p, ok, _ := g.resolve(arg(0), arg(2), arg(3), true)
+		if !ok {
+			return
+		}
+
+		data := g.memory.Data()
+		out := arg(8)
+		if out < 0 || len(data) < int(out)+4 {
+			return
+		}
+
+		fd := int32(binary.LittleEndian.Uint32(data[out:]))
+		g.files[fd] = wasiFile{mount: m, path: p}
+
+	case "fd_close":
+		delete(g.files, arg(0))
+		delete(g.stdio, arg(0))
+		delete(g.stdin, arg(0))
+
+	case "fd_renumber":
+		if f, ok := g.files[arg(0)]; ok {
+			g.files[arg(1)] = f
+		} else {
+			delete(g.files, arg(1))
+		}
+
+		if w, ok := g.stdio[arg(0)]; ok {
+			g.stdio[arg(1)] = w
+		} else {
+			delete(g.stdio, arg(1))
+		}
+
+		if r, ok := g.stdin[arg(0)]; ok {
+			g.stdin[arg(1)] = r
+		} else {
+			delete(g.stdin, arg(1))
+		}
+
+		if f, ok := g.vfs[arg(0)]; ok {
+			g.vfs[arg(1)] = f
+		} else {
+			delete(g.vfs, arg(1))
+		}
+
+		delete(g.files, arg(0))
+		delete(g.stdio, arg(0))
+		delete(g.stdin, arg(0))
+		delete(g.vfs, arg(0))
+	}
+}
+
+// writeStdio writes the iovecs to the writer for a captured stdout or stderr and
+// stores the number of bytes written at nwritten
+func (g *wasiGuard) writeStdio(w io.Writer, iovs, count, nwritten int32) int32 {
+	bufs, errno := g.iovecs(iovs, count, nwritten)
+	if errno != wasiErrnoSuccess {
+		return errno
+	}
+
+	written := 0
+	for _, b := range bufs {
+		c, err := w.Write(b)
+		written += c
+
+		if err != nil {
+			errno = wasiErrnoIO
+			break
+		}
+	}
+
+	binary.LittleEndian.PutUint32(g.memory.Data()[nwritten:], uint32(written))
+
+	return errno
+}
+
+// checkPath returns an errno when the path is outside of the mount, or when write
+// is true and the path is in a read only volume
+func (g *wasiGuard) checkPath(fd, ptr, size int32, follow, write bool) int32 {
+	m, _, _, errno := g.resolve(fd, ptr, size, follow)
+	if errno != wasiErrnoSuccess {
+		return errno
+	}
+
+	if write && m != nil && m.readOnly {
+		return wasiErrnoRofs
+	}
+
+	return wasiErrnoSuccess
+}
+
+// checkSymlink returns an errno when the symlink is created in a read only volume
+// or the target of the symlink is outside of the mount
+func (g *wasiGuard) checkSymlink(targetPtr, targetSize, fd, ptr, size int32) int32 {
+	m, p, ok, errno := g.resolve(fd, ptr, size, false)
+	if errno != wasiErrnoSuccess || !ok {
+		return errno
+	}
+
+	if m == nil {
+		return wasiErrnoNotCapable
+	}
+
+	if m.readOnly {
+		return wasiErrnoRofs
+	}
+
+	target, ok := g.readString(targetPtr, targetSize)
+	if !ok {
+		return wasiErrnoFault
+	}
+
+	if path.IsAbs(target) || escapes(path.Join(path.Dir(p), target)) {
+		return wasiErrnoNotCapable
+	}
+
+	return wasiErrnoSuccess
+}
+
+// resolve returns the mount and the path relative to the mount for the path opened
+// relative to the directory fd. When follow is true a symlink at the end of the path is
+// followed, symlinks in the directories of the path are always followed. ok is false
+// when the directory is not tracked by the guard, the mount is nil for the root of the
+// module filesystem. An errno is returned when the path is outside of the mount.
+func (g *wasiGuard) resolve(fd, ptr, size int32, follow bool) (*wasiMount, string, bool, int32) {
+	f, ok := g.files[fd]
+	if !ok {
+		return nil, "", false, wasiErrnoSuccess
+	}
+
+	p, ok := g.readString(ptr, size)
+	if !ok {
+		return nil, "", false, wasiErrnoFault
+	}
+
+	if path.IsAbs(p) {
+		return nil, "", false, wasiErrnoNotCapable
+	}
+
+	rel := path.Join(f.path, p)
+	if escapes(rel) {
+		return nil, "", false, wasiErrnoNotCapable
+	}
+
+	m := f.mount
+	if m == nil {
+		// paths opened from the root start with the name of the mount
+		parts := strings.SplitN(rel, "/", 2)
+		if parts[0] == "." {
+			return nil, "", true, wasiErrnoSuccess
+		}
+
+		m = g.mount(parts[0])
+		if m == nil {
+			return nil, "", false, wasiErrnoSuccess
+		}
+
+		rel = "."
+		if len(parts) == 2 {
+			rel = parts[1]
+		}
+	}
+
+	host := filepath.Join(m.root, filepath.FromSlash(rel))
+
+	check := host
+	if !follow && rel != "." {
+		check = filepath.Dir(host)
+	}
+
+	resolved, err := resolveExisting(check)
+	if err != nil {
+		return nil, "", false, wasiErrnoNotCapable
+	}
+
+	if resolved != m.root && !strings.HasPrefix(resolved, m.root+string(filepath.Separator)) {
+		return nil, "", false, wasiErrnoNotCapable
+	}
+
+	if check != host {
+		resolved = filepath.Join(resolved, filepath.Base(host))
+	}
+
+	rel, err = filepath.Rel(m.root, resolved)
+	if err != nil {
+		return nil, "", false, wasiErrnoNotCapable
+	}
+
+	return m, filepath.ToSlash(rel), true, wasiErrnoSuccess
+}
+
+// readStdin reads from stdin into the iovecs and stores the number of bytes read at
+// nread, reading stops at the first buffer that is not filled so that the module
+// does not block waiting for input that it has not asked for
+func (g *wasiGuard) readStdin(r io.Reader, iovs, count, nread int32) int32 {
+	bufs, errno := g.iovecs(iovs, count, nread)
+	if errno != wasiErrnoSuccess {
+		return errno
+	}
+
+	read := 0
+	for _, b := range bufs {
+		c, err := r.Read(b)
+		read += c
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			errno = wasiErrnoIO
+			break
+		}
+
+		if c < len(b) {
+			break
+		}
+	}
+
+	binary.LittleEndian.PutUint32(g.memory.Data()[nread:], uint32(read))
+
+	return errno
+}
+
+// readString reads the string from the module memory
+func (g *wasiGuard) readString(ptr, size int32) (string, bool) {
+	data := g.memory.Data()
+	if ptr < 0 || size < 0 || len(data) < int(ptr)+int(size) {
+		return "", false
+	}
+
+	return string(data[ptr : ptr+size]), true
+}
+
+// escapes returns true when the cleaned relative path is outside of its root
+func escapes(p string) bool {
+	return p == ".." || strings.HasPrefix(p, "../")
+}
+
+// resolveExisting resolves the symlinks in the path, the path does not need to exist
+// as the elements that do not exist are appended to the resolved path
+func resolveExisting(p string) (string, error) {
+	missing := []string{}
+
+	for {
+		_, err := os.Lstat(p)
+		if err == nil {
+			break
+		}
+
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+
+		parent := filepath.Dir(p)
+		if parent == p {
+			return "", err
+		}
+
+		missing = append([]string{filepath.Base(p)}, missing...)
+		p = parent
+	}
+
+	resolved, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(append([]string{resolved}, missing...)...), nil
+}
@@ -0,0 +1,731 @@
+package engine
+
+import (
+	"encoding/binary"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/wasmerio/wasmer-go/wasmer"
+	"golang.org/x/xerrors"
+)
+
+// WASI error numbers returned for the virtual filesystems
+const (
+	wasiErrnoBadf     int32 = 8
+	wasiErrnoExist    int32 = 20
+	wasiErrnoInval    int32 = 28
+	wasiErrnoIsDir    int32 = 31
+	wasiErrnoNoEnt    int32 = 44
+	wasiErrnoNotDir   int32 = 54
+	wasiErrnoNotEmpty int32 = 55
+	wasiErrnoNotSup   int32 = 58
+	wasiErrnoXdev     int32 = 75
+)
+
+// WASI constants used by the virtual filesystems
+const (
+	wasiFiletypeDirectory   = 3
+	wasiFiletypeRegularFile = 4
+
+	wasiOflagsDirectory int32 = 2
+
+	wasiFdflagsAppend int32 = 1
+
+	wasiRightsFdWrite int64 = 1 << 6
+	wasiRightsAll     int64 = 1<<29 - 1
+
+	wasiFstflagsMtim    int32 = 1 << 2
+	wasiFstflagsMtimNow int32 = 1 << 3
+
+	wasiWhenceSet = 0
+	wasiWhenceCur = 1
+	wasiWhenceEnd = 2
+)
+
+// virtualMount is a MemFS mounted into the module filesystem, the mount is backed by
+// an empty scratch directory so that Wasmer allocates the file descriptors
+type virtualMount struct {
+	name string
+	fs   *MemFS
+	// fd is the preopened file descriptor for the mount
+	fd int32
+}
+
+// virtualFile is a file descriptor for a file or directory in a virtual mount
+type virtualFile struct {
+	mount *virtualMount
+	// path is relative to the root of the MemFS
+	path string
+	dir  bool
+
+	// node is the file, writable is false for files opened without the write right
+	node     *memNode
+	writable bool
+	append   bool
+	offset   int64
+}
+
+// virtualCall implements the WASI function when the file descriptor is in a virtual
+// mount, ok is false when the call should be passed to Wasmer
+func (g *wasiGuard) virtualCall(name string, args []wasmer.Value) (errno int32, ok bool) {
+	if len(g.virtual) == 0 {
+		return 0, false
+	}
+
+	i32 := func(n int) int32 { return args[n].I32() }
+	i64 := func(n int) int64 { return args[n].I64() }
+
+	switch name {
+	case "path_open":
+		return g.virtualPath(i32(0), i32(2), i32(3), func(m *virtualMount, p string) int32 {
+			return g.virtualOpen(m, p, i32(4), i64(5), i32(7), i32(8))
+		})
+
+	case "path_filestat_get":
+		return g.virtualPath(i32(0), i32(2), i32(3), func(m *virtualMount, p string) int32 {
+			return g.virtualStat(m, p, i32(4))
+		})
+
+	case "path_filestat_set_times":
+		return g.virtualPath(i32(0), i32(2), i32(3), func(m *virtualMount, p string) int32 {
+			return g.virtualSetTimes(m, p, i64(5), i32(6))
+		})
+
+	case "path_create_directory":
+		return g.virtualPath(i32(0), i32(1), i32(2), func(m *virtualMount, p string) int32 {
+			return g.fsErrno(m, func() error { return m.fs.mkdir(p) })
+		})
+
+	case "path_remove_directory":
+		return g.virtualPath(i32(0), i32(1), i32(2), func(m *virtualMount, p string) int32 {
+			return g.fsErrno(m, func() error { return m.fs.remove(p, true) })
+		})
+
+	case "path_unlink_file":
+		return g.virtualPath(i32(0), i32(1), i32(2), func(m *virtualMount, p string) int32 {
+			return g.fsErrno(m, func() error { return m.fs.remove(p, false) })
+		})
+
+	case "path_readlink":
+		// the virtual filesystems do not contain symlinks
+		return g.virtualPath(i32(0), i32(1), i32(2), func(m *virtualMount, p string) int32 {
+			return g.fsErrno(m, func() error {
+				_, err := m.fs.entry(p)
+				if err != nil {
+					return err
+				}
+
+				return errInvalid
+			})
+		})
+
+	case "path_rename":
+		return g.virtualRename(i32(0), i32(1), i32(2), i32(3), i32(4), i32(5))
+
+	case "path_link":
+		return g.virtualLink(i32(0), i32(2), i32(3), i32(4), i32(5), i32(6))
+
+	case "path_symlink":
+		return g.virtualLink(i32(2), i32(3), i32(4), i32(2), i32(3), i32(4))
+
+	case "fd_close":
+		// the file descriptor is closed by Wasmer to release the number
+		delete(g.vfs, i32(0))
+		return 0, false
+	}
+
+	// the remaining functions operate on the file descriptor in the first argument
+	if !strings.HasPrefix(name, "fd_") || name == "fd_renumber" || strings.HasPrefix(name, "fd_prestat") {
+		return 0, false
+	}
+
+	f, ok := g.vfs[i32(0)]
+	if !ok {
+		return 0, false
+	}
+
+	m := f.mount.fs
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	switch name {
+	case "fd_read":
+		return g.virtualRead(f, i32(1), i32(2), -1, i32(3)), true
+	case "fd_pread":
+		return g.virtualRead(f, i32(1), i32(2), i64(3), i32(4)), true
+	case "fd_write":
+		return g.virtualWrite(f, i32(1), i32(2), -1, i32(3)), true
+	case "fd_pwrite":
+		return g.virtualWrite(f, i32(1), i32(2), i64(3), i32(4)), true
+	case "fd_seek":
+		return g.virtualSeek(f, i64(1), i32(2), i32(3)), true
+	case "fd_tell":
+		return g.virtualSeek(f, 0, wasiWhenceCur, i32(1)), true
+	case "fd_readdir":
+		return g.virtualReaddir(f, i32(1), i32(2), i64(3), i32(4)), true
+
+	case "fd_filestat_get":
+		e, err := m.entry(f.path)
+		if f.node != nil {
+			e, err = f.node.entry(path.Base(f.path)), nil
+		}
+
+		if err != nil {
+			return fsErrno(err), true
+		}
+
+		return g.writeFilestat(e, i32(1)), true
+
+	case "fd_fdstat_get":
+		return g.writeFdstat(f, i32(1)), true
+
+	case "fd_fdstat_set_flags":
+		f.append = i32(1)&wasiFdflagsAppend != 0
+		return wasiErrnoSuccess, true
+
+	case "fd_filestat_set_size":
+		if f.node == nil || !f.writable {
+			return wasiErrnoBadf, true
+		}
+
+		f.node.resize(i64(1))
+		return wasiErrnoSuccess, true
+
+	case "fd_allocate":
+		if f.node == nil || !f.writable {
+			return wasiErrnoBadf, true
+		}
+
+		if size := i64(1) + i64(2); size > int64(len(f.node.data)) {
+			f.node.resize(size)
+		}
+
+		return wasiErrnoSuccess, true
+
+	case "fd_filestat_set_times":
+		if f.node == nil {
+			return fsErrno(m.setModTime(f.path, wasiTime(i64(2), i32(3)))), true
+		}
+
+		if i32(3)&(wasiFstflagsMtim|wasiFstflagsMtimNow) != 0 {
+			f.node.modTime = wasiTime(i64(2), i32(3))
+		}
+
+		return wasiErrnoSuccess, true
+
+	case "fd_sync", "fd_datasync", "fd_advise", "fd_fdstat_set_rights":
+		return wasiErrnoSuccess, true
+	}
+
+	return wasiErrnoNotSup, true
+}
+
+// virtualPath resolves the path relative to the directory fd and calls fn with the
+// mount and the path relative to the root of the MemFS, ok is false when the path
+// is not in a virtual mount
+func (g *wasiGuard) virtualPath(fd, ptr, size int32, fn func(m *virtualMount, p string) int32) (int32, bool) {
+	m, p, ok, errno := g.resolveVirtual(fd, ptr, size)
+	if !ok || errno != wasiErrnoSuccess {
+		return errno, ok
+	}
+
+	if fn == nil {
+		return wasiErrnoSuccess, true
+	}
+
+	return fn(m, p), true
+}
+
+// resolveVirtual returns the mount and path for a path relative to the directory fd
+func (g *wasiGuard) resolveVirtual(fd, ptr, size int32) (*virtualMount, string, bool, int32) {
+	base, isVirtual := g.vfs[fd]
+	root, isRoot := g.files[fd]
+	if !isVirtual && !(isRoot && root.mount == nil) {
+		return nil, "", false, wasiErrnoSuccess
+	}
+
+	p, ok := g.readString(ptr, size)
+	if !ok {
+		return nil, "", isVirtual, wasiErrnoFault
+	}
+
+	if !isVirtual {
+		// paths opened from the root of the module filesystem start with the mount name
+		parts := strings.SplitN(path.Clean(p), "/", 2)
+
+		m := g.virtualMount(parts[0])
+		if m == nil || path.IsAbs(p) {
+			return nil, "", false, wasiErrnoSuccess
+		}
+
+		if len(parts) == 1 {
+			return m, ".", true, wasiErrnoSuccess
+		}
+
+		return m, parts[1], true, wasiErrnoSuccess
+	}
+
+	if path.IsAbs(p) {
+		return nil, "", true, wasiErrnoNotCapable
+	}
+
+	joined := path.Join(base.path, p)
+	if escapes(joined) {
+		return nil, "", true, wasiErrnoNotCapable
+	}
+
+	return base.mount, joined, true, wasiErrnoSuccess
+}
+
+// virtualMount returns the virtual mount with the given name
+func (g *wasiGuard) virtualMount(name string) *virtualMount {
+	for _, m := range g.virtual {
+		if m.name == name {
+			return m
+		}
+	}
+
+	return nil
+}
+
+// virtualOpen opens the file or directory and stores the new file descriptor at out,
+// out is checked first so that an invalid pointer does not create the file or use an fd
+func (g *wasiGuard) virtualOpen(m *virtualMount, p string, oflags int32, rights int64, fdflags, out int32) int32 {
+	if out < 0 || len(g.memory.Data()) < int(out)+4 {
+		return wasiErrnoFault
+	}
+
+	m.fs.mutex.Lock()
+	defer m.fs.mutex.Unlock()
+
+	f := &virtualFile{mount: m, path: p, append: fdflags&wasiFdflagsAppend != 0}
+	writable := rights&wasiRightsFdWrite != 0 || oflags&wasiOflagsTrunc != 0
+
+	e, err := m.fs.entry(p)
+	switch {
+	case err == nil && oflags&wasiOflagsCreat != 0 && oflags&wasiOflagsExcl != 0:
+		return wasiErrnoExist
+
+	case err != nil && oflags&wasiOflagsCreat == 0:
+		return fsErrno(err)
+
+	case err != nil:
+		f.node, err = m.fs.createFile(p, true)
+		if err != nil {
+			return fsErrno(err)
+		}
+
+		f.writable = true
+
+	case e.dir:
+		if oflags&wasiOflagsTrunc != 0 {
+			return wasiErrnoIsDir
+		}
+
+		f.dir = true
+
+	case oflags&wasiOflagsDirectory != 0:
+		return wasiErrnoNotDir
+
+	default:
+		f.node, err = m.fs.openFile(p, writable)
+		if err != nil {
+			return fsErrno(err)
+		}
+
+		f.writable = writable
+		if oflags&wasiOflagsTrunc != 0 {
+			f.node.resize(0)
+		}
+	}
+
+	fd, errno := g.reserveFd(m.fd)
+	if errno != wasiErrnoSuccess {
+		return errno
+	}
+
+	g.vfs[fd] = f
+
+	binary.LittleEndian.PutUint32(g.memory.Data()[out:], uint32(fd))
+
+	return wasiErrnoSuccess
+}
+
+// reserveFd opens the scratch directory for the mount so that Wasmer allocates
+// a file descriptor number that is not used by any other file
+func (g *wasiGuard) reserveFd(dirfd int32) (int32, int32) {
+	var fd int32
+
+	errno := g.withScratch(func(scratch int32) int32 {
+		data := g.memory.Data()
+		data[scratch] = '.'
+
+		errno := g.invoke(
+			"path_open",
+			dirfd, int32(0), scratch, int32(1), wasiOflagsDirectory, int64(0), int64(0), int32(0), scratch+8,
+		)
+		if errno == wasiErrnoSuccess {
+			fd = int32(binary.LittleEndian.Uint32(g.memory.Data()[scratch+8:]))
+		}
+
+		return errno
+	})
+
+	return fd, errno
+}
+
+// virtualStat writes the filestat for the path to out
+func (g *wasiGuard) virtualStat(m *virtualMount, p string, out int32) int32 {
+	m.fs.mutex.RLock()
+	defer m.fs.mutex.RUnlock()
+
+	e, err := m.fs.entry(p)
+	if err != nil {
+		return fsErrno(err)
+	}
+
+	return g.writeFilestat(e, out)
+}
+
+// virtualSetTimes sets the modification time for the path
+func (g *wasiGuard) virtualSetTimes(m *virtualMount, p string, mtim int64, flags int32) int32 {
+	if flags&(wasiFstflagsMtim|wasiFstflagsMtimNow) == 0 {
+		return g.virtualStat(m, p, -1)
+	}
+
+	return g.fsErrno(m, func() error { return m.fs.setModTime(p, wasiTime(mtim, flags)) })
+}
+
+// virtualRename renames a file or directory, both paths must be in the same MemFS
+func (g *wasiGuard) virtualRename(fd, ptr, size, newFd, newPtr, newSize int32) (int32, bool) {
+	m, p, ok, errno := g.resolveVirtual(fd, ptr, size)
+	nm, np, nok, nerrno := g.resolveVirtual(newFd, newPtr, newSize)
+
+	if !ok && !nok {
+		return 0, false
+	}
+
+	if errno != wasiErrnoSuccess {
+		return errno, true
+	}
+
+	if nerrno != wasiErrnoSuccess {
+		return nerrno, true
+	}
+
+	if !ok || !nok || m.fs != nm.fs {
+		return wasiErrnoXdev, true
+	}
+
+	return g.fsErrno(m, func() error { return m.fs.rename(p, np) }), true
+}
+
+// virtualLink returns an error for links in a virtual mount, links are not supported
+func (g *wasiGuard) virtualLink(fd, ptr, size, newFd, newPtr, newSize int32) (int32, bool) {
+	_, _, ok, _ := g.resolveVirtual(fd, ptr, size)
+	_, _, nok, _ := g.resolveVirtual(newFd, newPtr, newSize)
+
+	if !ok && !nok {
+		return 0, false
+	}
+
+	return wasiErrnoNotSup, true
+}
+
+// virtualRead reads from the file into the iovecs, when offset is -1 the current
+// offset is used and updated
+func (g *wasiGuard) virtualRead(f *virtualFile, iovs, count int32, offset int64, out int32) int32 {
+	if f.dir {
+		return wasiErrnoIsDir
+	}
+
+	bufs, errno := g.iovecs(iovs, count, out)
+	if errno != wasiErrnoSuccess {
+		return errno
+	}
+
+	pos := offset
+	if offset < 0 {
+		pos = f.offset
+	}
+
+	read := 0
+	for _, b := range bufs {
+		if pos >= int64(len(f.node.data)) {
+			break
+		}
+
+		c := copy(b, f.node.data[pos:])
+		pos += int64(c)
+		read += c
+	}
+
+	if offset < 0 {
+		f.offset = pos
+	}
+
+	binary.LittleEndian.PutUint32(g.memory.Data()[out:], uint32(read))
+
+	return wasiErrnoSuccess
+}
+
+// virtualWrite writes the iovecs to the file, when offset is -1 the current offset
+// is used and updated
+func (g *wasiGuard) virtualWrite(f *virtualFile, iovs, count int32, offset int64, out int32) int32 {
+	if f.dir {
+		return wasiErrnoIsDir
+	}
+
+	if !f.writable {
+		return wasiErrnoBadf
+	}
+
+	bufs, errno := g.iovecs(iovs, count, out)
+	if errno != wasiErrnoSuccess {
+		return errno
+	}
+
+	pos := offset
+	if offset < 0 {
+		pos = f.offset
+		if f.append {
+			pos = int64(len(f.node.data))
+		}
+	}
+
+	written := 0
+	for _, b := range bufs {
+		if end := pos + int64(len(b)); end > int64(len(f.node.data)) {
+			f.node.resize(end)
+		}
+
+		copy(f.node.data[pos:], b)
+		pos += int64(len(b))
+		written += len(b)
+	}
+
+	f.node.modTime = time.Now()
+
+	if offset < 0 {
+		f.offset = pos
+	}
+
+	binary.LittleEndian.PutUint32(g.memory.Data()[out:], uint32(written))
+
+	return wasiErrnoSuccess
+}
+
+// virtualSeek moves the offset of the file and stores the new offset at out
+func (g *wasiGuard) virtualSeek(f *virtualFile, delta int64, whence, out int32) int32 {
+	if f.dir {
+		return wasiErrnoBadf
+	}
+
+	pos := f.offset
+	switch whence {
+	case wasiWhenceSet:
+		pos = delta
+	case wasiWhenceCur:
+		pos += delta
+	case wasiWhenceEnd:
+		pos = int64(len(f.node.data)) + delta
+	default:
+		return wasiErrnoInval
+	}
+
+	if pos < 0 {
+		return wasiErrnoInval
+	}
+
+	data := g.memory.Data()
+	if out < 0 || len(data) < int(out)+8 {
+		return wasiErrnoFault
+	}
+
+	f.offset = pos
+	binary.LittleEndian.PutUint64(data[out:], uint64(pos))
+
+	return wasiErrnoSuccess
+}
+
+// virtualReaddir writes the directory entries starting at the cookie to the buffer,
+// the last entry is truncated when the buffer is full
+func (g *wasiGuard) virtualReaddir(f *virtualFile, buf, size int32, cookie int64, out int32) int32 {
+	if !f.dir {
+		return wasiErrnoNotDir
+	}
+
+	data := g.memory.Data()
+	if buf < 0 || size < 0 || len(data) < int(buf)+int(size) || out < 0 || len(data) < int(out)+4 {
+		return wasiErrnoFault
+	}
+
+	entries, err := f.mount.fs.list(f.path)
+	if err != nil {
+		return fsErrno(err)
+	}
+
+	used := 0
+	for n := cookie; n >= 0 && n < int64(len(entries)) && used < int(size); n++ {
+		e := entries[n]
+
+		// each entry is a 24 byte dirent followed by the name
+		dirent := make([]byte, 24, 24+len(e.name))
+		binary.LittleEndian.PutUint64(dirent[0:], uint64(n+1))
+		binary.LittleEndian.PutUint64(dirent[8:], e.ino)
+		binary.LittleEndian.PutUint32(dirent[16:], uint32(len(e.name)))
+		dirent[20] = wasiFiletype(e)
+		dirent = append(dirent, e.name...)
+
+		used += copy(data[int(buf)+used:int(buf)+int(size)], dirent)
+	}
+
+	binary.LittleEndian.PutUint32(data[out:], uint32(used))
+
+	return wasiErrnoSuccess
+}
+
+// writeFilestat writes the WASI filestat for the entry to out, nothing is
+// written when out is -1
+func (g *wasiGuard) writeFilestat(e memEntry, out int32) int32 {
+	if out == -1 {
+		return wasiErrnoSuccess
+	}
+
+	data := g.memory.Data()
+	if out < 0 || len(data) < int(out)+64 {
+		return wasiErrnoFault
+	}
+
+	st := data[out : out+64]
+	for n := range st {
+		st[n] = 0
+	}
+
+	mtim := uint64(e.modTime.UnixNano())
+
+	binary.LittleEndian.PutUint64(st[8:], e.ino)
+	st[16] = wasiFiletype(e)
+	binary.LittleEndian.PutUint64(st[24:], 1)
+	binary.LittleEndian.PutUint64(st[32:], uint64(e.size))
+	binary.LittleEndian.PutUint64(st[40:], mtim)
+	binary.LittleEndian.PutUint64(st[48:], mtim)
+	binary.LittleEndian.PutUint64(st[56:], mtim)
+
+	return wasiErrnoSuccess
+}
+
+// writeFdstat writes the WASI fdstat for the file to out
+func (g *wasiGuard) writeFdstat(f *virtualFile, out int32) int32 {
+	data := g.memory.Data()
+	if out < 0 || len(data) < int(out)+24 {
+		return wasiErrnoFault
+	}
+
+	st := data[out : out+24]
+	for n := range st {
+		st[n] = 0
+	}
+
+	st[0] = wasiFiletypeRegularFile
+	if f.dir {
+		st[0] = wasiFiletypeDirectory
+	}
+
+	if f.append {
+		binary.LittleEndian.PutUint16(st[2:], uint16(wasiFdflagsAppend))
+	}
+
+	rights := wasiRightsAll
+	if f.node != nil && !f.writable {
+		rights &^= wasiRightsFdWrite
+	}
+
+	binary.LittleEndian.PutUint64(st[8:], uint64(rights))
+	binary.LittleEndian.PutUint64(st[16:], uint64(wasiRightsAll))
+
+	return wasiErrnoSuccess
+}
+
+// iovecs returns the buffers for the iovecs in the module memory, out is the address
+// of the result which is checked so that it can be written without further checks
+func (g *wasiGuard) iovecs(iovs, count, out int32) ([][]byte, int32) {
+	data := g.memory.Data()
+	if iovs < 0 || count < 0 || len(data) < int(iovs)+int(count)*8 || out < 0 || len(data) < int(out)+4 {
+		return nil, wasiErrnoFault
+	}
+
+	bufs := make([][]byte, count)
+	for n := int32(0); n < count; n++ {
+		// each iovec is a pointer to the buffer and the length of the buffer
+		ptr := binary.LittleEndian.Uint32(data[iovs+n*8:])
+		size := binary.LittleEndian.Uint32(data[iovs+n*8+4:])
+		if uint64(ptr)+uint64(size) > uint64(len(data)) {
+			return nil, wasiErrnoFault
+		}
+
+		bufs[n] = data[ptr : ptr+size]
+	}
+
+	return bufs, wasiErrnoSuccess
+}
+
+// fsErrno locks the MemFS for the mount and converts the error returned by fn
+func (g *wasiGuard) fsErrno(m *virtualMount, fn func() error) int32 {
+	m.fs.mutex.Lock()
+	defer m.fs.mutex.Unlock()
+
+	return fsErrno(fn())
+}
+
+// fsErrno converts an error returned by a MemFS operation to a WASI errno
+func fsErrno(err error) int32 {
+	switch {
+	case err == nil:
+		return wasiErrnoSuccess
+	case xerrors.Is(err, fs.ErrNotExist):
+		return wasiErrnoNoEnt
+	case xerrors.Is(err, fs.ErrExist):
+		return wasiErrnoExist
+	case xerrors.Is(err, errNotDir):
+		return wasiErrnoNotDir
+	case xerrors.Is(err, errIsDir):
+		return wasiErrnoIsDir
+	case xerrors.Is(err, errNotEmpty):
+		return wasiErrnoNotEmpty
+	case xerrors.Is(err, errInvalid):
+		return wasiErrnoInval
+	}
+
+	return wasiErrnoIO
+}
+
+// wasiFiletype returns the WASI filetype for the entry
+func wasiFiletype(e memEntry) byte {
+	if e.dir {
+		return wasiFiletypeDirectory
+	}
+
+	return wasiFiletypeRegularFile
+}
+
+// wasiTime returns the time set by fd_filestat_set_times or path_filestat_set_times
+func wasiTime(mtim int64, flags int32) time.Time {
+	if flags&wasiFstflagsMtimNow != 0 {
+		return time.Now()
+	}
+
+	return time.Unix(0, mtim)
+}
+
+// resize changes the size of the file, new bytes are zero
+func (n *memNode) resize(size int64) {
+	if size <= int64(len(n.data)) {
+		n.data = n.data[:size]
+		return
+	}
+
+	n.data = append(n.data, make([]byte, size-int64(len(n.data)))...)
+}
@@ -0,0 +1,245 @@
+package engine
+
+import (
+	"encoding/binary"
+	"io/fs"
+	"os"
+	"testing"
+	"testing/fstest"
+
+	"github.com/nicholasjackson/wasp/engine/logger"
+	"github.com/stretchr/testify/require"
+)
+
+// watMemFS is a module that uses WASI to access the files in a virtual mount, paths
+// are passed as a pointer and length to the strings in the data segments
+var watMemFS = `
+(module
+	(import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+	(import "wasi_snapshot_preview1" "path_open"
+		(func $path_open (param i32 i32 i32 i32 i32 i64 i64 i32 i32) (result i32)))
+	(import "wasi_snapshot_preview1" "fd_read"
+		(func $fd_read (param i32 i32 i32 i32) (result i32)))
+	(import "wasi_snapshot_preview1" "fd_write"
+		(func $fd_write (param i32 i32 i32 i32) (result i32)))
+	(import "wasi_snapshot_preview1" "fd_close"
+		(func $fd_close (param i32) (result i32)))
+	(import "wasi_snapshot_preview1" "fd_readdir"
+		(func $fd_readdir (param i32 i32 i32 i64 i32) (result i32)))
+	(import "wasi_snapshot_preview1" "path_create_directory"
+		(func $path_create_directory (param i32 i32 i32) (result i32)))
+	(import "wasi_snapshot_preview1" "path_unlink_file"
+		(func $path_unlink_file (param i32 i32 i32) (result i32)))
+	(import "wasi_snapshot_preview1" "path_rename"
+		(func $path_rename (param i32 i32 i32 i32 i32 i32) (result i32)))
+	(memory (export "memory") 1)
+	(data (i32.const 0x100) "in.txt")
+	(data (i32.const 0x120) "out.txt")
+	(data (i32.const 0x140) "sub")
+	(data (i32.const 0x160) "sub/moved.txt")
+	(data (i32.const 0x180) "../x")
+	(data (i32.const 0x1a0) "files/out.txt")
+	(data (i32.const 0x300) "hi")
+	(data (i32.const 0x400) "\00\03\00\00\02\00\00\00")
+	(data (i32.const 0x420) "\00\06\00\00\40\00\00\00")
+
+	;; open opens the path relative to the directory fd and stores the new fd at 0x500
+	(func (export "open") (param $dir i32) (param $ptr i32) (param $len i32) (param $oflags i32) (param $rights i64) (result i32)
+		(call $path_open
+			(local.get $dir) (i32.const 1) (local.get $ptr) (local.get $len) (local.get $oflags)
+			(local.get $rights) (local.get $rights) (i32.const 0) (i32.const 0x500)))
+
+	;; open_to opens the path for writing like open and stores the new fd at out
+	(func (export "open_to") (param $dir i32) (param $ptr i32) (param $len i32) (param $oflags i32) (param $out i32) (result i32)
+		(call $path_open
+			(local.get $dir) (i32.const 1) (local.get $ptr) (local.get $len) (local.get $oflags)
+			(i64.const 0x42) (i64.const 0x42) (i32.const 0) (local.get $out)))
+
+	;; write writes hi to the last file opened
+	(func (export "write") (result i32)
+		(call $fd_write (i32.load (i32.const 0x500)) (i32.const 0x400) (i32.const 1) (i32.const 0x410)))
+
+	;; read reads up to 64 bytes from the last file opened to 0x600
+	(func (export "read") (result i32)
+		(call $fd_read (i32.load (i32.const 0x500)) (i32.const 0x420) (i32.const 1) (i32.const 0x410)))
+
+	(func (export "nbytes") (result i32)
+		(i32.load (i32.const 0x410)))
+
+	(func (export "close") (result i32)
+		(call $fd_close (i32.load (i32.const 0x500))))
+
+	;; readdir reads the entries of the directory fd to 0x800
+	(func (export "readdir") (param $dir i32) (result i32)
+		(call $fd_readdir (local.get $dir) (i32.const 0x800) (i32.const 0x400) (i64.const 0) (i32.const 0x410)))
+
+	(func (export "mkdir") (param $dir i32) (param $ptr i32) (param $len i32) (result i32)
+		(call $path_create_directory (local.get $dir) (local.get $ptr) (local.get $len)))
+
+	(func (export "unlink") (param $dir i32) (param $ptr i32) (param $len i32) (result i32)
+		(call $path_unlink_file (local.get $dir) (local.get $ptr) (local.get $len)))
+
+	(func (export "rename") (param $dir i32) (param $ptr i32) (param $len i32) (param $to i32) (param $tolen i32) (result i32)
+		(call $path_rename (local.get $dir) (local.get $ptr) (local.get $len) (local.get $dir) (local.get $to) (local.get $tolen))))
+`
+
+const (
+	fdFiles = 4
+
+	pathSub     = 0x140
+	pathMoved   = 0x160
+	pathEscapes = 0x180
+	pathFiles   = 0x1a0
+
+	rightsRead  = int64(1 << 1)
+	rightsWrite = int64(1<<1 | 1<<6)
+)
+
+func setupMemFSInstance(t *testing.T) (Instance, *MemFS, fstest.MapFS) {
+	base := fstest.MapFS{"in.txt": {Data: []byte("base")}}
+	m := NewMemFS(base)
+
+	e := New(logger.New(nil, nil, nil, nil))
+
+	err := e.RegisterPluginBytes("test", watToWasm(t, watMemFS), nil)
+	require.NoError(t, err)
+
+	i, err := e.GetInstanceWithOptions("test", InstanceOptions{Filesystems: map[string]*MemFS{"/files": m}})
+	require.NoError(t, err)
+
+	t.Cleanup(func() { i.Remove() })
+
+	return i, m, base
+}
+
+func memory(t *testing.T, i Instance) []byte {
+	mem, err := i.(*wasmerInstance).instance.Exports.GetMemory("memory")
+	require.NoError(t, err)
+
+	return mem.Data()
+}
+
+func TestMemFSReadFileFromBase(t *testing.T) {
+	i, _, _ := setupMemFSInstance(t)
+
+	require.Equal(t, wasiErrnoSuccess, callErrno(t, i, "open", fdFiles, pathIn, 6, 0, rightsRead))
+	require.Equal(t, wasiErrnoSuccess, callErrno(t, i, "read"))
+
+	n := callErrno(t, i, "nbytes")
+	require.Equal(t, "base", string(memory(t, i)[0x600:0x600+n]))
+
+	// files opened without the write right can not be written to
+	require.Equal(t, wasiErrnoBadf, callErrno(t, i, "write"))
+}
+
+func TestMemFSOpenChecksOutPointerBeforeCreatingFile(t *testing.T) {
+	i, m, _ := setupMemFSInstance(t)
+
+	require.Equal(t, wasiErrnoFault, callErrno(t, i, "open_to", fdFiles, pathOut, 7, wasiOflagsCreat, 0xfffe))
+
+	_, err := m.ReadFile("out.txt")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	// no file descriptor was used by the failed open
+	require.Equal(t, wasiErrnoSuccess, callErrno(t, i, "open", fdFiles, pathOut, 7, wasiOflagsCreat, rightsWrite))
+	require.Equal(t, uint32(fdFiles+1), binary.LittleEndian.Uint32(memory(t, i)[0x500:]))
+}
+
+func TestMemFSCreateAndWriteFile(t *testing.T) {
+	i, m, _ := setupMemFSInstance(t)
+
+	require.Equal(t, wasiErrnoSuccess, callErrno(t, i, "open", fdFiles, pathOut, 7, wasiOflagsCreat, rightsWrite))
+	require.Equal(t, wasiErrnoSuccess, callErrno(t, i, "write"))
+	require.Equal(t, wasiErrnoSuccess, callErrno(t, i, "close"))
+
+	d, err := m.ReadFile("out.txt")
+	require.NoError(t, err)
+	require.Equal(t, "hi", string(d))
+
+	// paths opened from the root of the module filesystem
+	require.Equal(t, wasiErrnoSuccess, callErrno(t, i, "open", fdRoot, pathFiles, 13, wasiOflagsTrunc, rightsWrite))
+	require.Equal(t, wasiErrnoSuccess, callErrno(t, i, "write"))
+	require.Equal(t, wasiErrnoSuccess, callErrno(t, i, "write"))
+
+	d, err = m.ReadFile("out.txt")
+	require.NoError(t, err)
+	require.Equal(t, "hihi", string(d))
+
+	// the scratch directory backing the mount is not modified
+	entries, err := os.ReadDir(i.(*wasmerInstance).volume)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestMemFSModifyDirectories(t *testing.T) {
+	i, m, base := setupMemFSInstance(t)
+
+	require.Equal(t, wasiErrnoSuccess, callErrno(t, i, "mkdir", fdFiles, pathSub, 3))
+	require.Equal(t, wasiErrnoExist, callErrno(t, i, "mkdir", fdFiles, pathSub, 3))
+	require.Equal(t, wasiErrnoSuccess, callErrno(t, i, "rename", fdFiles, pathIn, 6, pathMoved, 13))
+	require.Equal(t, wasiErrnoNoEnt, callErrno(t, i, "unlink", fdFiles, pathIn, 6))
+	require.Equal(t, wasiErrnoIsDir, callErrno(t, i, "unlink", fdFiles, pathSub, 3))
+
+	d, err := m.ReadFile("sub/moved.txt")
+	require.NoError(t, err)
+	require.Equal(t, "base", string(d))
+
+	_, err = m.Stat("in.txt")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	require.Contains(t, base, "in.txt")
+
+	require.Equal(t, wasiErrnoSuccess, callErrno(t, i, "unlink", fdFiles, pathMoved, 13))
+
+	_, err = m.Stat("sub/moved.txt")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestMemFSReadDirectory(t *testing.T) {
+	i, m, _ := setupMemFSInstance(t)
+
+	err := m.WriteFile("out.txt", []byte("out"), 0644)
+	require.NoError(t, err)
+
+	require.Equal(t, wasiErrnoSuccess, callErrno(t, i, "readdir", fdFiles))
+
+	data := memory(t, i)
+	used := int(binary.LittleEndian.Uint32(data[0x410:]))
+
+	names := []string{}
+	for offset := 0x800; offset < 0x800+used; {
+		size := int(binary.LittleEndian.Uint32(data[offset+16:]))
+		names = append(names, string(data[offset+24:offset+24+size]))
+		offset += 24 + size
+	}
+
+	require.Equal(t, []string{"in.txt", "out.txt"}, names)
+}
+
+func TestMemFSPreventsPathTraversal(t *testing.T) {
+	i, _, _ := setupMemFSInstance(t)
+
+	require.Equal(t, wasiErrnoNotCapable, callErrno(t, i, "open", fdFiles, pathEscapes, 4, 0, rightsRead))
+	require.Equal(t, wasiErrnoNotCapable, callErrno(t, i, "mkdir", fdFiles, pathEscapes, 4))
+}
+
+func TestGetInstanceValidatesFilesystems(t *testing.T) {
+	e := New(logger.New(nil, nil, nil, nil))
+
+	conf := &PluginConfig{Volumes: map[string]string{"/data": t.TempDir()}}
+	err := e.RegisterPluginBytes("test", watToWasm(t, watMemFS), conf)
+	require.NoError(t, err)
+
+	tt := map[string]map[string]*MemFS{
+		"volume":    {"/data": NewMemFS(nil)},
+		"workspace": {"/workspace": NewMemFS(nil)},
+		"nested":    {"/files/nested": NewMemFS(nil)},
+		"nil":       {"/files": nil},
+	}
+
+	for name, filesystems := range tt {
+		t.Run(name, func(t *testing.T) {
+			_, err := e.GetInstanceWithOptions("test", InstanceOptions{Filesystems: filesystems})
+			require.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package engine
+
+import (
+	"golang.org/x/xerrors"
+)
+
+// opcodes that are significant when instrumenting a function body
+const (
+	opUnreachable byte = 0x00
+	opBlock       byte = 0x02
+	opLoop        byte = 0x03
+	opIf          byte = 0x04
+	opElse        byte = 0x05
+	opEnd         byte = 0x0b
+	opBr          byte = 0x0c
+	opBrIf        byte = 0x0d
+	opBrTable     byte = 0x0e
+	opReturn      byte = 0x0f
+	opCall        byte = 0x10
+	opLocalGet    byte = 0x20
+	opLocalTee    byte = 0x22
+	opGlobalGet   byte = 0x23
+	opGlobalSet   byte = 0x24
+	opMemoryGrow  byte = 0x40
+	opI32Const    byte = 0x41
+	opI64Const    byte = 0x42
+	opF32Const    byte = 0x43
+	opF64Const    byte = 0x44
+	opI32Eq       byte = 0x46
+	opI64LtU      byte = 0x54
+	opI64Sub      byte = 0x7d
+	opPrefixMisc  byte = 0xfc
+	opPrefixSIMD  byte = 0xfd
+	opPrefixAtom  byte = 0xfe
+	blockTypeVoid byte = 0x40
+)
+
+// wasmInstruction is a single decoded instruction in a function body
+type wasmInstruction struct {
+	opcode byte
+	// start and end are the offsets of the encoded instruction in the body
+	start int
+	end   int
+	// index is the immediate for instructions that reference a function or memory
+	index uint32
+}
+
+// wasmFunctionBody is a decoded function from the code section
+type wasmFunctionBody struct {
+	// locals is the encoded local declarations
+	locals []byte
+	// code is the encoded expression for the function
+	code         []byte
+	instructions []wasmInstruction
+}
+
+// decodeFunctionBody decodes the function body from the code section
+// into its local declarations and instructions
+func decodeFunctionBody(body []byte) (*wasmFunctionBody, error) {
+	r := &wasmReader{data: body}
+
+	count := r.u32()
+	for n := uint32(0); n < count && r.err == nil; n++ {
+		r.u32()
+		r.byte()
+	}
+
+	if r.err != nil {
+		return nil, xerrors.Errorf("unable to read function locals: %w", r.err)
+	}
+
+	f := &wasmFunctionBody{locals: body[:r.pos], code: body[r.pos:]}
+
+	instructions, err := decodeInstructions(f.code)
+	if err != nil {
+		return nil, err
+	}
+
+	f.instructions = instructions
+
+	return f, nil
+}
+
+// decodeInstructions decodes the encoded expression into a list of instructions
+func decodeInstructions(code []byte) ([]wasmInstruction, error) {
+	r := &wasmReader{data: code}
+	instructions := []wasmInstruction{}
+
+	for !r.eof() {
+		in := wasmInstruction{start: r.pos}
+		in.opcode = r.byte()
+
+		switch op := in.opcode; {
+		case op == opBlock || op == opLoop || op == opIf:
+			r.blockType()
+
+		case op == opBr || op == opBrIf:
+			r.u32()
+
+		case op == opBrTable:
+			targets := r.u32()
+			for n := uint32(0); n <= targets && r.err == nil; n++ {
+				r.u32()
+			}
+
+		case op == opCall || op == 0x12: // call, return_call
+			in.index = r.u32()
+
+		case op == 0x11 || op == 0x13: // call_indirect, return_call_indirect
+			r.u32()
+			r.u32()
+
+		case op == 0x1c: // select t*
+			types := r.u32()
+			r.bytes(int(types))
+
+		case op >= 0x20 && op <= 0x26: // local, global and table get / set
+			r.u32()
+
+		case op >= 0x28 && op <= 0x3e: // load and store
+			r.memarg()
+
+		case op == 0x3f || op == opMemoryGrow: // memory.size, memory.grow
+			in.index = r.u32()
+
+		case op == opI32Const:
+			r.s32()
+
+		case op == opI64Const:
+			r.s64()
+
+		case op == 0x43: // f32.const
+			r.bytes(4)
+
+		case op == 0x44: // f64.const
+			r.bytes(8)
+
+		case op == 0xd0: // ref.null
+			r.byte()
+
+		case op == 0xd2: // ref.func
+			r.u32()
+
+		case op == opPrefixMisc:
+			r.miscImmediates()
+
+		case op == opPrefixSIMD:
+			r.simdImmediates()
+
+		case op == opPrefixAtom:
+			if r.u32() == 0x03 { // atomic.fence
+				r.byte()
+			} else {
+				r.memarg()
+			}
+
+		case op <= 0x01, // unreachable, nop
+			op == opElse, op == opEnd, op == opReturn,
+			op == 0x1a || op == 0x1b, // drop, select
+			op >= 0x45 && op <= 0xc4, // numeric instructions
+			op == 0xd1:               // ref.is_null
+
+		default:
+			return nil, xerrors.Errorf("unsupported instruction 0x%x at offset %d", op, in.start)
+		}
+
+		if r.err != nil {
+			return nil, xerrors.Errorf("unable to decode instruction 0x%x at offset %d: %w", in.opcode, in.start, r.err)
+		}
+
+		in.end = r.pos
+		instructions = append(instructions, in)
+	}
+
+	return instructions, nil
+}
+
+// blockType reads the block type for block, loop and if instructions
+func (r *wasmReader) blockType() {
+	if r.eof() {
+		r.err = errUnexpectedEOF
+		return
+	}
+
+	switch r.data[r.pos] {
+	case blockTypeVoid, valueI32, valueI64, valueF32, valueF64, 0x7b, 0x70, 0x6f:
+		r.pos++
+	default:
+		// index of a function type encoded as a signed 33 bit integer
+		r.sleb(33)
+	}
+}
+
+// memarg reads the alignment and offset for memory instructions
+func (r *wasmReader) memarg() {
+	r.u32()
+	r.u32()
+}
+
+// miscImmediates reads the immediates for instructions with the 0xfc prefix
+func (r *wasmReader) miscImmediates() {
+	switch op := r.u32(); {
+	case op <= 7: // saturating truncation
+	case op == 8: // memory.init
+		r.u32()
+		r.u32()
+	case op == 9: // data.drop
+		r.u32()
+	case op == 10: // memory.copy
+		r.u32()
+		r.u32()
+	case op == 11: // memory.fill
+		r.u32()
+	case op == 12 || op == 14: // table.init, table.copy
+		r.u32()
+		r.u32()
+	case op == 13 || (op >= 15 && op <= 17): // elem.drop, table.grow, table.size, table.fill
+		r.u32()
+	default:
+		r.err = xerrors.Errorf("unsupported instruction 0xfc %d", op)
+	}
+}
+
+// simdImmediates reads the immediates for instructions with the 0xfd prefix
+func (r *wasmReader) simdImmediates() {
+	switch op := r.u32(); {
+	case op <= 11: // v128 load and store
+		r.memarg()
+	case op == 12 || op == 13: // v128.const, i8x16.shuffle
+		r.bytes(16)
+	case op >= 21 && op <= 34: // extract and replace lane
+		r.byte()
+	case op >= 84 && op <= 91: // load and store lane
+		r.memarg()
+		r.byte()
+	case op == 92 || op == 93: // load zero
+		r.memarg()
+	}
+}
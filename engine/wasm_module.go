@@ -0,0 +1,613 @@
+package engine
+
+import (
+	"bytes"
+
+	"golang.org/x/xerrors"
+)
+
+// wasmMagic is the preamble for a Wasm binary module, magic number and version
+var wasmMagic = []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+
+// section ids for the Wasm binary format
+const (
+	sectionCustom    byte = 0
+	sectionType      byte = 1
+	sectionImport    byte = 2
+	sectionFunction  byte = 3
+	sectionTable     byte = 4
+	sectionMemory    byte = 5
+	sectionGlobal    byte = 6
+	sectionExport    byte = 7
+	sectionStart     byte = 8
+	sectionElement   byte = 9
+	sectionCode      byte = 10
+	sectionData      byte = 11
+	sectionDataCount byte = 12
+)
+
+// sectionOrder is the order that the known sections must appear in a module
+var sectionOrder = map[byte]int{
+	sectionType:      1,
+	sectionImport:    2,
+	sectionFunction:  3,
+	sectionTable:     4,
+	sectionMemory:    5,
+	sectionGlobal:    6,
+	sectionExport:    7,
+	sectionStart:     8,
+	sectionElement:   9,
+	sectionDataCount: 10,
+	sectionCode:      11,
+	sectionData:      12,
+}
+
+// external kinds used by imports and exports
+const (
+	externFunction byte = 0
+	externTable    byte = 1
+	externMemory   byte = 2
+	externGlobal   byte = 3
+)
+
+// value types
+const (
+	valueI32 byte = 0x7f
+	valueI64 byte = 0x7e
+	valueF32 byte = 0x7d
+	valueF64 byte = 0x7c
+)
+
+// wasmSection is a raw section in a Wasm module
+type wasmSection struct {
+	id   byte
+	data []byte
+}
+
+// wasmModule is a minimal representation of a Wasm binary module that
+// allows sections to be read and replaced
+type wasmModule struct {
+	sections []*wasmSection
+}
+
+// parseWasmModule splits the Wasm binary into its sections
+func parseWasmModule(b []byte) (*wasmModule, error) {
+	if !bytes.HasPrefix(b, wasmMagic) {
+		return nil, xerrors.Errorf("data is not a Wasm binary module")
+	}
+
+	m := &wasmModule{}
+	r := &wasmReader{data: b, pos: len(wasmMagic)}
+
+	for !r.eof() {
+		id := r.byte()
+		size := r.u32()
+		data := r.bytes(int(size))
+
+		if r.err != nil {
+			return nil, xerrors.Errorf("unable to read section %d: %w", id, r.err)
+		}
+
+		m.sections = append(m.sections, &wasmSection{id: id, data: data})
+	}
+
+	return m, nil
+}
+
+// bytes encodes the module in the Wasm binary format
+func (m *wasmModule) bytes() []byte {
+	out := append([]byte{}, wasmMagic...)
+
+	for _, s := range m.sections {
+		out = append(out, s.id)
+		out = appendU32(out, uint32(len(s.data)))
+		out = append(out, s.data...)
+	}
+
+	return out
+}
+
+// section returns the data for the section with the given id or nil
+// if the module does not contain the section
+func (m *wasmModule) section(id byte) []byte {
+	for _, s := range m.sections {
+		if s.id == id {
+			return s.data
+		}
+	}
+
+	return nil
+}
+
+// customSection returns the data for the custom section with the given
+// name, the name is not included in the returned data
+func (m *wasmModule) customSection(name string) []byte {
+	for _, s := range m.sections {
+		if s.id != sectionCustom {
+			continue
+		}
+
+		r := &wasmReader{data: s.data}
+		if r.name() == name && r.err == nil {
+			return s.data[r.pos:]
+		}
+	}
+
+	return nil
+}
+
+// nameSubsectionFunctions is the id of the function names in the name section
+const nameSubsectionFunctions byte = 1
+
+// functionNames returns the names of the functions from the name section keyed by
+// function index, including imported functions, nil is returned when the module
+// does not have a name section or the section does not contain function names
+func (m *wasmModule) functionNames() (map[uint32]string, error) {
+	data := m.customSection("name")
+	if data == nil {
+		return nil, nil
+	}
+
+	r := &wasmReader{data: data}
+	for !r.eof() {
+		id := r.byte()
+		size := r.u32()
+		sub := r.bytes(int(size))
+
+		if r.err != nil {
+			return nil, xerrors.Errorf("unable to read name section: %w", r.err)
+		}
+
+		if id != nameSubsectionFunctions {
+			continue
+		}
+
+		sr := &wasmReader{data: sub}
+		count := sr.u32()
+
+		names := map[uint32]string{}
+		for n := uint32(0); n < count && sr.err == nil; n++ {
+			index := sr.u32()
+			names[index] = sr.name()
+		}
+
+		if sr.err != nil {
+			return nil, xerrors.Errorf("unable to read function names: %w", sr.err)
+		}
+
+		return names, nil
+	}
+
+	return nil, nil
+}
+
+// setSection replaces the section with the given id, when the module does
+// not contain the section it is inserted in the correct position
+func (m *wasmModule) setSection(id byte, data []byte) {
+	for _, s := range m.sections {
+		if s.id == id {
+			s.data = data
+			return
+		}
+	}
+
+	n := len(m.sections)
+	for i, s := range m.sections {
+		if s.id != sectionCustom && sectionOrder[s.id] > sectionOrder[id] {
+			n = i
+			break
+		}
+	}
+
+	m.sections = append(m.sections, nil)
+	copy(m.sections[n+1:], m.sections[n:])
+	m.sections[n] = &wasmSection{id: id, data: data}
+}
+
+// wasmImports contains the number of each kind of import in a module
+type wasmImports struct {
+	functions uint32
+	globals   uint32
+	memories  []wasmLimits
+	// entries contains every import in the order they are declared
+	entries []wasmImport
+}
+
+// wasmImport is a single import in a module
+type wasmImport struct {
+	module string
+	name   string
+	kind   byte
+	// typeIndex is the index of the function type for function imports
+	typeIndex uint32
+	// valueType and mutable are the type of global imports
+	valueType byte
+	mutable   bool
+}
+
+// wasmFuncType is a function type from the type section
+type wasmFuncType struct {
+	params  []byte
+	results []byte
+}
+
+// encode returns the function type in the Wasm binary format
+func (f wasmFuncType) encode() []byte {
+	b := []byte{0x60}
+	b = appendU32(b, uint32(len(f.params)))
+	b = append(b, f.params...)
+	b = appendU32(b, uint32(len(f.results)))
+	return append(b, f.results...)
+}
+
+// valueTypeName returns the name of the Wasm value type used in the text format
+func valueTypeName(t byte) string {
+	switch t {
+	case valueI32:
+		return "i32"
+	case valueI64:
+		return "i64"
+	case valueF32:
+		return "f32"
+	case valueF64:
+		return "f64"
+	case 0x7b:
+		return "v128"
+	case 0x70:
+		return "funcref"
+	case 0x6f:
+		return "externref"
+	}
+
+	return "unknown"
+}
+
+// wasmMaxPages is the maximum number of 64KiB pages for a 32 bit memory
+const wasmMaxPages = 65536
+
+// wasmLimits are the limits for a memory or table
+type wasmLimits struct {
+	flags  byte
+	min    uint32
+	max    uint32
+	hasMax bool
+}
+
+// imports reads the import section of the module
+func (m *wasmModule) imports() (*wasmImports, error) {
+	i := &wasmImports{}
+
+	r := &wasmReader{data: m.section(sectionImport)}
+	if len(r.data) == 0 {
+		return i, nil
+	}
+
+	count := r.u32()
+	for n := uint32(0); n < count && r.err == nil; n++ {
+		e := wasmImport{module: r.name(), name: r.name(), kind: r.byte()}
+
+		switch e.kind {
+		case externFunction:
+			e.typeIndex = r.u32()
+			i.functions++
+		case externTable:
+			r.byte()
+			r.limits()
+		case externMemory:
+			i.memories = append(i.memories, r.limits())
+		case externGlobal:
+			e.valueType = r.byte()
+			e.mutable = r.byte() == 0x01
+			i.globals++
+		default:
+			return nil, xerrors.Errorf("unknown import kind %d", e.kind)
+		}
+
+		i.entries = append(i.entries, e)
+	}
+
+	if r.err != nil {
+		return nil, xerrors.Errorf("unable to read import section: %w", r.err)
+	}
+
+	return i, nil
+}
+
+// setImportFunctionTypes replaces the type of the imported functions, types is
+// a map of the function index to the new type index
+func (m *wasmModule) setImportFunctionTypes(types map[uint32]uint32) error {
+	count, rest, err := m.vectorCount(sectionImport)
+	if err != nil {
+		return err
+	}
+
+	r := &wasmReader{data: rest}
+	out := appendU32(nil, count)
+	function := uint32(0)
+
+	for n := uint32(0); n < count && r.err == nil; n++ {
+		start := r.pos
+		r.name()
+		r.name()
+
+		kind := r.byte()
+		if kind != externFunction {
+			switch kind {
+			case externTable:
+				r.byte()
+				r.limits()
+			case externMemory:
+				r.limits()
+			case externGlobal:
+				r.bytes(2)
+			default:
+				return xerrors.Errorf("unknown import kind %d", kind)
+			}
+
+			out = append(out, rest[start:r.pos]...)
+			continue
+		}
+
+		out = append(out, rest[start:r.pos]...)
+
+		t := r.u32()
+		if nt, ok := types[function]; ok {
+			t = nt
+		}
+
+		out = appendU32(out, t)
+		function++
+	}
+
+	if r.err != nil {
+		return xerrors.Errorf("unable to read import section: %w", r.err)
+	}
+
+	m.setSection(sectionImport, out)
+
+	return nil
+}
+
+// types reads the function types from the type section of the module
+func (m *wasmModule) types() ([]wasmFuncType, error) {
+	count, rest, err := m.vectorCount(sectionType)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &wasmReader{data: rest}
+	types := []wasmFuncType{}
+
+	for n := uint32(0); n < count && r.err == nil; n++ {
+		if form := r.byte(); form != 0x60 && r.err == nil {
+			return nil, xerrors.Errorf("unknown type form %d", form)
+		}
+
+		ft := wasmFuncType{}
+		ft.params = r.bytes(int(r.u32()))
+		ft.results = r.bytes(int(r.u32()))
+
+		types = append(types, ft)
+	}
+
+	if r.err != nil {
+		return nil, xerrors.Errorf("unable to read type section: %w", r.err)
+	}
+
+	return types, nil
+}
+
+// vectorCount returns the number of entries in a section that is encoded as a vector
+// and the remaining section data after the count
+func (m *wasmModule) vectorCount(id byte) (uint32, []byte, error) {
+	data := m.section(id)
+	if data == nil {
+		return 0, nil, nil
+	}
+
+	r := &wasmReader{data: data}
+	count := r.u32()
+	if r.err != nil {
+		return 0, nil, xerrors.Errorf("unable to read section %d: %w", id, r.err)
+	}
+
+	return count, data[r.pos:], nil
+}
+
+// appendToVector appends the encoded entries to the section that is encoded
+// as a vector, entries is the number of entries that are added.
+// The index of the first appended entry is returned.
+func (m *wasmModule) appendToVector(id byte, entries uint32, data []byte) (uint32, error) {
+	count, rest, err := m.vectorCount(id)
+	if err != nil {
+		return 0, err
+	}
+
+	out := appendU32(nil, count+entries)
+	out = append(out, rest...)
+	out = append(out, data...)
+
+	m.setSection(id, out)
+
+	return count, nil
+}
+
+// wasmReader reads values encoded in the Wasm binary format, the first
+// error encountered is stored and subsequent reads return zero values
+type wasmReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+var errUnexpectedEOF = xerrors.New("unexpected end of data")
+
+func (r *wasmReader) eof() bool {
+	return r.pos >= len(r.data)
+}
+
+func (r *wasmReader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+
+	if r.eof() {
+		r.err = errUnexpectedEOF
+		return 0
+	}
+
+	b := r.data[r.pos]
+	r.pos++
+
+	return b
+}
+
+func (r *wasmReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+
+	if n < 0 || r.pos+n > len(r.data) {
+		r.err = errUnexpectedEOF
+		return nil
+	}
+
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+
+	return b
+}
+
+// u32 reads an unsigned LEB128 encoded integer
+func (r *wasmReader) u32() uint32 {
+	return uint32(r.uleb(32))
+}
+
+// s32 reads a signed LEB128 encoded 32 bit integer
+func (r *wasmReader) s32() int32 {
+	return int32(r.sleb(32))
+}
+
+// s64 reads a signed LEB128 encoded 64 bit integer
+func (r *wasmReader) s64() int64 {
+	return r.sleb(64)
+}
+
+func (r *wasmReader) uleb(bits uint) uint64 {
+	var result uint64
+	var shift uint
+
+	for {
+		b := r.byte()
+		if r.err != nil {
+			return 0
+		}
+
+		result |= uint64(b&0x7f) << shift
+		shift += 7
+
+		if b&0x80 == 0 {
+			return result
+		}
+
+		if shift >= bits+7 {
+			r.err = xerrors.Errorf("integer representation too long")
+			return 0
+		}
+	}
+}
+
+func (r *wasmReader) sleb(bits uint) int64 {
+	var result int64
+	var shift uint
+
+	for {
+		b := r.byte()
+		if r.err != nil {
+			return 0
+		}
+
+		result |= int64(b&0x7f) << shift
+		shift += 7
+
+		if b&0x80 == 0 {
+			if shift < 64 && b&0x40 != 0 {
+				result |= -1 << shift
+			}
+
+			return result
+		}
+
+		if shift >= bits+7 {
+			r.err = xerrors.Errorf("integer representation too long")
+			return 0
+		}
+	}
+}
+
+// name reads a UTF-8 string prefixed with its length
+func (r *wasmReader) name() string {
+	n := r.u32()
+	return string(r.bytes(int(n)))
+}
+
+// limits reads the limits for a memory or table
+func (r *wasmReader) limits() wasmLimits {
+	l := wasmLimits{}
+
+	l.flags = r.byte()
+	l.min = r.u32()
+
+	if l.flags&0x01 != 0 {
+		l.max = r.u32()
+		l.hasMax = true
+	}
+
+	return l
+}
+
+// appendU32 appends the unsigned LEB128 encoding of v to b
+func appendU32(b []byte, v uint32) []byte {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+
+		if v == 0 {
+			return append(b, c)
+		}
+
+		b = append(b, c|0x80)
+	}
+}
+
+// appendS64 appends the signed LEB128 encoding of v to b
+func appendS64(b []byte, v int64) []byte {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+
+		if (v == 0 && c&0x40 == 0) || (v == -1 && c&0x40 != 0) {
+			return append(b, c)
+		}
+
+		b = append(b, c|0x80)
+	}
+}
+
+// appendName appends a UTF-8 string prefixed with its length to b
+func appendName(b []byte, s string) []byte {
+	b = appendU32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+// appendLimits appends the encoded limits to b
+func appendLimits(b []byte, l wasmLimits) []byte {
+	if l.hasMax {
+		b = append(b, l.flags|0x01)
+		b = appendU32(b, l.min)
+		return appendU32(b, l.max)
+	}
+
+	b = append(b, l.flags&^0x01)
+	return appendU32(b, l.min)
+}
@@ -0,0 +1,376 @@
+package engine
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/nicholasjackson/wasp/engine/logger"
+	"golang.org/x/xerrors"
+)
+
+// ErrWorkspaceClosed is returned when a closed Workspace is attached to an
+// instance or a plugin attempts to lock a file in a closed workspace
+var ErrWorkspaceClosed = xerrors.New("workspace is closed")
+
+// ErrNoWorkspace is returned to a plugin that attempts to lock a file when the
+// instance does not have a Workspace
+var ErrNoWorkspace = xerrors.New("instance does not have a workspace")
+
+// ErrLockNotHeld is returned to a plugin that attempts to unlock a file it has not locked
+var ErrLockNotHeld = xerrors.New("lock is not held by the instance")
+
+// ErrLockDeadlock is returned to a plugin that attempts to upgrade a shared lock to an
+// exclusive lock while another instance holding the shared lock is waiting to upgrade it,
+// the plugin should release the shared lock to allow the other instance to continue
+var ErrLockDeadlock = xerrors.New("upgrading the lock would deadlock with another instance")
+
+// Workspace is a directory shared by a group of instances, the directory is
+// mounted to /workspace in every instance the Workspace is attached to. Plugins
+// can coordinate access to the files in the workspace using advisory locks, the
+// locks do not prevent access to the files.
+type Workspace struct {
+	dir    string
+	engine *Wasm
+
+	mutex  sync.Mutex
+	locks  map[string]*workspaceLock
+	closed bool
+
+	// released is closed and replaced when a lock is released or the workspace
+	// is closed, waiting lock requests retry when it is closed
+	released chan struct{}
+}
+
+// workspaceLock is the state of a lock on a path in the workspace, a lock is held
+// exclusively by a single instance or shared by many instances
+type workspaceLock struct {
+	exclusive bool
+	owners    map[uint64]bool
+
+	// upgrading is the owner waiting to convert its shared lock to an exclusive lock,
+	// 0 when no owner is waiting
+	upgrading uint64
+}
+
+// NewWorkspace creates a Workspace with a new empty directory, the directory is
+// removed when the workspace is closed. The engine tracks the workspaces it creates
+// and closes any that are still open when the engine is closed.
+func (w *Wasm) NewWorkspace() (*Workspace, error) {
+	dir, err := os.MkdirTemp("", "wasp-workspace-")
+	if err != nil {
+		return nil, xerrors.Errorf("unable to create workspace directory: %w", err)
+	}
+
+	ws := &Workspace{
+		dir:      dir,
+		engine:   w,
+		locks:    map[string]*workspaceLock{},
+		released: make(chan struct{}),
+	}
+
+	w.workspaceMutex.Lock()
+	defer w.workspaceMutex.Unlock()
+
+	if w.workspaces == nil {
+		w.workspaces = map[*Workspace]bool{}
+	}
+
+	w.workspaces[ws] = true
+
+	return ws, nil
+}
+
+// Close closes all the workspaces created by the engine that are still open, the
+// engine and any instances created by it should not be used after Close
+func (w *Wasm) Close() error {
+	w.workspaceMutex.Lock()
+	workspaces := []*Workspace{}
+	for ws := range w.workspaces {
+		workspaces = append(workspaces, ws)
+	}
+	w.workspaceMutex.Unlock()
+
+	var closeErr error
+	for _, ws := range workspaces {
+		err := ws.Close()
+		if err != nil && closeErr == nil {
+			closeErr = err
+		}
+	}
+
+	return closeErr
+}
+
+// Dir returns the directory on the host for the workspace
+func (ws *Workspace) Dir() string {
+	return ws.dir
+}
+
+// Close releases all locks and removes the workspace directory, instances using
+// the workspace should be removed before the workspace is closed
+func (ws *Workspace) Close() error {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+
+	if ws.closed {
+		return nil
+	}
+
+	ws.closed = true
+	ws.locks = map[string]*workspaceLock{}
+	ws.notify()
+
+	ws.engine.workspaceMutex.Lock()
+	delete(ws.engine.workspaces, ws)
+	ws.engine.workspaceMutex.Unlock()
+
+	err := os.RemoveAll(ws.dir)
+	if err != nil {
+		return xerrors.Errorf("unable to remove workspace directory %s: %w", ws.dir, err)
+	}
+
+	return nil
+}
+
+// isClosed returns true when the workspace has been closed
+func (ws *Workspace) isClosed() bool {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+
+	return ws.closed
+}
+
+// lockKey returns the path of the file relative to the workspace, paths can be
+// relative to the workspace or absolute paths in /workspace
+func lockKey(p string) (string, error) {
+	key := path.Clean(p)
+
+	if path.IsAbs(key) {
+		root := "/" + workspaceMount + "/"
+		if !strings.HasPrefix(key, root) {
+			return "", xerrors.Errorf("path %s is not a file in the workspace", p)
+		}
+
+		key = strings.TrimPrefix(key, root)
+	}
+
+	if key == "." || key == ".." || strings.HasPrefix(key, "../") {
+		return "", xerrors.Errorf("path %s is not a file in the workspace", p)
+	}
+
+	return key, nil
+}
+
+// lock acquires the lock on the path for the owner, when the lock is held by another
+// instance lock waits until the lock is released or the context is done
+func (ws *Workspace) lock(ctx context.Context, owner uint64, p string, exclusive bool) error {
+	key, err := lockKey(p)
+	if err != nil {
+		return err
+	}
+
+	defer ws.stopUpgrade(owner, key)
+
+	for {
+		ws.mutex.Lock()
+		ok, err := ws.acquire(owner, key, exclusive)
+		if err == nil && !ok && exclusive {
+			err = ws.startUpgrade(owner, key)
+		}
+
+		released := ws.released
+		ws.mutex.Unlock()
+
+		if err != nil || ok {
+			return err
+		}
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// startUpgrade records that the owner is waiting to convert its shared lock to an
+// exclusive lock, two owners waiting to upgrade the same lock would wait for each
+// other forever so ErrLockDeadlock is returned. The mutex must be held.
+func (ws *Workspace) startUpgrade(owner uint64, key string) error {
+	l := ws.locks[key]
+	if !l.owners[owner] || l.exclusive {
+		return nil
+	}
+
+	if l.upgrading != 0 && l.upgrading != owner {
+		return ErrLockDeadlock
+	}
+
+	l.upgrading = owner
+
+	return nil
+}
+
+// stopUpgrade clears the upgrade for the owner once the lock request has completed
+func (ws *Workspace) stopUpgrade(owner uint64, key string) {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+
+	if l, ok := ws.locks[key]; ok && l.upgrading == owner {
+		l.upgrading = 0
+	}
+}
+
+// tryLock acquires the lock on the path for the owner without waiting, false is
+// returned when the lock is held by another instance
+func (ws *Workspace) tryLock(owner uint64, p string, exclusive bool) (bool, error) {
+	key, err := lockKey(p)
+	if err != nil {
+		return false, err
+	}
+
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+
+	return ws.acquire(owner, key, exclusive)
+}
+
+// acquire takes the lock when it is not held by another instance, an owner that
+// already holds the lock converts it to the requested type. The mutex must be held.
+func (ws *Workspace) acquire(owner uint64, key string, exclusive bool) (bool, error) {
+	if ws.closed {
+		return false, ErrWorkspaceClosed
+	}
+
+	l, ok := ws.locks[key]
+	if !ok {
+		ws.locks[key] = &workspaceLock{exclusive: exclusive, owners: map[uint64]bool{owner: true}}
+		return true, nil
+	}
+
+	others := len(l.owners)
+	if l.owners[owner] {
+		others--
+	}
+
+	// shared locks can be held by many owners, exclusive locks by one
+	if others > 0 && (exclusive || l.exclusive) {
+		return false, nil
+	}
+
+	// converting an exclusive lock to a shared lock allows waiting requests to continue
+	if l.exclusive && !exclusive {
+		ws.notify()
+	}
+
+	l.exclusive = exclusive
+	l.owners[owner] = true
+
+	return true, nil
+}
+
+// unlock releases the lock on the path held by the owner
+func (ws *Workspace) unlock(owner uint64, p string) error {
+	key, err := lockKey(p)
+	if err != nil {
+		return err
+	}
+
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+
+	l, ok := ws.locks[key]
+	if !ok || !l.owners[owner] {
+		return ErrLockNotHeld
+	}
+
+	ws.releaseLock(owner, key, l)
+
+	return nil
+}
+
+// release releases all the locks held by the owner
+func (ws *Workspace) release(owner uint64) {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+
+	for key, l := range ws.locks {
+		if l.owners[owner] {
+			ws.releaseLock(owner, key, l)
+		}
+	}
+}
+
+// releaseLock removes the owner from the lock and wakes any waiting lock requests,
+// the mutex must be held
+func (ws *Workspace) releaseLock(owner uint64, key string, l *workspaceLock) {
+	delete(l.owners, owner)
+	if len(l.owners) == 0 {
+		delete(ws.locks, key)
+	}
+
+	ws.notify()
+}
+
+// notify wakes the waiting lock requests, the mutex must be held
+func (ws *Workspace) notify() {
+	close(ws.released)
+	ws.released = make(chan struct{})
+}
+
+// workspaceCallbacks returns the default imports that allow a plugin to lock files
+// in the workspace attached to the instance, the locks are owned by the instance
+func workspaceCallbacks(i Instance, ws *Workspace, owner uint64, l *logger.Wrapper) *Callbacks {
+	cb := &Callbacks{}
+
+	// workspace_lock waits until the lock is acquired, the wait is stopped when the
+	// context for the function call is done
+	cb.AddCallback(
+		"env",
+		"workspace_lock",
+		func(p string, exclusive bool) error {
+			if ws == nil {
+				return ErrNoWorkspace
+			}
+
+			err := ws.lock(i.callContext(), owner, p, exclusive)
+			if err != nil && i.callContext().Err() != nil {
+				l.Debug("Workspace lock cancelled", "path", p, "error", err)
+				i.interrupt()
+			}
+
+			return err
+		},
+	)
+
+	// workspace_try_lock returns 1 when the lock is acquired and 0 when the lock is
+	// held by another instance
+	cb.AddCallback(
+		"env",
+		"workspace_try_lock",
+		func(p string, exclusive bool) (bool, error) {
+			if ws == nil {
+				return false, ErrNoWorkspace
+			}
+
+			return ws.tryLock(owner, p, exclusive)
+		},
+	)
+
+	cb.AddCallback(
+		"env",
+		"workspace_unlock",
+		func(p string) error {
+			if ws == nil {
+				return ErrNoWorkspace
+			}
+
+			return ws.unlock(owner, p)
+		},
+	)
+
+	return cb
+}
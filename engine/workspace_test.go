@@ -0,0 +1,282 @@
+package engine
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nicholasjackson/wasp/engine/logger"
+	"github.com/stretchr/testify/require"
+)
+
+// watWorkspace is a module that locks files in the workspace, the functions return
+// the result of last_host_error after calling the import
+var watWorkspace = `
+(module
+	(import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+	(import "env" "workspace_lock" (func $lock (param i32 i32)))
+	(import "env" "workspace_try_lock" (func $try_lock (param i32 i32) (result i32)))
+	(import "env" "workspace_unlock" (func $unlock (param i32)))
+	(import "env" "last_host_error" (func $last_host_error (result i32)))
+	(memory (export "memory") 1)
+	(data (i32.const 0x100) "data.txt\00")
+	(data (i32.const 0x120) "/workspace/data.txt\00")
+	(data (i32.const 0x140) "../data.txt\00")
+	(global $next (mut i32) (i32.const 1024))
+	(func (export "allocate") (param $size i32) (result i32)
+		(local $addr i32)
+		(local.set $addr (global.get $next))
+		(global.set $next (i32.add (global.get $next) (local.get $size)))
+		(local.get $addr))
+	(func (export "deallocate") (param i32 i32))
+	(func (export "get_string_size") (param $p i32) (result i32)
+		(local $n i32)
+		(block $done
+			(loop $l
+				(br_if $done (i32.eqz (i32.load8_u (i32.add (local.get $p) (local.get $n)))))
+				(local.set $n (i32.add (local.get $n) (i32.const 1)))
+				(br $l)))
+		(local.get $n))
+	(func (export "lock") (param $path i32) (param $exclusive i32) (result i32)
+		(call $lock (local.get $path) (local.get $exclusive))
+		(call $last_host_error))
+	(func (export "try_lock") (param $path i32) (param $exclusive i32) (result i32)
+		(call $try_lock (local.get $path) (local.get $exclusive)))
+	(func (export "unlock") (param $path i32) (result i32)
+		(call $unlock (local.get $path))
+		(call $last_host_error)))
+`
+
+const (
+	pathLock         = 0x100
+	pathLockAbsolute = 0x120
+	pathLockEscape   = 0x140
+)
+
+func setupWorkspaceInstances(t *testing.T, n int) ([]Instance, *Workspace) {
+	e := New(logger.New(nil, nil, nil, nil))
+
+	err := e.RegisterPluginBytes("test", watToWasm(t, watWorkspace), nil)
+	require.NoError(t, err)
+
+	ws, err := e.NewWorkspace()
+	require.NoError(t, err)
+
+	t.Cleanup(func() { ws.Close() })
+
+	instances := []Instance{}
+	for j := 0; j < n; j++ {
+		i, err := e.GetInstanceWithOptions("test", InstanceOptions{Workspace: ws})
+		require.NoError(t, err)
+
+		instances = append(instances, i)
+	}
+
+	return instances, ws
+}
+
+func TestWorkspaceIsCreatedAndRemoved(t *testing.T) {
+	e := New(logger.New(nil, nil, nil, nil))
+
+	ws, err := e.NewWorkspace()
+	require.NoError(t, err)
+	require.DirExists(t, ws.Dir())
+
+	err = os.WriteFile(filepath.Join(ws.Dir(), "data.txt"), []byte("data"), 0644)
+	require.NoError(t, err)
+
+	err = ws.Close()
+	require.NoError(t, err)
+	require.NoDirExists(t, ws.Dir())
+
+	err = e.RegisterPluginBytes("test", watToWasm(t, watWorkspace), nil)
+	require.NoError(t, err)
+
+	_, err = e.GetInstanceWithOptions("test", InstanceOptions{Workspace: ws})
+	require.ErrorIs(t, err, ErrWorkspaceClosed)
+}
+
+func TestEngineCloseRemovesWorkspaces(t *testing.T) {
+	e := New(logger.New(nil, nil, nil, nil))
+
+	ws1, err := e.NewWorkspace()
+	require.NoError(t, err)
+
+	ws2, err := e.NewWorkspace()
+	require.NoError(t, err)
+
+	err = ws1.Close()
+	require.NoError(t, err)
+	require.Len(t, e.workspaces, 1)
+
+	err = e.Close()
+	require.NoError(t, err)
+	require.NoDirExists(t, ws2.Dir())
+	require.True(t, ws2.isClosed())
+	require.Empty(t, e.workspaces)
+}
+
+func TestWorkspaceExclusiveLock(t *testing.T) {
+	instances, _ := setupWorkspaceInstances(t, 2)
+
+	var acquired bool
+	err := instances[0].CallFunction("try_lock", &acquired, pathLock, 1)
+	require.NoError(t, err)
+	require.True(t, acquired)
+
+	// the absolute path in the workspace refers to the same lock
+	err = instances[1].CallFunction("try_lock", &acquired, pathLockAbsolute, 0)
+	require.NoError(t, err)
+	require.False(t, acquired)
+
+	var msg string
+	err = instances[1].CallFunction("unlock", &msg, pathLock)
+	require.NoError(t, err)
+	require.Equal(t, ErrLockNotHeld.Error(), msg)
+
+	err = instances[0].CallFunction("unlock", &msg, pathLock)
+	require.NoError(t, err)
+	require.Empty(t, msg)
+
+	err = instances[1].CallFunction("try_lock", &acquired, pathLock, 1)
+	require.NoError(t, err)
+	require.True(t, acquired)
+}
+
+func TestWorkspaceSharedLock(t *testing.T) {
+	instances, _ := setupWorkspaceInstances(t, 3)
+
+	var acquired bool
+	for _, i := range instances[:2] {
+		err := i.CallFunction("try_lock", &acquired, pathLock, 0)
+		require.NoError(t, err)
+		require.True(t, acquired)
+	}
+
+	err := instances[2].CallFunction("try_lock", &acquired, pathLock, 1)
+	require.NoError(t, err)
+	require.False(t, acquired)
+}
+
+func TestWorkspaceLockWaitsForRelease(t *testing.T) {
+	instances, _ := setupWorkspaceInstances(t, 2)
+
+	var msg string
+	err := instances[0].CallFunction("lock", &msg, pathLock, 1)
+	require.NoError(t, err)
+	require.Empty(t, msg)
+
+	done := make(chan error)
+	go func() {
+		var msg string
+		done <- instances[1].CallFunction("lock", &msg, pathLock, 1)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("lock was acquired while held by another instance")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// removing the instance releases the locks it holds
+	err = instances[0].Remove()
+	require.NoError(t, err)
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("lock was not acquired after it was released")
+	}
+}
+
+func TestWorkspaceLockUpgradeReturnsErrorWhenDeadlocked(t *testing.T) {
+	instances, _ := setupWorkspaceInstances(t, 2)
+
+	var msg string
+	for _, i := range instances {
+		err := i.CallFunction("lock", &msg, pathLock, 0)
+		require.NoError(t, err)
+		require.Empty(t, msg)
+	}
+
+	// the first upgrade waits for the other instance to release its shared lock
+	done := make(chan string)
+	go func() {
+		var msg string
+		instances[0].CallFunction("lock", &msg, pathLock, 1)
+		done <- msg
+	}()
+
+	require.Eventually(t, func() bool {
+		ws := instances[0].(*wasmerInstance).workspace
+		ws.mutex.Lock()
+		defer ws.mutex.Unlock()
+
+		return ws.locks["data.txt"].upgrading != 0
+	}, time.Second, time.Millisecond)
+
+	// the second upgrade would wait for the first forever
+	err := instances[1].CallFunction("lock", &msg, pathLock, 1)
+	require.NoError(t, err)
+	require.Equal(t, ErrLockDeadlock.Error(), msg)
+
+	err = instances[1].CallFunction("unlock", &msg, pathLock)
+	require.NoError(t, err)
+
+	select {
+	case msg := <-done:
+		require.Empty(t, msg)
+	case <-time.After(time.Second):
+		t.Fatal("lock was not upgraded after the shared lock was released")
+	}
+}
+
+func TestWorkspaceLockStopsWhenContextIsDone(t *testing.T) {
+	instances, _ := setupWorkspaceInstances(t, 2)
+
+	var msg string
+	err := instances[0].CallFunction("lock", &msg, pathLock, 1)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err = instances[1].CallFunctionContext(ctx, "lock", &msg, pathLock, 0)
+	require.ErrorIs(t, err, ErrCallTimeout)
+}
+
+func TestWorkspaceLockRejectsPathsOutsideWorkspace(t *testing.T) {
+	instances, _ := setupWorkspaceInstances(t, 1)
+
+	var msg string
+	err := instances[0].CallFunction("lock", &msg, pathLockEscape, 1)
+	require.NoError(t, err)
+	require.Contains(t, msg, "is not a file in the workspace")
+}
+
+func TestWorkspaceLockWithoutWorkspace(t *testing.T) {
+	i := setupWatInstance(t, watWorkspace, nil)
+
+	var msg string
+	err := i.CallFunction("lock", &msg, pathLock, 1)
+	require.NoError(t, err)
+	require.Equal(t, ErrNoWorkspace.Error(), msg)
+}
+
+func TestGetInstanceRejectsWorkspaceAndWorkspaceDir(t *testing.T) {
+	e := New(logger.New(nil, nil, nil, nil))
+
+	err := e.RegisterPluginBytes("test", watToWasm(t, watWorkspace), nil)
+	require.NoError(t, err)
+
+	ws, err := e.NewWorkspace()
+	require.NoError(t, err)
+
+	defer ws.Close()
+
+	_, err = e.GetInstanceWithOptions("test", InstanceOptions{Workspace: ws, WorkspaceDir: t.TempDir()})
+	require.Error(t, err)
+}
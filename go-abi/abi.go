@@ -6,6 +6,8 @@ package abi
 import "C"
 import (
 	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"unsafe"
 )
 
@@ -77,6 +79,29 @@ func String(in string) WasmString {
 	return ws
 }
 
+// JSON is a helper that returns WasmBytes containing the JSON encoding of v,
+// it can be used to return structured values to CallFunction when the plugin
+// is registered with EncodeArguments
+func JSON(v interface{}) WasmBytes {
+	d, err := json.Marshal(v)
+	if err != nil {
+		Error(err.Error())
+		return 0
+	}
+
+	wb := WasmBytes(0)
+	wb.Copy(d)
+
+	return wb
+}
+
+// UnmarshalJSON decodes the JSON in the WasmBytes into v, it can be used to
+// read structured values passed by CallFunction when the plugin is registered
+// with EncodeArguments
+func UnmarshalJSON(data WasmBytes, v interface{}) error {
+	return json.Unmarshal(data.Bytes(), v)
+}
+
 /* DEFAULT ABI */
 
 // allocate memory that can be written to by the Wasm host
@@ -121,7 +146,81 @@ func Error(in string) {
 	raise_error(err)
 }
 
+//export raise_error_v2
+func raise_error_v2(in WasmBytes)
+
+// pluginError is the JSON payload for raise_error_v2
+type pluginError struct {
+	Code    int               `json:"code"`
+	Message string            `json:"message"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// ErrorWithCode passes an error with a code and optional details back to the host,
+// CallFunction returns the error as an engine.PluginError
+func ErrorWithCode(code int, msg string, details map[string]string) {
+	d, err := json.Marshal(pluginError{Code: code, Message: msg, Details: details})
+	if err != nil {
+		Error(msg)
+		return
+	}
+
+	payload := WasmBytes(0)
+	payload.Copy(d)
+
+	raise_error_v2(payload)
+}
+
+// last_host_error returns the error returned by the last host callback
+// that returns an error, 0 when the callback succeeded
+//
+//export last_host_error
+func last_host_error() WasmString
+
+// LastHostError returns the error returned by the last host callback that can
+// return an error, nil is returned when the callback succeeded. When a callback
+// returns an error the values returned to the module are zero values.
+func LastHostError() error {
+	err := last_host_error()
+	if err == 0 {
+		return nil
+	}
+
+	return errors.New(err.String())
+}
+
 // Default workspace directory if available
 const DirWorkspace = "/workspace"
 
+//export workspace_lock
+func workspace_lock(path WasmString, exclusive bool)
+
+//export workspace_try_lock
+func workspace_try_lock(path WasmString, exclusive bool) bool
+
+//export workspace_unlock
+func workspace_unlock(path WasmString)
+
+// Lock acquires an advisory lock on a file in the workspace, the path is relative
+// to the workspace or an absolute path in /workspace. Shared locks can be held by
+// many instances, exclusive locks by one. Lock waits until the lock is available.
+func Lock(path string, exclusive bool) error {
+	workspace_lock(String(path), exclusive)
+	return LastHostError()
+}
+
+// TryLock acquires an advisory lock on a file in the workspace without waiting,
+// false is returned when the lock is held by another instance
+func TryLock(path string, exclusive bool) (bool, error) {
+	ok := workspace_try_lock(String(path), exclusive)
+	return ok, LastHostError()
+}
+
+// Unlock releases a lock acquired with Lock or TryLock, locks are also released
+// when the instance is removed
+func Unlock(path string) error {
+	workspace_unlock(String(path))
+	return LastHostError()
+}
+
 /* END DEFAULT ABI */
@@ -1,14 +1,16 @@
 module github.com/nicholasjackson/wasp
 
-go 1.15
+go 1.16
 
 require (
 	github.com/hashicorp/go-hclog v0.16.0
 	github.com/niemeyer/pretty v0.0.0-20200227124842-a10e7caefd8e // indirect
 	github.com/stretchr/testify v1.7.0
+	github.com/vmihailenco/msgpack/v5 v5.3.5
 	github.com/wasmerio/wasmer-go v1.0.3
-	go.uber.org/goleak v1.1.10 // indirect
+	go.uber.org/goleak v1.1.10
 	golang.org/x/lint v0.0.0-20201208152925-83fdc39ff7b5 // indirect
 	golang.org/x/tools v0.1.0 // indirect
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1
+	google.golang.org/protobuf v1.27.1
 )